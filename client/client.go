@@ -3,8 +3,10 @@ package client
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"math/rand"
 	"os"
 	"strconv"
@@ -21,6 +23,28 @@ const (
 	LockRelease
 )
 
+// Reason codes the locking service sends with a failed LockAcquireReply or
+// LockRenewReply
+const (
+	LockReasonHeld           string = "LOCK_HELD"
+	LockReasonWaitTimeout    string = "WAIT_TIMEOUT"
+	LockReasonDeadlock       string = "DEADLOCK"
+	LockReasonSessionExpired string = "SESSION_EXPIRED"
+	LockReasonNotHeld        string = "NOT_HELD"
+)
+
+var (
+	ErrLockHeld        = errors.New("lock is held by another client")
+	ErrLockWaitTimeout = errors.New("timed out waiting for lock")
+	// ErrLockDeadlock is returned when the server aborted the request to break
+	// a wait-for cycle. Release held locks before retrying.
+	ErrLockDeadlock       = errors.New("lock request aborted to break a deadlock")
+	ErrLockSessionExpired = errors.New("session expired before the lock was granted")
+	// ErrLockNotHeld is returned when the cluster answered that the client
+	// does not hold the lock, as opposed to not answering at all.
+	ErrLockNotHeld = errors.New("lock is not held by this client")
+)
+
 type FencingToken struct {
 	Key   string
 	Value uint64
@@ -29,29 +53,58 @@ type FencingToken struct {
 type LockRequest struct {
 	CommandType LockCommandType `json:"commandType"`
 	Key         string          `json:"key"`
+	Keys        []string        `json:"keys,omitempty"`
 	ClientID    string          `json:"clientId"`
 	TTL         time.Duration   `json:"ttl"`
+	TryAcquire  bool            `json:"tryAcquire"`
+	WaitTimeout time.Duration   `json:"waitTimeout"`
+	Reentrant   bool            `json:"reentrant"`
+	OwnerToken  string          `json:"ownerToken,omitempty"`
+	Priority    int             `json:"priority,omitempty"`
 }
 type LockAcquireReply struct {
-	Success      bool
-	FencingToken FencingToken
+	Success       bool
+	Key           string
+	Keys          []string
+	FencingToken  FencingToken
+	FencingTokens []FencingToken
+	Reason        string
+}
+
+type LockReleaseReply struct {
+	Success bool
+	Key     string
+	Keys    []string
+	Error   string
+}
+
+type LockRenewReply struct {
+	Success    bool
+	Key        string
+	ExpiryTime time.Time
+	Reason     string
+	Error      string
 }
 
 type ConnectionRequest struct {
-	ClientID string `json:"clientID"`
+	ClientID   string        `json:"clientID"`
+	SessionID  string        `json:"sessionID,omitempty"`
+	SessionTTL time.Duration `json:"sessionTTL,omitempty"`
 }
 
 type ConnectionReply struct {
-	Success bool
-	Leader  int64
+	Success    bool
+	Leader     int64
+	SessionID  string
+	SessionTTL time.Duration
 }
 
 var (
-	Conn          *websocket.Conn
-	ClientID      string
-	servers       []uint64
-	responseChan  chan []byte
-	reconnectedCh chan struct{} // Notification channel
+	Conn     *websocket.Conn
+	ClientID string
+	servers  []uint64
+
+	elections = make(map[string]*Election)
 )
 
 func selectRandomServer(serverId int64) uint64 {
@@ -103,6 +156,7 @@ func connectToLeader() {
 
 		if reply.Success {
 			log.Printf("Connected to leader %d", serverId)
+			adoptSession(reply.SessionID, reply.SessionTTL)
 			return
 		}
 	}
@@ -110,21 +164,20 @@ func connectToLeader() {
 
 func startReader() {
 	for {
-		responseChan = make(chan []byte)
 		connectToLeader()
-
-		reconnectedCh <- struct{}{}
+		markConnected()
+		go resumeWatches()
 
 		for {
 			_, message, err := Conn.ReadMessage()
 			if err != nil {
 				log.Printf("Connection lost: %v", err)
-				close(responseChan)
+				markDisconnected()
 				Conn.Close()
 				break
 			}
 
-			responseChan <- message
+			dispatch(message)
 		}
 	}
 }
@@ -137,9 +190,13 @@ func connectToServer(serverId uint64) error {
 	if err != nil {
 		return err
 	}
+	connMu.Lock()
 	connectionReq := ConnectionRequest{
-		ClientID: ClientID,
+		ClientID:   ClientID,
+		SessionID:  SessionID,
+		SessionTTL: SessionTTL,
 	}
+	connMu.Unlock()
 
 	data, err := json.Marshal(connectionReq)
 	if err != nil {
@@ -158,90 +215,206 @@ func connectToServer(serverId uint64) error {
 	return nil
 }
 
-func acquireLock(key string, ttl int64) {
-	for {
-		lockReq := LockRequest{
-			CommandType: LockAcquire,
-			Key:         key,
-			ClientID:    ClientID,
-			TTL:         time.Duration(ttl) * time.Second,
-		}
+// AcquireLock blocks until the lock is granted. A positive waitTimeout bounds
+// how long the request may sit in the server's queue; ErrLockWaitTimeout is
+// returned once it expires.
+func AcquireLock(key string, ttl time.Duration, waitTimeout time.Duration) (FencingToken, error) {
+	return acquireLock(LockRequest{
+		CommandType: LockAcquire,
+		Key:         key,
+		ClientID:    ClientID,
+		TTL:         ttl,
+		WaitTimeout: waitTimeout,
+	})
+}
 
-		data, err := json.Marshal(lockReq)
-		if err != nil {
-			log.Printf("json marshal error: %v", err)
-			return
-		}
+// AcquireLockWithPriority is AcquireLock for locks served by the PRIORITY
+// policy: waiters with a higher priority are granted the lock first. Other
+// policies ignore the priority.
+func AcquireLockWithPriority(key string, ttl time.Duration, waitTimeout time.Duration, priority int) (FencingToken, error) {
+	return acquireLock(LockRequest{
+		CommandType: LockAcquire,
+		Key:         key,
+		ClientID:    ClientID,
+		TTL:         ttl,
+		WaitTimeout: waitTimeout,
+		Priority:    priority,
+	})
+}
 
-		// Retry loop for sending requests
-		for {
-			if Conn == nil {
-				// log.Println("Waiting for reconnection...")
-				time.Sleep(time.Second)
-				continue
-			}
-			err := Conn.WriteMessage(websocket.TextMessage, data)
-			if err != nil {
-				log.Printf("error sending lock command: %v", err)
-				time.Sleep(time.Second)
-				continue
-			}
-			log.Printf("Sent lock acquire command: %s", data)
-			break
-		}
+// TryAcquireLock fails with ErrLockHeld right away instead of queueing if the
+// lock is currently held or already has waiters.
+func TryAcquireLock(key string, ttl time.Duration) (FencingToken, error) {
+	return acquireLock(LockRequest{
+		CommandType: LockAcquire,
+		Key:         key,
+		ClientID:    ClientID,
+		TTL:         ttl,
+		TryAcquire:  true,
+	})
+}
 
-		select {
-		case message, ok := <-responseChan:
-			if !ok {
-				// log.Println("Connection lost, waiting for reconnection...")
-				<-reconnectedCh
-				continue
-			}
+// AcquireReentrantLock acquires a lock that the same client and owner token
+// may acquire again while holding it. Every acquisition returns the same
+// fencing token and must be matched by a ReleaseReentrantLock.
+func AcquireReentrantLock(key string, ownerToken string, ttl time.Duration, waitTimeout time.Duration) (FencingToken, error) {
+	return acquireLock(LockRequest{
+		CommandType: LockAcquire,
+		Key:         key,
+		ClientID:    ClientID,
+		TTL:         ttl,
+		WaitTimeout: waitTimeout,
+		Reentrant:   true,
+		OwnerToken:  ownerToken,
+	})
+}
 
-			var reply LockAcquireReply
-			err = json.Unmarshal(message, &reply)
-			if err != nil {
-				log.Printf("Invalid response: %v", err)
-				continue
-			}
+// AcquireLocks acquires every key in keys as one atomic request: either all
+// of them are granted together or the request keeps waiting, so a client
+// never holds only part of the set. Tokens are returned in sorted key order.
+func AcquireLocks(keys []string, ttl time.Duration, waitTimeout time.Duration) ([]FencingToken, error) {
+	reply, err := requestLock(LockRequest{
+		CommandType: LockAcquire,
+		Keys:        keys,
+		ClientID:    ClientID,
+		TTL:         ttl,
+		WaitTimeout: waitTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reply.FencingTokens, nil
+}
 
-			if reply.Success {
-				log.Printf("Lock %s acquired successfully", key)
-				return
-			} else {
-				log.Printf("Lock %s acquisition failed, retrying...", key)
-				time.Sleep(2 * time.Second)
-			}
+func acquireLock(lockReq LockRequest) (FencingToken, error) {
+	reply, err := requestLock(lockReq)
+	if err != nil {
+		return FencingToken{}, err
+	}
+	return reply.FencingToken, nil
+}
 
-		case <-time.After(1000 * time.Second):
+func requestLock(lockReq LockRequest) (LockAcquireReply, error) {
+	key := lockReq.Key
+	if len(lockReq.Keys) > 0 {
+		key = strings.Join(lockReq.Keys, ",")
+	}
+	responseTimeout := 1000 * time.Second
+	if lockReq.WaitTimeout > 0 {
+		// leave the server room to send its own timeout reply first
+		responseTimeout = lockReq.WaitTimeout + 5*time.Second
+	}
+	// every attempt is the same request, so a lock granted to an attempt whose
+	// reply was lost is not taken twice
+	seq := startSeq()
+	defer finishSeq(seq)
+	for {
+		var reply LockAcquireReply
+		err := requestWithSeq(seq, MessageAcquire, lockReq, &reply, responseTimeout)
+		if errors.Is(err, ErrConnectionLost) {
+			// log.Println("Connection lost, waiting for reconnection...")
+			continue
+		}
+		if errors.Is(err, errReplyTimeout) {
+			if lockReq.WaitTimeout > 0 {
+				return reply, fmt.Errorf("%w: %s", ErrLockWaitTimeout, key)
+			}
 			log.Println("Timed out waiting for response, retrying...")
+			continue
+		}
+		if err != nil {
+			return reply, err
+		}
+
+		if reply.Success {
+			log.Printf("Lock %s acquired successfully", key)
+			return reply, nil
+		}
+		switch reply.Reason {
+		case LockReasonHeld:
+			return reply, fmt.Errorf("%w: %s", ErrLockHeld, key)
+		case LockReasonWaitTimeout:
+			return reply, fmt.Errorf("%w: %s", ErrLockWaitTimeout, key)
+		case LockReasonDeadlock:
+			return reply, fmt.Errorf("%w: %s", ErrLockDeadlock, key)
+		case LockReasonSessionExpired:
+			return reply, fmt.Errorf("%w: %s", ErrLockSessionExpired, key)
+		default:
+			return reply, fmt.Errorf("lock %s acquisition failed: %s", key, reply.Reason)
 		}
 	}
 }
 
-func releaseLock(key string) {
-	if Conn == nil {
-		fmt.Printf("locking service connection missing\n")
+func logAcquireResult(key string, token FencingToken, err error) {
+	if err != nil {
+		log.Printf("Lock %s not acquired: %v", key, err)
 		return
 	}
+	log.Printf("Lock %s acquired with fencing token %d", key, token.Value)
+}
+
+func ReleaseLock(key string) error {
+	return releaseLock(key, "")
+}
+
+// ReleaseReentrantLock gives up one hold on a reentrant lock.
+func ReleaseReentrantLock(key string, ownerToken string) error {
+	return releaseLock(key, ownerToken)
+}
+
+func releaseLock(key string, ownerToken string) error {
 	lockReq := LockRequest{
 		CommandType: LockRelease,
 		Key:         key,
 		ClientID:    ClientID,
 		TTL:         time.Duration(0),
+		OwnerToken:  ownerToken,
 	}
-	data, err := json.Marshal(lockReq)
-	if err != nil {
-		fmt.Printf("json marshal error: %v\n", err)
-		return
+	var reply LockReleaseReply
+	if err := request(MessageRelease, lockReq, &reply, 10*time.Second); err != nil {
+		return err
+	}
+	if !reply.Success {
+		return fmt.Errorf("lock %s not released: %s", key, reply.Error)
 	}
+	return nil
+}
 
-	err = Conn.WriteMessage(websocket.TextMessage, data)
-	if err != nil {
-		fmt.Printf("error sending lock command: %v\n", err)
-		return
+// ReleaseLocks releases a set of keys acquired together with AcquireLocks.
+func ReleaseLocks(keys []string) error {
+	lockReq := LockRequest{
+		CommandType: LockRelease,
+		Keys:        keys,
+		ClientID:    ClientID,
+	}
+	var reply LockReleaseReply
+	if err := request(MessageRelease, lockReq, &reply, 10*time.Second); err != nil {
+		return err
 	}
-	log.Printf("Sent lock release command: %s", data)
+	if !reply.Success {
+		return fmt.Errorf("locks %v not released: %s", keys, reply.Error)
+	}
+	return nil
+}
+
+// RenewLock extends the lease on a held lock by ttl from now.
+func RenewLock(key string, ttl time.Duration) (time.Time, error) {
+	lockReq := LockRequest{
+		Key:      key,
+		ClientID: ClientID,
+		TTL:      ttl,
+	}
+	var reply LockRenewReply
+	if err := request(MessageRenew, lockReq, &reply, 10*time.Second); err != nil {
+		return time.Time{}, err
+	}
+	if reply.Reason == LockReasonNotHeld {
+		return time.Time{}, fmt.Errorf("%w: %s", ErrLockNotHeld, key)
+	}
+	if !reply.Success {
+		return time.Time{}, fmt.Errorf("lock %s not renewed: %s", key, reply.Error)
+	}
+	return reply.ExpiryTime, nil
 }
 
 func PrintMenu() {
@@ -251,8 +424,42 @@ func PrintMenu() {
 	fmt.Println("+----+---------------------------------+------------------------------------+")
 	fmt.Println("| 1  | create client                   |      clientId                      |")
 	fmt.Println("| 2  | connect to locking service      |      serverId upperlimit           |")
-	fmt.Println("| 3  | acquire lock                    |      lockKey, TTL (in secs)        |")
+	fmt.Println("| 3  | acquire lock                    | lockKey, TTL, [waitTimeout, prio]  |")
 	fmt.Println("| 4  | release lock                    |      lockKey                       |")
+	fmt.Println("| 5  | try acquire lock                |      lockKey, TTL (in secs)        |")
+	fmt.Println("| 6  | renew lock                      |      lockKey, TTL (in secs)        |")
+	fmt.Println("| 7  | acquire reentrant lock          |      lockKey, TTL, [ownerToken]    |")
+	fmt.Println("| 8  | release reentrant lock          |      lockKey, [ownerToken]         |")
+	fmt.Println("| 9  | acquire multiple locks          |      TTL, lockKey1 lockKey2 ...    |")
+	fmt.Println("| 10 | release multiple locks          |      lockKey1 lockKey2 ...         |")
+	fmt.Println("| 11 | campaign for election           |      electionName, TTL (in secs)   |")
+	fmt.Println("| 12 | resign from election            |      electionName                  |")
+	fmt.Println("| 13 | show election leader            |      electionName                  |")
+	fmt.Println("| 14 | wait at barrier                 |      barrierName, parties          |")
+	fmt.Println("| 15 | create latch                    |      latchName, count              |")
+	fmt.Println("| 16 | count down latch                |      latchName                     |")
+	fmt.Println("| 17 | wait on latch                   |      latchName                     |")
+	fmt.Println("| 18 | enqueue item                    |      queueName, payload            |")
+	fmt.Println("| 19 | dequeue item                    | queueName, [visibilityTimeout]     |")
+	fmt.Println("| 20 | acknowledge item                |      queueName, itemId             |")
+	fmt.Println("| 21 | negatively acknowledge item     |      queueName, itemId             |")
+	fmt.Println("| 22 | put value                       |      key, value                    |")
+	fmt.Println("| 23 | get value                       |      key                           |")
+	fmt.Println("| 24 | delete value                    |      key                           |")
+	fmt.Println("| 25 | compare and swap                |      key, expected|#version, value |")
+	fmt.Println("| 26 | put if absent                   |      key, value                    |")
+	fmt.Println("| 27 | transaction                     |      cmps... then ops... [else ops]|")
+	fmt.Println("| 28 | range scan                      |      start, [end], [limit], [token]|")
+	fmt.Println("| 29 | prefix scan                     |      prefix, [limit], [token]      |")
+	fmt.Println("| 30 | watch key                       |      key, [startRevision]          |")
+	fmt.Println("| 31 | watch prefix                    |      prefix, [startRevision]       |")
+	fmt.Println("| 32 | cancel watch                    |      watchId                       |")
+	fmt.Println("| 33 | put value with ttl              |      key, ttlSecs, value           |")
+	fmt.Println("| 34 | get value at revision           |      key, revision                 |")
+	fmt.Println("| 35 | compact history                 |      revision                      |")
+	fmt.Println("| 36 | increment counter               |      key, delta, [min], [max]      |")
+	fmt.Println("| 37 | decrement counter               |      key, delta, [min], [max]      |")
+	fmt.Println("| 38 | put values in batch             |      key=value key=value ...       |")
 	fmt.Println("+----+---------------------------------+------------------------------------+")
 	fmt.Println("+---------------------------------------------------------------------------+")
 	fmt.Println("")
@@ -264,7 +471,6 @@ func ClientInput(sigCh chan os.Signal) {
 		fmt.Println("SIGNAL RECEIVED")
 		os.Exit(0)
 	}()
-	reconnectedCh = make(chan struct{}, 1)
 	for {
 		PrintMenu()
 		fmt.Println("WAITING FOR INPUTS..")
@@ -300,6 +506,7 @@ func ClientInput(sigCh chan os.Signal) {
 				servers = append(servers, uint64(i))
 			}
 			go startReader()
+			go keepSessionAlive()
 		case 3:
 			if len(tokens) < 3 {
 				fmt.Printf("Lock Key and TTL not passed")
@@ -310,15 +517,681 @@ func ClientInput(sigCh chan os.Signal) {
 				fmt.Println("invalid TTL")
 				break
 			}
-			go acquireLock(tokens[1], int64(ttl))
+			waitTimeout := 0
+			if len(tokens) > 3 {
+				waitTimeout, err = strconv.Atoi(tokens[3])
+				if err != nil {
+					fmt.Println("invalid wait timeout")
+					break
+				}
+			}
+			priority := 0
+			if len(tokens) > 4 {
+				priority, err = strconv.Atoi(tokens[4])
+				if err != nil {
+					fmt.Println("invalid priority")
+					break
+				}
+			}
+			go func(key string) {
+				token, err := AcquireLockWithPriority(key, time.Duration(ttl)*time.Second, time.Duration(waitTimeout)*time.Second, priority)
+				logAcquireResult(key, token, err)
+			}(tokens[1])
 		case 4:
 			if len(tokens) < 2 {
 				fmt.Printf("Lock Key not passed")
 				break
 			}
-			go releaseLock(tokens[1])
+			go func(key string) {
+				if err := ReleaseLock(key); err != nil {
+					log.Printf("%v", err)
+					return
+				}
+				log.Printf("Lock %s released", key)
+			}(tokens[1])
+		case 5:
+			if len(tokens) < 3 {
+				fmt.Printf("Lock Key and TTL not passed")
+				break
+			}
+			ttl, err := strconv.Atoi(tokens[2])
+			if err != nil {
+				fmt.Println("invalid TTL")
+				break
+			}
+			go func(key string) {
+				token, err := TryAcquireLock(key, time.Duration(ttl)*time.Second)
+				logAcquireResult(key, token, err)
+			}(tokens[1])
+		case 6:
+			if len(tokens) < 3 {
+				fmt.Printf("Lock Key and TTL not passed")
+				break
+			}
+			ttl, err := strconv.Atoi(tokens[2])
+			if err != nil {
+				fmt.Println("invalid TTL")
+				break
+			}
+			go func(key string) {
+				expiry, err := RenewLock(key, time.Duration(ttl)*time.Second)
+				if err != nil {
+					log.Printf("%v", err)
+					return
+				}
+				log.Printf("Lock %s renewed until %v", key, expiry)
+			}(tokens[1])
+		case 7:
+			if len(tokens) < 3 {
+				fmt.Printf("Lock Key and TTL not passed")
+				break
+			}
+			ttl, err := strconv.Atoi(tokens[2])
+			if err != nil {
+				fmt.Println("invalid TTL")
+				break
+			}
+			ownerToken := ""
+			if len(tokens) > 3 {
+				ownerToken = tokens[3]
+			}
+			go func(key string) {
+				token, err := AcquireReentrantLock(key, ownerToken, time.Duration(ttl)*time.Second, 0)
+				logAcquireResult(key, token, err)
+			}(tokens[1])
+		case 8:
+			if len(tokens) < 2 {
+				fmt.Printf("Lock Key not passed")
+				break
+			}
+			ownerToken := ""
+			if len(tokens) > 2 {
+				ownerToken = tokens[2]
+			}
+			go func(key string) {
+				if err := ReleaseReentrantLock(key, ownerToken); err != nil {
+					log.Printf("%v", err)
+					return
+				}
+				log.Printf("Released one hold on lock %s", key)
+			}(tokens[1])
+		case 9:
+			if len(tokens) < 3 {
+				fmt.Printf("TTL and Lock Keys not passed")
+				break
+			}
+			ttl, err := strconv.Atoi(tokens[1])
+			if err != nil {
+				fmt.Println("invalid TTL")
+				break
+			}
+			go func(keys []string) {
+				fencingTokens, err := AcquireLocks(keys, time.Duration(ttl)*time.Second, 0)
+				if err != nil {
+					log.Printf("Locks %v not acquired: %v", keys, err)
+					return
+				}
+				for _, token := range fencingTokens {
+					log.Printf("Lock %s acquired with fencing token %d", token.LockKey(), token.Value)
+				}
+			}(tokens[2:])
+		case 10:
+			if len(tokens) < 2 {
+				fmt.Printf("Lock Keys not passed")
+				break
+			}
+			go func(keys []string) {
+				if err := ReleaseLocks(keys); err != nil {
+					log.Printf("%v", err)
+					return
+				}
+				log.Printf("Locks %v released", keys)
+			}(tokens[1:])
+		case 11:
+			if len(tokens) < 3 {
+				fmt.Printf("Election name and TTL not passed")
+				break
+			}
+			ttl, err := strconv.Atoi(tokens[2])
+			if err != nil || ttl <= 0 {
+				fmt.Println("invalid TTL")
+				break
+			}
+			election, exists := elections[tokens[1]]
+			if !exists {
+				election = NewElection(tokens[1], time.Duration(ttl)*time.Second)
+				elections[tokens[1]] = election
+			}
+			go func() {
+				term, err := election.Campaign()
+				if err != nil {
+					log.Printf("Campaign for %s failed: %v", election.Name, err)
+					return
+				}
+				log.Printf("Leading %s in term %d", election.Name, term.Value)
+			}()
+		case 12:
+			if len(tokens) < 2 {
+				fmt.Printf("Election name not passed")
+				break
+			}
+			election, exists := elections[tokens[1]]
+			if !exists {
+				fmt.Println("not campaigning in this election")
+				break
+			}
+			go func() {
+				if err := election.Resign(); err != nil {
+					log.Printf("%v", err)
+					return
+				}
+				log.Printf("Resigned from %s", election.Name)
+			}()
+		case 13:
+			if len(tokens) < 2 {
+				fmt.Printf("Election name not passed")
+				break
+			}
+			go func(name string) {
+				leader, err := ObserveElection(servers, name)
+				if err != nil {
+					log.Printf("%v", err)
+					return
+				}
+				if !leader.Elected {
+					log.Printf("Election %s has no leader, last term %d", name, leader.Term)
+					return
+				}
+				log.Printf("Election %s is led by %s in term %d", name, leader.Leader, leader.Term)
+			}(tokens[1])
+		case 14:
+			if len(tokens) < 3 {
+				fmt.Printf("Barrier name and parties not passed")
+				break
+			}
+			parties, err := strconv.Atoi(tokens[2])
+			if err != nil {
+				fmt.Println("invalid number of parties")
+				break
+			}
+			go func(name string) {
+				generation, err := AwaitBarrier(name, parties, 0)
+				if err != nil {
+					log.Printf("%v", err)
+					return
+				}
+				log.Printf("Barrier %s passed, generation %d", name, generation)
+			}(tokens[1])
+		case 15:
+			if len(tokens) < 3 {
+				fmt.Printf("Latch name and count not passed")
+				break
+			}
+			count, err := strconv.Atoi(tokens[2])
+			if err != nil {
+				fmt.Println("invalid count")
+				break
+			}
+			go func(name string) {
+				if err := CreateLatch(name, count); err != nil {
+					log.Printf("%v", err)
+					return
+				}
+				log.Printf("Latch %s created with count %d", name, count)
+			}(tokens[1])
+		case 16:
+			if len(tokens) < 2 {
+				fmt.Printf("Latch name not passed")
+				break
+			}
+			go func(name string) {
+				if err := CountDownLatch(name); err != nil {
+					log.Printf("%v", err)
+					return
+				}
+				log.Printf("Latch %s counted down", name)
+			}(tokens[1])
+		case 17:
+			if len(tokens) < 2 {
+				fmt.Printf("Latch name not passed")
+				break
+			}
+			go func(name string) {
+				if err := AwaitLatch(name, 0); err != nil {
+					log.Printf("%v", err)
+					return
+				}
+				log.Printf("Latch %s is open", name)
+			}(tokens[1])
+		case 18:
+			if len(tokens) < 3 {
+				fmt.Printf("Queue name and payload not passed")
+				break
+			}
+			go func(queue string, payload string) {
+				itemID, err := Enqueue(queue, []byte(payload))
+				if err != nil {
+					log.Printf("%v", err)
+					return
+				}
+				log.Printf("Enqueued item %d on queue %s", itemID, queue)
+			}(tokens[1], strings.Join(tokens[2:], " "))
+		case 19:
+			if len(tokens) < 2 {
+				fmt.Printf("Queue name not passed")
+				break
+			}
+			visibilityTimeout := 0
+			if len(tokens) > 2 {
+				var err error
+				visibilityTimeout, err = strconv.Atoi(tokens[2])
+				if err != nil {
+					fmt.Println("invalid visibility timeout")
+					break
+				}
+			}
+			go func(queue string) {
+				item, err := Dequeue(queue, time.Duration(visibilityTimeout)*time.Second)
+				if err != nil {
+					log.Printf("%v", err)
+					return
+				}
+				log.Printf("Dequeued item %d from queue %s (delivery %d): %s", item.ID, queue, item.Deliveries, item.Payload)
+			}(tokens[1])
+		case 20, 21:
+			if len(tokens) < 3 {
+				fmt.Printf("Queue name and item ID not passed")
+				break
+			}
+			itemID, err := strconv.ParseUint(tokens[2], 10, 64)
+			if err != nil {
+				fmt.Println("invalid item ID")
+				break
+			}
+			go func(queue string, ack bool) {
+				settle, action := Ack, "Acknowledged"
+				if !ack {
+					settle, action = Nack, "Returned"
+				}
+				if err := settle(queue, itemID); err != nil {
+					log.Printf("%v", err)
+					return
+				}
+				log.Printf("%s item %d of queue %s", action, itemID, queue)
+			}(tokens[1], command == 20)
+		case 22:
+			if len(tokens) < 3 {
+				fmt.Printf("Key and value not passed")
+				break
+			}
+			go func(key string, value string) {
+				if err := PutString(key, value); err != nil {
+					log.Printf("%v", err)
+					return
+				}
+				log.Printf("Stored %q under %s", value, key)
+			}(tokens[1], strings.Join(tokens[2:], " "))
+		case 23:
+			if len(tokens) < 2 {
+				fmt.Printf("Key not passed")
+				break
+			}
+			go func(key string) {
+				entry, err := GetEntry(key)
+				if err != nil {
+					log.Printf("%v", err)
+					return
+				}
+				if entry.TTL > 0 {
+					log.Printf("%s = %q (version %d, mod revision %d, expires in %v)", key, entry.Value, entry.Version, entry.ModRevision, entry.TTL.Round(time.Millisecond))
+					return
+				}
+				log.Printf("%s = %q (version %d, mod revision %d)", key, entry.Value, entry.Version, entry.ModRevision)
+			}(tokens[1])
+		case 24:
+			if len(tokens) < 2 {
+				fmt.Printf("Key not passed")
+				break
+			}
+			go func(key string) {
+				previous, err := Delete(key)
+				if err != nil {
+					log.Printf("%v", err)
+					return
+				}
+				log.Printf("Deleted %s (was %q)", key, previous)
+			}(tokens[1])
+		case 25:
+			if len(tokens) < 4 {
+				fmt.Printf("Key, expected value and new value not passed")
+				break
+			}
+			go func(key string, expected string, value string) {
+				var reply KVReply
+				var err error
+				if version, parseErr := strconv.ParseUint(strings.TrimPrefix(expected, "#"), 10, 64); strings.HasPrefix(expected, "#") && parseErr == nil {
+					reply, err = CompareVersionAndSwap(key, version, []byte(value))
+				} else {
+					reply, err = CompareAndSwap(key, []byte(expected), []byte(value))
+				}
+				if err != nil {
+					log.Printf("%v", err)
+					return
+				}
+				if reply.Success {
+					log.Printf("Swapped %s to %q (version %d)", key, value, reply.Version)
+				} else if reply.Found {
+					log.Printf("Compare failed: %s holds %q (version %d)", key, reply.Previous, reply.PreviousVersion)
+				} else {
+					log.Printf("Compare failed: %s is not set", key)
+				}
+			}(tokens[1], tokens[2], strings.Join(tokens[3:], " "))
+		case 26:
+			if len(tokens) < 3 {
+				fmt.Printf("Key and value not passed")
+				break
+			}
+			go func(key string, value string) {
+				reply, err := PutIfAbsent(key, []byte(value))
+				if err != nil {
+					log.Printf("%v", err)
+					return
+				}
+				if reply.Success {
+					log.Printf("Stored %q under %s", value, key)
+				} else {
+					log.Printf("%s already holds %q (version %d)", key, reply.Previous, reply.PreviousVersion)
+				}
+			}(tokens[1], strings.Join(tokens[2:], " "))
+		case 27:
+			txn, err := parseTxn(tokens[1:])
+			if err != nil {
+				fmt.Printf("%v", err)
+				break
+			}
+			go func(txn *TxnBuilder) {
+				reply, err := txn.Commit()
+				if err != nil {
+					log.Printf("%v", err)
+					return
+				}
+				branch := "then"
+				if !reply.Succeeded {
+					branch = "else"
+				}
+				log.Printf("Transaction ran its %s branch", branch)
+				for _, result := range reply.Results {
+					log.Printf("  %s %s: value %q version %d found %v", result.Op, result.Key, result.Value, result.Version, result.Found)
+				}
+			}(txn)
+		case 28, 29:
+			if len(tokens) < 2 {
+				fmt.Printf("Start key or prefix not passed")
+				break
+			}
+			go func(command int, tokens []string) {
+				var page RangePage
+				var err error
+				if command == 29 {
+					limit, _ := strconv.Atoi(optionalArg(tokens, 2))
+					page, err = Prefix(tokens[1], limit, optionalArg(tokens, 3))
+				} else {
+					limit, _ := strconv.Atoi(optionalArg(tokens, 3))
+					page, err = Range(tokens[1], optionalArg(tokens, 2), limit, optionalArg(tokens, 4))
+				}
+				if err != nil {
+					log.Printf("%v", err)
+					return
+				}
+				for _, kv := range page.KVs {
+					log.Printf("%s = %q (version %d)", kv.Key, kv.Value, kv.Version)
+				}
+				if page.NextPageToken != "" {
+					log.Printf("More keys, next page token %s", page.NextPageToken)
+				}
+			}(command, tokens)
+		case 30, 31:
+			if len(tokens) < 2 {
+				fmt.Printf("Key or prefix not passed")
+				break
+			}
+			var startRevision uint64
+			if len(tokens) > 2 {
+				var err error
+				if startRevision, err = strconv.ParseUint(tokens[2], 10, 64); err != nil {
+					fmt.Println("invalid start revision")
+					break
+				}
+			}
+			go func(key string, prefix bool) {
+				var watch *Watch
+				var err error
+				if prefix {
+					watch, err = WatchPrefix(key, startRevision)
+				} else {
+					watch, err = WatchKey(key, startRevision)
+				}
+				if err != nil {
+					log.Printf("%v", err)
+					return
+				}
+				log.Printf("Watch %s opened on %s at revision %d", watch.ID, key, watch.Revision())
+				for event := range watch.Events() {
+					log.Printf("Watch %s: %s %s = %q (version %d, revision %d)",
+						watch.ID, event.Type, event.Key, event.Value, event.Version, event.Revision)
+				}
+				if err := watch.Err(); err != nil {
+					log.Printf("Watch %s ended: %v", watch.ID, err)
+				}
+			}(tokens[1], command == 31)
+		case 32:
+			if len(tokens) < 2 {
+				fmt.Printf("Watch id not passed")
+				break
+			}
+			watchesMu.Lock()
+			watch, exists := watches[tokens[1]]
+			watchesMu.Unlock()
+			if !exists {
+				fmt.Println("no such watch")
+				break
+			}
+			go func() {
+				if err := watch.Cancel(); err != nil {
+					log.Printf("%v", err)
+					return
+				}
+				log.Printf("Watch %s cancelled", watch.ID)
+			}()
+		case 33:
+			if len(tokens) < 4 {
+				fmt.Printf("Key, ttl and value not passed")
+				break
+			}
+			ttlSecs, err := strconv.Atoi(tokens[2])
+			if err != nil || ttlSecs <= 0 {
+				fmt.Printf("Invalid ttl")
+				break
+			}
+			go func(key string, ttl time.Duration, value string) {
+				if err := PutWithTTL(key, []byte(value), ttl); err != nil {
+					log.Printf("%v", err)
+					return
+				}
+				log.Printf("Stored %q under %s, expires in %v", value, key, ttl)
+			}(tokens[1], time.Duration(ttlSecs)*time.Second, strings.Join(tokens[3:], " "))
+		case 34:
+			if len(tokens) < 3 {
+				fmt.Printf("Key and revision not passed")
+				break
+			}
+			revision, err := strconv.ParseUint(tokens[2], 10, 64)
+			if err != nil || revision == 0 {
+				fmt.Printf("Invalid revision")
+				break
+			}
+			go func(key string, revision uint64) {
+				entry, err := GetAtRevision(key, revision)
+				if err != nil {
+					log.Printf("%v", err)
+					return
+				}
+				log.Printf("%s = %q at revision %d (version %d, mod revision %d)", key, entry.Value, revision, entry.Version, entry.ModRevision)
+			}(tokens[1], revision)
+		case 35:
+			if len(tokens) < 2 {
+				fmt.Printf("Revision not passed")
+				break
+			}
+			revision, err := strconv.ParseUint(tokens[1], 10, 64)
+			if err != nil {
+				fmt.Printf("Invalid revision")
+				break
+			}
+			go func(revision uint64) {
+				if err := Compact(revision); err != nil {
+					log.Printf("%v", err)
+					return
+				}
+				log.Printf("Compacted history up to revision %d", revision)
+			}(revision)
+		case 36, 37:
+			if len(tokens) < 3 {
+				fmt.Printf("Key and delta not passed")
+				break
+			}
+			delta, err := strconv.ParseInt(tokens[2], 10, 64)
+			if err != nil {
+				fmt.Printf("Invalid delta")
+				break
+			}
+			low, high := int64(math.MinInt64), int64(math.MaxInt64)
+			if arg := optionalArg(tokens, 3); arg != "" {
+				low, err = strconv.ParseInt(arg, 10, 64)
+			}
+			if arg := optionalArg(tokens, 4); arg != "" && err == nil {
+				high, err = strconv.ParseInt(arg, 10, 64)
+			}
+			if err != nil {
+				fmt.Printf("Invalid bounds")
+				break
+			}
+			go func(key string, decrement bool, bounded bool) {
+				var value int64
+				var err error
+				switch {
+				case decrement && bounded:
+					value, err = DecrementWithin(key, delta, low, high)
+				case bounded:
+					value, err = IncrementWithin(key, delta, low, high)
+				case decrement:
+					value, err = Decrement(key, delta)
+				default:
+					value, err = Increment(key, delta)
+				}
+				if err != nil {
+					log.Printf("%v", err)
+					return
+				}
+				log.Printf("Counter %s is now %d", key, value)
+			}(tokens[1], command == 37, len(tokens) > 3)
+		case 38:
+			if len(tokens) < 2 {
+				fmt.Printf("No key=value pairs passed")
+				break
+			}
+			kvs := make([]KVPair, 0, len(tokens)-1)
+			for _, token := range tokens[1:] {
+				key, value, found := strings.Cut(token, "=")
+				if !found {
+					fmt.Printf("%q is not of the form key=value", token)
+					kvs = nil
+					break
+				}
+				kvs = append(kvs, KVPair{Key: key, Value: []byte(value)})
+			}
+			if kvs == nil {
+				break
+			}
+			go func(kvs []KVPair) {
+				revision, err := PutBatch(kvs)
+				if err != nil {
+					log.Printf("%v", err)
+					return
+				}
+				log.Printf("Put %d keys at revision %d", len(kvs), revision)
+			}(kvs)
 		default:
 			fmt.Printf("Invalid input")
 		}
 	}
 }
+
+// parseTxn reads a transaction typed at the menu, for example
+//
+//	a=1 b#>0 then put:a:2 get:b else get:a
+//
+// where key#<op>n compares versions and key<op>value compares values.
+func parseTxn(tokens []string) (*TxnBuilder, error) {
+	txn := Txn()
+	section := "if"
+	for _, token := range tokens {
+		if token == "then" || token == "else" {
+			section = token
+			continue
+		}
+		if section == "if" {
+			compare, err := parseTxnCompare(token)
+			if err != nil {
+				return nil, err
+			}
+			txn.If(compare)
+			continue
+		}
+		parts := strings.SplitN(token, ":", 3)
+		var op TxnOp
+		switch {
+		case parts[0] == "put" && len(parts) == 3:
+			op = OpPut(parts[1], []byte(parts[2]))
+		case parts[0] == "get" && len(parts) == 2:
+			op = OpGet(parts[1])
+		case parts[0] == "del" && len(parts) == 2:
+			op = OpDelete(parts[1])
+		default:
+			return nil, fmt.Errorf("invalid operation %q", token)
+		}
+		if section == "then" {
+			txn.Then(op)
+		} else {
+			txn.Else(op)
+		}
+	}
+	return txn, nil
+}
+
+func parseTxnCompare(token string) (TxnCompare, error) {
+	for _, result := range []string{"!=", "=", "<", ">"} {
+		index := strings.Index(token, result)
+		if index <= 0 {
+			continue
+		}
+		key, expected := token[:index], token[index+len(result):]
+		if strings.HasSuffix(key, "#") {
+			version, err := strconv.ParseUint(expected, 10, 64)
+			if err != nil {
+				return TxnCompare{}, fmt.Errorf("invalid version in %q", token)
+			}
+			return CompareVersion(strings.TrimSuffix(key, "#"), result, version), nil
+		}
+		return Compare(key, result, []byte(expected)), nil
+	}
+	return TxnCompare{}, fmt.Errorf("invalid comparison %q", token)
+}
+
+// optionalArg returns tokens[i], or "" if it is missing or "-"
+func optionalArg(tokens []string, i int) string {
+	if i >= len(tokens) || tokens[i] == "-" {
+		return ""
+	}
+	return tokens[i]
+}
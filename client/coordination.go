@@ -0,0 +1,104 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+type CoordinationRequest struct {
+	Op      string `json:"op"`
+	Name    string `json:"name"`
+	Parties int    `json:"parties,omitempty"`
+	Count   int    `json:"count,omitempty"`
+}
+
+type BarrierReply struct {
+	Success    bool
+	Name       string
+	Generation uint64
+	Error      string
+}
+
+type LatchReply struct {
+	Success bool
+	Name    string
+	Error   string
+}
+
+var ErrCoordinationTimeout = errors.New("timed out waiting to be released")
+
+// AwaitBarrier blocks until parties clients, this one included, have arrived
+// at the named barrier and returns the generation that was completed. A
+// positive timeout bounds the wait; the arrival itself is not withdrawn.
+func AwaitBarrier(name string, parties int, timeout time.Duration) (uint64, error) {
+	req := CoordinationRequest{Op: "arrive", Name: name, Parties: parties}
+	var reply BarrierReply
+	if err := awaitCoordination(MessageBarrier, req, &reply, timeout); err != nil {
+		return 0, err
+	}
+	if !reply.Success {
+		return 0, fmt.Errorf("barrier %s failed: %s", name, reply.Error)
+	}
+	return reply.Generation, nil
+}
+
+// CreateLatch arms the named latch with count. A latch that is open can be
+// armed again.
+func CreateLatch(name string, count int) error {
+	req := CoordinationRequest{Op: "create", Name: name, Count: count}
+	var reply LatchReply
+	if err := request(MessageLatch, req, &reply, 10*time.Second); err != nil {
+		return err
+	}
+	if !reply.Success {
+		return fmt.Errorf("latch %s not created: %s", name, reply.Error)
+	}
+	return nil
+}
+
+func CountDownLatch(name string) error {
+	req := CoordinationRequest{Op: "countdown", Name: name}
+	var reply LatchReply
+	if err := request(MessageLatch, req, &reply, 10*time.Second); err != nil {
+		return err
+	}
+	if !reply.Success {
+		return fmt.Errorf("latch %s not counted down: %s", name, reply.Error)
+	}
+	return nil
+}
+
+// AwaitLatch blocks until the named latch has been counted down to zero.
+func AwaitLatch(name string, timeout time.Duration) error {
+	req := CoordinationRequest{Op: "wait", Name: name}
+	var reply LatchReply
+	if err := awaitCoordination(MessageLatch, req, &reply, timeout); err != nil {
+		return err
+	}
+	if !reply.Success {
+		return fmt.Errorf("waiting on latch %s failed: %s", name, reply.Error)
+	}
+	return nil
+}
+
+// awaitCoordination sends a request whose reply only comes once the client
+// is released. Lost connections are retried; the server keeps a single
+// place per client, so resending does not count the client twice.
+func awaitCoordination(msgType MessageType, req CoordinationRequest, reply interface{}, timeout time.Duration) error {
+	responseTimeout := 1000 * time.Second
+	if timeout > 0 {
+		responseTimeout = timeout
+	}
+	deadline := time.Now().Add(responseTimeout)
+	for {
+		err := request(msgType, req, reply, time.Until(deadline))
+		if errors.Is(err, ErrConnectionLost) && time.Now().Before(deadline) {
+			continue
+		}
+		if errors.Is(err, errReplyTimeout) {
+			return fmt.Errorf("%w: %s %s", ErrCoordinationTimeout, msgType, req.Name)
+		}
+		return err
+	}
+}
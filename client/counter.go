@@ -0,0 +1,45 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrCounterOutOfBounds is returned by IncrementWithin and DecrementWithin
+// when the new value would fall outside the bounds. The counter is left
+// unchanged.
+var ErrCounterOutOfBounds = errors.New("counter would be out of bounds")
+
+// Increment atomically adds delta to the counter stored under key, creating
+// it at 0, and returns the new value. Counters are stored as decimal text,
+// so they can also be read with GetString.
+func Increment(key string, delta int64) (int64, error) {
+	reply, err := kvRequest(KVRequest{Op: "increment", Key: key, Delta: delta})
+	return reply.Counter, err
+}
+
+// Decrement atomically subtracts delta from the counter under key and
+// returns the new value.
+func Decrement(key string, delta int64) (int64, error) {
+	return Increment(key, -delta)
+}
+
+// IncrementWithin adds delta to the counter under key only if the new value
+// stays within [low, high], as a rate limiter would. Otherwise it returns the
+// current value and ErrCounterOutOfBounds.
+func IncrementWithin(key string, delta int64, low int64, high int64) (int64, error) {
+	reply, err := kvRequest(KVRequest{Op: "increment", Key: key, Delta: delta, Bounded: true, Min: low, Max: high})
+	if err != nil {
+		return 0, err
+	}
+	if !reply.Success {
+		return reply.Counter, fmt.Errorf("%w: %s is %d", ErrCounterOutOfBounds, key, reply.Counter)
+	}
+	return reply.Counter, nil
+}
+
+// DecrementWithin subtracts delta from the counter under key only if the new
+// value stays within [low, high].
+func DecrementWithin(key string, delta int64, low int64, high int64) (int64, error) {
+	return IncrementWithin(key, -delta, low, high)
+}
@@ -0,0 +1,227 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Elections are plain locks under this prefix; the fencing token of the lock
+// is the leader's term.
+const electionKeyPrefix string = "ELECTION_"
+
+var (
+	ErrNotLeader          = errors.New("not the leader of the election")
+	ErrCampaignInProgress = errors.New("already campaigning in or leading the election")
+)
+
+// The elections this client is campaigning in or leading, and the Election
+// doing so. Another campaign for the same election would queue behind the
+// client's own lock request, or its held lock, and not be granted.
+var (
+	campaignsMu sync.Mutex
+	campaigns   = make(map[string]*Election)
+)
+
+// ElectionLeader is the current winner of an election as seen by anyone,
+// participant or not.
+type ElectionLeader struct {
+	Election string
+	Elected  bool
+	Leader   string
+	Term     uint64
+}
+
+// Election lets several instances of a service agree that exactly one of
+// them is active. The winner holds the election lock and keeps renewing it
+// until it resigns or fails to renew in time.
+type Election struct {
+	Name string
+	TTL  time.Duration
+
+	mu      sync.Mutex
+	leading bool
+	term    FencingToken
+	resign  chan struct{}
+	lost    chan struct{}
+}
+
+func NewElection(name string, ttl time.Duration) *Election {
+	return &Election{Name: name, TTL: ttl}
+}
+
+func (election *Election) lockKey() string {
+	return electionKeyPrefix + election.Name
+}
+
+// Campaign blocks until this client wins the election and returns its term.
+// Terms only ever grow, so they can be handed to a FencingGuard to reject
+// writes from a deposed leader. Campaigning again while leading returns the
+// current term. While one Election campaigns in or leads an election, a
+// campaign by any other Election of this client for it fails with
+// ErrCampaignInProgress.
+func (election *Election) Campaign() (FencingToken, error) {
+	campaignsMu.Lock()
+	if owner, exists := campaigns[election.Name]; exists {
+		campaignsMu.Unlock()
+		if owner == election {
+			if term, err := election.Term(); err == nil {
+				return term, nil
+			}
+		}
+		return FencingToken{}, fmt.Errorf("%w: %s", ErrCampaignInProgress, election.Name)
+	}
+	campaigns[election.Name] = election
+	campaignsMu.Unlock()
+
+	term, err := AcquireLock(election.lockKey(), election.TTL, 0)
+	if err != nil {
+		election.endCampaign()
+		return FencingToken{}, err
+	}
+
+	election.mu.Lock()
+	election.leading = true
+	election.term = term
+	election.resign = make(chan struct{})
+	election.lost = make(chan struct{})
+	go election.keepLeading(election.resign, election.lost)
+	election.mu.Unlock()
+	log.Printf("Elected leader of %s for term %d", election.Name, term.Value)
+	return term, nil
+}
+
+// endCampaign lets the election be campaigned in again once this Election
+// neither campaigns nor leads in it.
+func (election *Election) endCampaign() {
+	campaignsMu.Lock()
+	if campaigns[election.Name] == election {
+		delete(campaigns, election.Name)
+	}
+	campaignsMu.Unlock()
+}
+
+// keepLeading renews the election lock every third of its TTL. A renewal
+// that goes unanswered, say while the cluster changes leader, is retried
+// until the lease it last got runs out. Leadership is lost once the cluster
+// answers that the lock is not held, or the lease runs out; in the latter
+// case the lock is released, in case it is held after all.
+func (election *Election) keepLeading(resign chan struct{}, lost chan struct{}) {
+	ticker := time.NewTicker(election.TTL / 3)
+	defer ticker.Stop()
+	leaseEnd := time.Now().Add(election.TTL)
+	for {
+		select {
+		case <-resign:
+			return
+		case <-ticker.C:
+			renewedAt := time.Now()
+			_, err := RenewLock(election.lockKey(), election.TTL)
+			if err == nil {
+				leaseEnd = renewedAt.Add(election.TTL)
+				continue
+			}
+			if !errors.Is(err, ErrLockNotHeld) && time.Now().Before(leaseEnd) {
+				log.Printf("Renewing leadership of %s failed, retrying: %v", election.Name, err)
+				continue
+			}
+			election.mu.Lock()
+			stillLeading := election.lost == lost
+			if stillLeading {
+				election.leading = false
+				close(lost)
+			}
+			election.mu.Unlock()
+			if !stillLeading {
+				return
+			}
+			log.Printf("Lost leadership of %s: %v", election.Name, err)
+			if !errors.Is(err, ErrLockNotHeld) {
+				if err := ReleaseLock(election.lockKey()); err != nil {
+					log.Printf("Releasing the lock of %s: %v", election.Name, err)
+				}
+			}
+			election.endCampaign()
+			return
+		}
+	}
+}
+
+// Lost returns a channel that is closed when this client stops being the
+// leader without resigning. It is nil if the client never won.
+func (election *Election) Lost() <-chan struct{} {
+	election.mu.Lock()
+	defer election.mu.Unlock()
+	return election.lost
+}
+
+// Term returns the term this client currently leads in.
+func (election *Election) Term() (FencingToken, error) {
+	election.mu.Lock()
+	defer election.mu.Unlock()
+	if !election.leading {
+		return FencingToken{}, fmt.Errorf("%w: %s", ErrNotLeader, election.Name)
+	}
+	return election.term, nil
+}
+
+// Resign gives up leadership so that the next candidate can be elected.
+func (election *Election) Resign() error {
+	election.mu.Lock()
+	if !election.leading {
+		election.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrNotLeader, election.Name)
+	}
+	election.leading = false
+	close(election.resign)
+	election.lost = nil
+	election.mu.Unlock()
+	defer election.endCampaign()
+	return ReleaseLock(election.lockKey())
+}
+
+// ObserveElection reports the current leader of the named election. It only
+// talks to the servers' HTTP endpoints and does not need a session.
+func ObserveElection(serverIds []uint64, name string) (ElectionLeader, error) {
+	status, err := FetchFencingToken(serverIds, electionKeyPrefix+name)
+	if err != nil {
+		return ElectionLeader{}, err
+	}
+	return ElectionLeader{
+		Election: name,
+		Elected:  status.Held,
+		Leader:   status.Holder,
+		Term:     status.Token,
+	}, nil
+}
+
+// WatchElection polls the named election every interval and sends the leader
+// each time it changes, until stop is closed.
+func WatchElection(serverIds []uint64, name string, interval time.Duration, stop <-chan struct{}) <-chan ElectionLeader {
+	changes := make(chan ElectionLeader)
+	go func() {
+		defer close(changes)
+		var last ElectionLeader
+		first := true
+		for {
+			leader, err := ObserveElection(serverIds, name)
+			if err == nil && (first || leader != last) {
+				first = false
+				last = leader
+				select {
+				case changes <- leader:
+				case <-stop:
+					return
+				}
+			}
+			select {
+			case <-time.After(interval):
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return changes
+}
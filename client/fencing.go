@@ -0,0 +1,143 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const fencingTokenPrefix string = "FENCING_TOKEN_"
+
+var ErrStaleFencingToken = errors.New("stale fencing token")
+
+type FencingTokenStatus struct {
+	Key    string `json:"key"`
+	Token  uint64 `json:"token"`
+	Issued bool   `json:"issued"`
+	Held   bool   `json:"held"`
+	Holder string `json:"holder"`
+}
+
+type FencingTokenValidation struct {
+	Key    string `json:"key"`
+	Token  uint64 `json:"token"`
+	Latest uint64 `json:"latest"`
+	Held   bool   `json:"held"`
+	Valid  bool   `json:"valid"`
+}
+
+// LockKey returns the lock key the fencing token was issued for.
+func (token FencingToken) LockKey() string {
+	return strings.TrimPrefix(token.Key, fencingTokenPrefix)
+}
+
+func fetchJSON(serverId uint64, path string, query url.Values, reply interface{}) error {
+	endpoint := fmt.Sprintf("http://localhost:%d%s?%s", 50050+serverId, path, query.Encode())
+	resp, err := http.Get(endpoint)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server %d replied with status %s", serverId, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
+
+// FetchFencingToken returns the latest fencing token issued for lockKey by
+// asking each of the given servers in turn.
+func FetchFencingToken(serverIds []uint64, lockKey string) (FencingTokenStatus, error) {
+	var status FencingTokenStatus
+	err := errors.New("no locking server passed")
+	for _, serverId := range serverIds {
+		query := url.Values{"key": {lockKey}}
+		if err = fetchJSON(serverId, "/fencing", query, &status); err == nil {
+			return status, nil
+		}
+	}
+	return status, err
+}
+
+// ValidateFencingToken checks whether token is still the latest token for
+// lockKey and the lock it was issued with is still held.
+func ValidateFencingToken(serverIds []uint64, lockKey string, token uint64) (FencingTokenValidation, error) {
+	var validation FencingTokenValidation
+	err := errors.New("no locking server passed")
+	for _, serverId := range serverIds {
+		query := url.Values{"key": {lockKey}, "token": {fmt.Sprint(token)}}
+		if err = fetchJSON(serverId, "/fencing/validate", query, &validation); err == nil {
+			return validation, nil
+		}
+	}
+	return validation, err
+}
+
+// FencingGuard is meant to sit in front of a resource protected by a lock.
+// It remembers the highest fencing token it has accepted for every lock key
+// and rejects writes carrying an older one. When servers are given, tokens
+// are additionally validated against the locking service.
+type FencingGuard struct {
+	mu       sync.Mutex
+	servers  []uint64
+	accepted map[string]uint64
+}
+
+func NewFencingGuard(serverIds []uint64) *FencingGuard {
+	return &FencingGuard{
+		servers:  serverIds,
+		accepted: make(map[string]uint64),
+	}
+}
+
+// Check returns ErrStaleFencingToken if a newer token than the given one has
+// already been accepted for the same lock key.
+func (guard *FencingGuard) Check(token FencingToken) error {
+	lockKey := token.LockKey()
+	if err := guard.checkAccepted(lockKey, token.Value); err != nil {
+		return err
+	}
+	if len(guard.servers) > 0 {
+		// The round trip runs unlocked so one slow server does not hold up
+		// the checks for every other lock key.
+		validation, err := ValidateFencingToken(guard.servers, lockKey, token.Value)
+		if err != nil {
+			return err
+		}
+		if !validation.Valid {
+			return fmt.Errorf("%w: token %d for lock %s, latest %d, held %v", ErrStaleFencingToken, token.Value, lockKey, validation.Latest, validation.Held)
+		}
+	}
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+	// A newer token may have been accepted while this one was validated.
+	if err := guard.staleLocked(lockKey, token.Value); err != nil {
+		return err
+	}
+	guard.accepted[lockKey] = token.Value
+	return nil
+}
+
+func (guard *FencingGuard) checkAccepted(lockKey string, token uint64) error {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+	return guard.staleLocked(lockKey, token)
+}
+
+func (guard *FencingGuard) staleLocked(lockKey string, token uint64) error {
+	if highest, ok := guard.accepted[lockKey]; ok && token < highest {
+		return fmt.Errorf("%w: token %d for lock %s, already accepted %d", ErrStaleFencingToken, token, lockKey, highest)
+	}
+	return nil
+}
+
+// Guard runs write only if token passes Check.
+func (guard *FencingGuard) Guard(token FencingToken, write func() error) error {
+	if err := guard.Check(token); err != nil {
+		return err
+	}
+	return write()
+}
@@ -0,0 +1,221 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+type KVRequest struct {
+	Op              string        `json:"op"`
+	Key             string        `json:"key"`
+	Value           []byte        `json:"value,omitempty"`
+	TTL             time.Duration `json:"ttl,omitempty"`
+	Expected        []byte        `json:"expected,omitempty"`
+	ExpectedVersion uint64        `json:"expectedVersion,omitempty"`
+	CompareVersion  bool          `json:"compareVersion,omitempty"`
+	End             string        `json:"end,omitempty"`
+	Limit           int           `json:"limit,omitempty"`
+	PageToken       string        `json:"pageToken,omitempty"`
+	Revision        uint64        `json:"revision,omitempty"`
+	Delta           int64         `json:"delta,omitempty"`
+	Bounded         bool          `json:"bounded,omitempty"`
+	Min             int64         `json:"min,omitempty"`
+	Max             int64         `json:"max,omitempty"`
+	KVs             []KVPair      `json:"kvs,omitempty"`
+}
+
+// KVPair is a key with its value and version. CreateRevision and
+// ModRevision are the cluster revisions at which the key was created and
+// last written. TTL is the time left before the key expires, or 0 if it does
+// not expire.
+type KVPair struct {
+	Key            string        `json:"key"`
+	Value          []byte        `json:"value"`
+	Version        uint64        `json:"version"`
+	CreateRevision uint64        `json:"createRevision"`
+	ModRevision    uint64        `json:"modRevision"`
+	TTL            time.Duration `json:"ttl"`
+}
+
+// KVReply is the server's answer to a kv request. For delete, cas and
+// putIfAbsent, Success reports whether the condition held and Previous and
+// PreviousVersion describe the key before the operation.
+type KVReply struct {
+	Success         bool          `json:"success"`
+	Key             string        `json:"key"`
+	Value           []byte        `json:"value"`
+	Version         uint64        `json:"version"`
+	CreateRevision  uint64        `json:"createRevision"`
+	ModRevision     uint64        `json:"modRevision"`
+	TTL             time.Duration `json:"ttl"`
+	Found           bool          `json:"found"`
+	Previous        []byte        `json:"previous"`
+	PreviousVersion uint64        `json:"previousVersion"`
+	KVs             []KVPair      `json:"kvs"`
+	NextPageToken   string        `json:"nextPageToken"`
+	Revision        uint64        `json:"revision"`
+	Counter         int64         `json:"counter"`
+	Error           string        `json:"error"`
+}
+
+// RangePage is one page of a scan, in key order. Pass NextPageToken to the
+// same scan to get the following page; it is empty on the last page.
+// Revision is the cluster revision the page was read at; pass it to
+// RangeAtRevision to read the following pages at the same revision.
+type RangePage struct {
+	KVs           []KVPair
+	NextPageToken string
+	Revision      uint64
+}
+
+var ErrKeyNotFound = errors.New("key not found")
+
+func kvRequest(req KVRequest) (KVReply, error) {
+	var reply KVReply
+	if err := requestExactlyOnce(MessageKV, req, &reply, 10*time.Second); err != nil {
+		return reply, err
+	}
+	if reply.Error != "" {
+		return reply, fmt.Errorf("%s of key %s failed: %s", req.Op, req.Key, reply.Error)
+	}
+	return reply, nil
+}
+
+// Put stores value under key in the replicated key-value store.
+func Put(key string, value []byte) error {
+	_, err := kvRequest(KVRequest{Op: "put", Key: key, Value: value})
+	return err
+}
+
+// PutWithTTL stores value under key and deletes the key once ttl has
+// passed. Writing the key again without a TTL keeps it indefinitely.
+func PutWithTTL(key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("invalid TTL %v", ttl)
+	}
+	_, err := kvRequest(KVRequest{Op: "put", Key: key, Value: value, TTL: ttl})
+	return err
+}
+
+// PutBatch stores every pair in kvs with a single request, applied as one
+// log entry, and returns the cluster revision they were all written at. Only
+// the Key, Value and TTL of each pair are used.
+func PutBatch(kvs []KVPair) (uint64, error) {
+	if len(kvs) == 0 {
+		return 0, errors.New("no keys to put")
+	}
+	reply, err := kvRequest(KVRequest{Op: "batchPut", KVs: kvs})
+	return reply.Revision, err
+}
+
+// Get returns the value stored under key, or ErrKeyNotFound.
+func Get(key string) ([]byte, error) {
+	value, _, err := GetWithVersion(key)
+	return value, err
+}
+
+// GetWithVersion returns the value stored under key and its version, which
+// can be passed to CompareVersionAndSwap.
+func GetWithVersion(key string) ([]byte, uint64, error) {
+	entry, err := GetEntry(key)
+	return entry.Value, entry.Version, err
+}
+
+// GetEntry returns the value stored under key with its version and the
+// time left before it expires, or ErrKeyNotFound.
+func GetEntry(key string) (KVPair, error) {
+	return GetAtRevision(key, 0)
+}
+
+// GetAtRevision returns the entry key held as of a past cluster revision,
+// or ErrKeyNotFound if it was not set then. A revision of 0 reads the latest
+// value. It fails if the revision has been compacted.
+func GetAtRevision(key string, revision uint64) (KVPair, error) {
+	reply, err := kvRequest(KVRequest{Op: "get", Key: key, Revision: revision})
+	if err != nil {
+		return KVPair{}, err
+	}
+	if !reply.Found {
+		return KVPair{}, fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+	}
+	return KVPair{
+		Key:            key,
+		Value:          reply.Value,
+		Version:        reply.Version,
+		CreateRevision: reply.CreateRevision,
+		ModRevision:    reply.ModRevision,
+		TTL:            reply.TTL,
+	}, nil
+}
+
+func PutString(key string, value string) error {
+	return Put(key, []byte(value))
+}
+
+func GetString(key string) (string, error) {
+	value, err := Get(key)
+	return string(value), err
+}
+
+// Delete removes key and returns the value it held, or ErrKeyNotFound.
+func Delete(key string) ([]byte, error) {
+	reply, err := kvRequest(KVRequest{Op: "delete", Key: key})
+	if err != nil {
+		return nil, err
+	}
+	if !reply.Success {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+	}
+	return reply.Previous, nil
+}
+
+// CompareAndSwap stores value under key only if the key currently holds
+// expected. reply.Success reports whether the swap happened.
+func CompareAndSwap(key string, expected []byte, value []byte) (KVReply, error) {
+	return kvRequest(KVRequest{Op: "cas", Key: key, Expected: expected, Value: value})
+}
+
+// CompareVersionAndSwap stores value under key only if the key is at
+// expectedVersion; a version of 0 requires the key to be unset.
+func CompareVersionAndSwap(key string, expectedVersion uint64, value []byte) (KVReply, error) {
+	return kvRequest(KVRequest{Op: "cas", Key: key, ExpectedVersion: expectedVersion, CompareVersion: true, Value: value})
+}
+
+// PutIfAbsent stores value under key only if the key is unset.
+// reply.Success reports whether the value was stored.
+func PutIfAbsent(key string, value []byte) (KVReply, error) {
+	return kvRequest(KVRequest{Op: "putIfAbsent", Key: key, Value: value})
+}
+
+// Range returns up to limit keys in [start, end), in order. An empty end
+// scans to the last key and a limit of 0 uses the server's default page size.
+func Range(start string, end string, limit int, pageToken string) (RangePage, error) {
+	return RangeAtRevision(start, end, limit, pageToken, 0)
+}
+
+// RangeAtRevision is Range over the keys as they were at a past cluster
+// revision. A revision of 0 reads the latest values.
+func RangeAtRevision(start string, end string, limit int, pageToken string, revision uint64) (RangePage, error) {
+	reply, err := kvRequest(KVRequest{Op: "range", Key: start, End: end, Limit: limit, PageToken: pageToken, Revision: revision})
+	if err != nil {
+		return RangePage{}, err
+	}
+	return RangePage{KVs: reply.KVs, NextPageToken: reply.NextPageToken, Revision: reply.Revision}, nil
+}
+
+// Prefix returns up to limit keys starting with prefix, in order.
+func Prefix(prefix string, limit int, pageToken string) (RangePage, error) {
+	reply, err := kvRequest(KVRequest{Op: "prefix", Key: prefix, Limit: limit, PageToken: pageToken})
+	if err != nil {
+		return RangePage{}, err
+	}
+	return RangePage{KVs: reply.KVs, NextPageToken: reply.NextPageToken, Revision: reply.Revision}, nil
+}
+
+// Compact discards the history of every key older than revision. Reads at
+// earlier revisions fail afterwards.
+func Compact(revision uint64) error {
+	_, err := kvRequest(KVRequest{Op: "compact", Revision: revision})
+	return err
+}
@@ -0,0 +1,310 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Version of the Envelope format spoken on the /ws connection
+const ProtocolVersion int = 1
+
+type MessageType string
+
+const (
+	MessageAcquire MessageType = "acquire"
+	MessageRelease MessageType = "release"
+	MessageRenew   MessageType = "renew"
+	MessageSession MessageType = "keepalive"
+	MessageError   MessageType = "error"
+	MessageEvent   MessageType = "event"
+	MessageBarrier MessageType = "barrier"
+	MessageLatch   MessageType = "latch"
+	MessageQueue   MessageType = "queue"
+	MessageKV      MessageType = "kv"
+	MessageTxn     MessageType = "txn"
+	MessageWatch   MessageType = "watch"
+)
+
+var (
+	ErrConnectionLost = errors.New("connection to locking service lost")
+	errReplyTimeout   = errors.New("timed out waiting for reply")
+)
+
+// Most times requestExactlyOnce sends a request before giving up on it
+const MaxRequestAttempts int = 5
+
+// Seq numbers a request and is kept when the request is resent, so the
+// cluster applies it once. AckedSeq tells the cluster that every request up
+// to it has been answered and its cached result can be dropped.
+type Envelope struct {
+	Version   int             `json:"version"`
+	RequestID string          `json:"requestId,omitempty"`
+	Seq       uint64          `json:"seq,omitempty"`
+	AckedSeq  uint64          `json:"ackedSeq,omitempty"`
+	Type      MessageType     `json:"type"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+}
+
+type ErrorReply struct {
+	Message string `json:"message"`
+}
+
+type LockEvent struct {
+	Event        string       `json:"event"`
+	Key          string       `json:"key"`
+	FencingToken FencingToken `json:"fencingToken"`
+}
+
+var (
+	connMu      sync.Mutex
+	isConnected bool
+	connected   = make(chan struct{}) // closed while a leader connection is up
+	pending     = make(map[string]chan Envelope)
+	requestSeq  uint64
+)
+
+var (
+	seqMu    sync.Mutex
+	lastSeq  uint64
+	inFlight = make(map[uint64]struct{})
+)
+
+func markConnected() {
+	connMu.Lock()
+	defer connMu.Unlock()
+	if !isConnected {
+		isConnected = true
+		close(connected)
+	}
+}
+
+// markDisconnected fails every request still waiting for a reply; callers
+// see ErrConnectionLost and decide whether to resend.
+func markDisconnected() {
+	connMu.Lock()
+	defer connMu.Unlock()
+	if isConnected {
+		isConnected = false
+		connected = make(chan struct{})
+	}
+	for requestID, replyCh := range pending {
+		close(replyCh)
+		delete(pending, requestID)
+	}
+}
+
+func waitForConnection() {
+	connMu.Lock()
+	ch := connected
+	connMu.Unlock()
+	<-ch
+}
+
+// waitForConnectionFor is waitForConnection for at most timeout, and reports
+// whether the connection is up.
+func waitForConnectionFor(timeout time.Duration) bool {
+	connMu.Lock()
+	ch := connected
+	connMu.Unlock()
+	select {
+	case <-ch:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func nextRequestID() string {
+	return fmt.Sprintf("%s-%d", ClientID, atomic.AddUint64(&requestSeq, 1))
+}
+
+// startSeq numbers a new request. Numbering starts from the clock so that a
+// client restarted under the same ID keeps using higher numbers.
+func startSeq() uint64 {
+	seqMu.Lock()
+	defer seqMu.Unlock()
+	if lastSeq == 0 {
+		lastSeq = uint64(time.Now().UnixNano())
+	}
+	lastSeq++
+	inFlight[lastSeq] = struct{}{}
+	return lastSeq
+}
+
+// finishSeq is called once a request will not be resent.
+func finishSeq(seq uint64) {
+	seqMu.Lock()
+	defer seqMu.Unlock()
+	delete(inFlight, seq)
+}
+
+// ackedSeq returns the highest sequence number up to which no request will
+// be resent.
+func ackedSeq() uint64 {
+	seqMu.Lock()
+	defer seqMu.Unlock()
+	acked := lastSeq
+	for seq := range inFlight {
+		if seq-1 < acked {
+			acked = seq - 1
+		}
+	}
+	return acked
+}
+
+// sendRequest writes payload to the leader under a fresh request ID and the
+// request's sequence number, and returns the channel its reply will be
+// delivered on. It fails with ErrConnectionLost if there is no leader to
+// send to within timeout.
+func sendRequest(seq uint64, msgType MessageType, payload interface{}, timeout time.Duration) (string, chan Envelope, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		if !waitForConnectionFor(time.Until(deadline)) {
+			return "", nil, ErrConnectionLost
+		}
+		requestID := nextRequestID()
+		msg, err := json.Marshal(Envelope{
+			Version:   ProtocolVersion,
+			RequestID: requestID,
+			Seq:       seq,
+			AckedSeq:  ackedSeq(),
+			Type:      msgType,
+			Payload:   data,
+		})
+		if err != nil {
+			return "", nil, err
+		}
+		replyCh := make(chan Envelope, 1)
+		connMu.Lock()
+		if !isConnected {
+			connMu.Unlock()
+			continue
+		}
+		pending[requestID] = replyCh
+		err = Conn.WriteMessage(websocket.TextMessage, msg)
+		if err != nil {
+			delete(pending, requestID)
+			connMu.Unlock()
+			log.Printf("error sending %s request: %v", msgType, err)
+			time.Sleep(time.Second)
+			continue
+		}
+		connMu.Unlock()
+		log.Printf("Sent %s request %s: %s", msgType, requestID, data)
+		return requestID, replyCh, nil
+	}
+}
+
+func awaitReply(requestID string, replyCh chan Envelope, timeout time.Duration) (Envelope, error) {
+	select {
+	case env, ok := <-replyCh:
+		if !ok {
+			return Envelope{}, ErrConnectionLost
+		}
+		if env.Type == MessageError {
+			var errorReply ErrorReply
+			json.Unmarshal(env.Payload, &errorReply)
+			return env, fmt.Errorf("request %s failed: %s", requestID, errorReply.Message)
+		}
+		return env, nil
+	case <-time.After(timeout):
+		connMu.Lock()
+		delete(pending, requestID)
+		connMu.Unlock()
+		return Envelope{}, errReplyTimeout
+	}
+}
+
+// request sends payload and decodes the matching reply into reply.
+func request(msgType MessageType, payload interface{}, reply interface{}, timeout time.Duration) error {
+	seq := startSeq()
+	defer finishSeq(seq)
+	return requestWithSeq(seq, msgType, payload, reply, timeout)
+}
+
+// requestExactlyOnce is request for commands that change the store. It
+// resends the request under the same sequence number whenever the connection
+// is lost or no reply arrives within timeout; the cluster answers a resend
+// with the original result instead of applying the command again. The
+// sequence number stays unacknowledged until a reply arrives, so the cluster
+// keeps that result for as long as a resend may come. After
+// MaxRequestAttempts sends it gives up with an error, and the command may or
+// may not have been applied.
+func requestExactlyOnce(msgType MessageType, payload interface{}, reply interface{}, timeout time.Duration) error {
+	seq := startSeq()
+	defer finishSeq(seq)
+	var err error
+	for attempt := 1; attempt <= MaxRequestAttempts; attempt++ {
+		err = requestWithSeq(seq, msgType, payload, reply, timeout)
+		switch {
+		case errors.Is(err, ErrConnectionLost):
+			log.Printf("Connection lost, resending %s request %d", msgType, seq)
+		case errors.Is(err, errReplyTimeout):
+			log.Printf("No reply to %s request %d, resending", msgType, seq)
+		default:
+			return err
+		}
+	}
+	return fmt.Errorf("giving up on %s request %d after %d attempts: %w", msgType, seq, MaxRequestAttempts, err)
+}
+
+// requestWithSeq sends payload as the request numbered seq. Resends of one
+// request must use the same seq.
+func requestWithSeq(seq uint64, msgType MessageType, payload interface{}, reply interface{}, timeout time.Duration) error {
+	requestID, replyCh, err := sendRequest(seq, msgType, payload, timeout)
+	if err != nil {
+		return err
+	}
+	env, err := awaitReply(requestID, replyCh, timeout)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(env.Payload, reply)
+}
+
+// dispatch routes a message read off the connection to the request waiting
+// for it, or to handleEvent if it is not a reply.
+func dispatch(message []byte) {
+	var env Envelope
+	if err := json.Unmarshal(message, &env); err != nil {
+		log.Printf("Invalid message: %v", err)
+		return
+	}
+	if env.Type == MessageEvent {
+		handleEvent(env)
+		return
+	}
+	if env.Type == MessageWatch && env.RequestID == "" {
+		handleWatchResponse(env)
+		return
+	}
+	connMu.Lock()
+	replyCh, ok := pending[env.RequestID]
+	delete(pending, env.RequestID)
+	connMu.Unlock()
+	if !ok {
+		log.Printf("Dropping %s reply for unknown request %q", env.Type, env.RequestID)
+		return
+	}
+	replyCh <- env
+}
+
+func handleEvent(env Envelope) {
+	var event LockEvent
+	if err := json.Unmarshal(env.Payload, &event); err != nil {
+		log.Printf("Invalid event: %v", err)
+		return
+	}
+	log.Printf("Event %s for lock %s", event.Event, event.Key)
+}
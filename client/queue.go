@@ -0,0 +1,77 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+type QueueRequest struct {
+	Op                string        `json:"op"`
+	Queue             string        `json:"queue"`
+	Payload           []byte        `json:"payload,omitempty"`
+	ItemID            uint64        `json:"itemId,omitempty"`
+	VisibilityTimeout time.Duration `json:"visibilityTimeout,omitempty"`
+}
+
+type QueueItem struct {
+	ID         uint64    `json:"id"`
+	Payload    []byte    `json:"payload"`
+	EnqueuedAt time.Time `json:"enqueuedAt"`
+	Deliveries int       `json:"deliveries"`
+}
+
+type QueueReply struct {
+	Success bool       `json:"success"`
+	Queue   string     `json:"queue"`
+	ItemID  uint64     `json:"itemId"`
+	Item    *QueueItem `json:"item"`
+	Empty   bool       `json:"empty"`
+	Error   string     `json:"error"`
+}
+
+var ErrQueueEmpty = errors.New("queue is empty")
+
+func queueRequest(req QueueRequest) (QueueReply, error) {
+	var reply QueueReply
+	if err := request(MessageQueue, req, &reply, 10*time.Second); err != nil {
+		return reply, err
+	}
+	if !reply.Success {
+		return reply, fmt.Errorf("%s on queue %s failed: %s", req.Op, req.Queue, reply.Error)
+	}
+	return reply, nil
+}
+
+// Enqueue appends payload to the named queue and returns the item's ID.
+func Enqueue(queue string, payload []byte) (uint64, error) {
+	reply, err := queueRequest(QueueRequest{Op: "enqueue", Queue: queue, Payload: payload})
+	return reply.ItemID, err
+}
+
+// Dequeue takes the oldest item off the named queue. The item stays hidden
+// from other consumers for visibilityTimeout; unless it is acknowledged
+// before then it is delivered again. A zero visibilityTimeout uses the
+// server's default.
+func Dequeue(queue string, visibilityTimeout time.Duration) (QueueItem, error) {
+	reply, err := queueRequest(QueueRequest{Op: "dequeue", Queue: queue, VisibilityTimeout: visibilityTimeout})
+	if err != nil {
+		return QueueItem{}, err
+	}
+	if reply.Empty || reply.Item == nil {
+		return QueueItem{}, fmt.Errorf("%w: %s", ErrQueueEmpty, queue)
+	}
+	return *reply.Item, nil
+}
+
+// Ack removes a delivered item from the queue for good.
+func Ack(queue string, itemID uint64) error {
+	_, err := queueRequest(QueueRequest{Op: "ack", Queue: queue, ItemID: itemID})
+	return err
+}
+
+// Nack hands a delivered item back to the front of the queue right away.
+func Nack(queue string, itemID uint64) error {
+	_, err := queueRequest(QueueRequest{Op: "nack", Queue: queue, ItemID: itemID})
+	return err
+}
@@ -0,0 +1,61 @@
+package client
+
+import (
+	"log"
+	"time"
+)
+
+type SessionKeepAliveReply struct {
+	Success    bool
+	SessionID  string
+	ExpiryTime time.Time
+	Error      string
+}
+
+var (
+	// SessionID is the session the locking service ties this client's locks
+	// to. It is sent on reconnect so the session can be resumed.
+	SessionID  string
+	SessionTTL = 10 * time.Second
+)
+
+func adoptSession(sessionID string, ttl time.Duration) {
+	connMu.Lock()
+	defer connMu.Unlock()
+	if SessionID != "" && SessionID != sessionID {
+		log.Printf("Session %s expired, locks held under it were released", SessionID)
+	}
+	SessionID = sessionID
+	if ttl > 0 {
+		SessionTTL = ttl
+	}
+	log.Printf("Using session %s with TTL %v", SessionID, SessionTTL)
+}
+
+// keepSessionAlive heartbeats the session every third of its TTL. If the
+// leader reports the session gone, the connection is dropped so that the
+// reader reconnects and opens a fresh one.
+func keepSessionAlive() {
+	for {
+		waitForConnection()
+		connMu.Lock()
+		interval := SessionTTL / 3
+		connMu.Unlock()
+		time.Sleep(interval)
+
+		var reply SessionKeepAliveReply
+		if err := request(MessageSession, struct{}{}, &reply, interval); err != nil {
+			log.Printf("Session heartbeat failed: %v", err)
+			continue
+		}
+		if !reply.Success {
+			log.Printf("Session %s lost: %s", reply.SessionID, reply.Error)
+			connMu.Lock()
+			SessionID = ""
+			if Conn != nil {
+				Conn.Close()
+			}
+			connMu.Unlock()
+		}
+	}
+}
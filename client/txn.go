@@ -0,0 +1,105 @@
+package client
+
+import (
+	"fmt"
+	"time"
+)
+
+type TxnCompare struct {
+	Key     string `json:"key"`
+	Target  string `json:"target"`
+	Result  string `json:"result"`
+	Value   []byte `json:"value,omitempty"`
+	Version uint64 `json:"version,omitempty"`
+}
+
+type TxnOp struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value []byte `json:"value,omitempty"`
+}
+
+type TxnOpResult struct {
+	Op      string `json:"op"`
+	Key     string `json:"key"`
+	Value   []byte `json:"value"`
+	Version uint64 `json:"version"`
+	Found   bool   `json:"found"`
+}
+
+// TxnReply reports which branch of a transaction ran and the result of each
+// of its operations, in order.
+type TxnReply struct {
+	Success   bool          `json:"success"`
+	Succeeded bool          `json:"succeeded"`
+	Results   []TxnOpResult `json:"results"`
+	Error     string        `json:"error"`
+}
+
+// Compare checks the value of key; result is one of "=", "!=", "<" or ">".
+// A key that is not set compares as an empty value.
+func Compare(key string, result string, value []byte) TxnCompare {
+	return TxnCompare{Key: key, Target: "value", Result: result, Value: value}
+}
+
+// CompareVersion checks the version of key; a key that is not set is at
+// version 0.
+func CompareVersion(key string, result string, version uint64) TxnCompare {
+	return TxnCompare{Key: key, Target: "version", Result: result, Version: version}
+}
+
+func OpPut(key string, value []byte) TxnOp {
+	return TxnOp{Op: "put", Key: key, Value: value}
+}
+
+func OpGet(key string) TxnOp {
+	return TxnOp{Op: "get", Key: key}
+}
+
+func OpDelete(key string) TxnOp {
+	return TxnOp{Op: "delete", Key: key}
+}
+
+// TxnBuilder collects the comparisons and branches of a transaction:
+//
+//	reply, err := client.Txn().
+//		If(client.CompareVersion("config", "=", 3)).
+//		Then(client.OpPut("config", next)).
+//		Else(client.OpGet("config")).
+//		Commit()
+type TxnBuilder struct {
+	Compare []TxnCompare `json:"compare"`
+	Success []TxnOp      `json:"success"`
+	Failure []TxnOp      `json:"failure"`
+}
+
+func Txn() *TxnBuilder {
+	return &TxnBuilder{}
+}
+
+func (txn *TxnBuilder) If(compares ...TxnCompare) *TxnBuilder {
+	txn.Compare = append(txn.Compare, compares...)
+	return txn
+}
+
+func (txn *TxnBuilder) Then(ops ...TxnOp) *TxnBuilder {
+	txn.Success = append(txn.Success, ops...)
+	return txn
+}
+
+func (txn *TxnBuilder) Else(ops ...TxnOp) *TxnBuilder {
+	txn.Failure = append(txn.Failure, ops...)
+	return txn
+}
+
+// Commit applies the transaction atomically on the cluster.
+func (txn *TxnBuilder) Commit() (TxnReply, error) {
+	var reply TxnReply
+	if err := requestExactlyOnce(MessageTxn, txn, &reply, 10*time.Second); err != nil {
+		return reply, err
+	}
+	if !reply.Success {
+		return reply, fmt.Errorf("transaction failed: %s", reply.Error)
+	}
+	return reply, nil
+}
@@ -0,0 +1,276 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type WatchEvent struct {
+	Type     string `json:"type"`
+	Key      string `json:"key"`
+	Value    []byte `json:"value"`
+	Version  uint64 `json:"version"`
+	Revision uint64 `json:"revision"`
+}
+
+type watchRequest struct {
+	Op            string `json:"op"`
+	WatchID       string `json:"watchId"`
+	Key           string `json:"key"`
+	Prefix        bool   `json:"prefix,omitempty"`
+	StartRevision uint64 `json:"startRevision,omitempty"`
+}
+
+type watchReply struct {
+	Success         bool   `json:"success"`
+	WatchID         string `json:"watchId"`
+	Revision        uint64 `json:"revision"`
+	CompactRevision uint64 `json:"compactRevision"`
+	Error           string `json:"error"`
+}
+
+type watchResponse struct {
+	WatchID  string       `json:"watchId"`
+	Revision uint64       `json:"revision"`
+	Events   []WatchEvent `json:"events"`
+	Canceled bool         `json:"canceled"`
+	Error    string       `json:"error"`
+}
+
+// A Watch streams changes to a key or prefix. After a reconnect it is opened
+// again on the new leader from the revision after the last one delivered, so
+// no change is missed or repeated. If the server no longer holds that
+// revision the watch ends and Err says why.
+type Watch struct {
+	ID     string
+	key    string
+	prefix bool
+	events chan WatchEvent
+	wake   chan struct{}
+	done   chan struct{}
+
+	mu           sync.Mutex
+	queue        []WatchEvent
+	lastRevision uint64
+	opened       bool
+	closed       bool
+	err          error
+}
+
+var (
+	watchesMu sync.Mutex
+	watches   = make(map[string]*Watch)
+	watchSeq  uint64
+)
+
+// WatchKey watches key. With a startRevision the changes made since that
+// revision are delivered first; otherwise only new changes are.
+func WatchKey(key string, startRevision uint64) (*Watch, error) {
+	return openWatch(key, false, startRevision)
+}
+
+// WatchPrefix watches every key starting with prefix.
+func WatchPrefix(prefix string, startRevision uint64) (*Watch, error) {
+	return openWatch(prefix, true, startRevision)
+}
+
+func openWatch(key string, prefix bool, startRevision uint64) (*Watch, error) {
+	w := &Watch{
+		ID:     fmt.Sprintf("w%d", atomic.AddUint64(&watchSeq, 1)),
+		key:    key,
+		prefix: prefix,
+		events: make(chan WatchEvent),
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	if startRevision > 0 {
+		w.lastRevision = startRevision - 1
+	}
+	// registered first as replayed events can arrive before the reply
+	watchesMu.Lock()
+	watches[w.ID] = w
+	watchesMu.Unlock()
+	if err := w.subscribe(startRevision); err != nil {
+		watchesMu.Lock()
+		delete(watches, w.ID)
+		watchesMu.Unlock()
+		return nil, err
+	}
+	w.mu.Lock()
+	w.opened = true
+	w.mu.Unlock()
+	go w.deliver()
+	return w, nil
+}
+
+func (w *Watch) subscribe(startRevision uint64) error {
+	var reply watchReply
+	req := watchRequest{Op: "create", WatchID: w.ID, Key: w.key, Prefix: w.prefix, StartRevision: startRevision}
+	if err := request(MessageWatch, req, &reply, 10*time.Second); err != nil {
+		return err
+	}
+	if !reply.Success {
+		return fmt.Errorf("watch on %s failed: %s", w.key, reply.Error)
+	}
+	w.mu.Lock()
+	if startRevision == 0 && reply.Revision > w.lastRevision {
+		w.lastRevision = reply.Revision
+	}
+	w.mu.Unlock()
+	return nil
+}
+
+// Events delivers the changes in revision order. It is closed once the watch
+// is cancelled or fails.
+func (w *Watch) Events() <-chan WatchEvent {
+	return w.events
+}
+
+// Revision is the last revision delivered to the watch.
+func (w *Watch) Revision() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.lastRevision
+}
+
+// Err reports why the watch ended, or nil if it was cancelled.
+func (w *Watch) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Cancel stops the watch; events not yet received are dropped.
+func (w *Watch) Cancel() error {
+	watchesMu.Lock()
+	_, open := watches[w.ID]
+	delete(watches, w.ID)
+	watchesMu.Unlock()
+	if !open {
+		return errors.New("watch already closed")
+	}
+	w.stop(nil)
+	close(w.done)
+	var reply watchReply
+	return request(MessageWatch, watchRequest{Op: "cancel", WatchID: w.ID}, &reply, 10*time.Second)
+}
+
+func (w *Watch) stop(err error) {
+	w.mu.Lock()
+	w.closed = true
+	w.err = err
+	w.mu.Unlock()
+	w.signal()
+}
+
+func (w *Watch) signal() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// push queues a revision's events unless it has been delivered already, as
+// happens when a resumed watch replays history.
+func (w *Watch) push(resp watchResponse) {
+	w.mu.Lock()
+	if w.closed || resp.Revision <= w.lastRevision {
+		w.mu.Unlock()
+		return
+	}
+	w.queue = append(w.queue, resp.Events...)
+	w.lastRevision = resp.Revision
+	w.mu.Unlock()
+	w.signal()
+}
+
+// deliver hands queued events to the consumer so a slow reader never holds
+// up the connection.
+func (w *Watch) deliver() {
+	defer close(w.events)
+	for {
+		w.mu.Lock()
+		if len(w.queue) == 0 {
+			closed := w.closed
+			w.mu.Unlock()
+			if closed {
+				return
+			}
+			select {
+			case <-w.wake:
+			case <-w.done:
+			}
+			continue
+		}
+		event := w.queue[0]
+		w.queue = w.queue[1:]
+		w.mu.Unlock()
+		select {
+		case w.events <- event:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func handleWatchResponse(env Envelope) {
+	var resp watchResponse
+	if err := json.Unmarshal(env.Payload, &resp); err != nil {
+		log.Printf("Invalid watch response: %v", err)
+		return
+	}
+	watchesMu.Lock()
+	w, ok := watches[resp.WatchID]
+	watchesMu.Unlock()
+	if !ok {
+		return
+	}
+	if resp.Canceled {
+		// the server dropped a watch that fell behind; pick up where the
+		// delivered events end, off the goroutine reading the connection
+		log.Printf("Watch %s cancelled by the server: %s", w.ID, resp.Error)
+		go w.resume()
+		return
+	}
+	w.push(resp)
+}
+
+// resumeWatches opens every watch again after connecting to a leader.
+func resumeWatches() {
+	watchesMu.Lock()
+	open := make([]*Watch, 0, len(watches))
+	for _, w := range watches {
+		open = append(open, w)
+	}
+	watchesMu.Unlock()
+	for _, w := range open {
+		w.resume()
+	}
+}
+
+// resume opens the watch again from the revision after the last one
+// delivered.
+func (w *Watch) resume() {
+	w.mu.Lock()
+	opened, startRevision := w.opened, w.lastRevision+1
+	w.mu.Unlock()
+	if !opened {
+		// still being opened by openWatch
+		return
+	}
+	err := w.subscribe(startRevision)
+	if err == nil || errors.Is(err, ErrConnectionLost) {
+		// a lost connection is retried on the next reconnect
+		return
+	}
+	log.Printf("Could not resume watch %s: %v", w.ID, err)
+	watchesMu.Lock()
+	delete(watches, w.ID)
+	watchesMu.Unlock()
+	w.stop(err)
+}
@@ -27,7 +27,7 @@ func main() {
 	// 	Stop(server)
 	// 	os.Exit(0)
 	// }()
-	sigCh := make(chan os.Signal)
+	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
 
 	fmt.Println("\n\n=============================================================")
@@ -0,0 +1,150 @@
+package raft
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// requireOperator lets a request through to handler only if it carries the
+// operator token from RAFT_ADMIN_TOKEN as "Authorization: Bearer <token>".
+// The admin endpoints are closed while no token is configured.
+func requireOperator(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := os.Getenv("RAFT_ADMIN_TOKEN")
+		if token == "" {
+			http.Error(w, "admin endpoints are disabled, set RAFT_ADMIN_TOKEN", http.StatusForbidden)
+			return
+		}
+		passed, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(passed), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "operator token required", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (server *Server) ListLocks() ([]LockDescription, error) {
+	success, reply, err := server.SubmitToServer(ListLocks{})
+	if err != nil {
+		return nil, err
+	}
+	if !success {
+		return nil, errors.New("lock listing could not be served, try different server(leader)")
+	}
+	locks, ok := reply.([]LockDescription)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply for lock listing: %T", reply)
+	}
+	return locks, nil
+}
+
+func (server *Server) DescribeLock(key string) (LockDescription, error) {
+	success, reply, err := server.SubmitToServer(DescribeLock{Key: key})
+	if err != nil {
+		return LockDescription{}, err
+	}
+	if !success {
+		return LockDescription{}, errors.New("lock description could not be served, try different server(leader)")
+	}
+	lock, ok := reply.(LockDescription)
+	if !ok {
+		return LockDescription{}, fmt.Errorf("unexpected reply for lock description: %T", reply)
+	}
+	return lock, nil
+}
+
+// ForceReleaseLock releases key through the log no matter who holds it. The
+// release is recorded against operator and reason.
+func (server *Server) ForceReleaseLock(key string, operator string, reason string) (string, error) {
+	if operator == "" {
+		return "", errors.New("operator not passed")
+	}
+	cmd := LockForceReleaseCommand{
+		Key:      key,
+		Operator: operator,
+		Reason:   reason,
+	}
+	success, reply, err := server.SubmitToServer(cmd)
+	if err != nil {
+		return "", err
+	}
+	if !success {
+		return "", errors.New("force release could not be submitted, try different server(leader)")
+	}
+	holder, _ := reply.(string)
+	return holder, nil
+}
+
+// AdminLocksHandler serves GET /admin/locks, or GET /admin/locks?key=<lockKey>
+// for a single lock.
+func (server *Server) AdminLocksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if key := r.URL.Query().Get("key"); key != "" {
+		lock, err := server.DescribeLock(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, lock)
+		return
+	}
+	locks, err := server.ListLocks()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, locks)
+}
+
+// AdminLockPolicyHandler serves POST /admin/locks/policy with form values key
+// and policy (FIFO, PRIORITY or FAIR_SHARE).
+func (server *Server) AdminLockPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key := r.FormValue("key")
+	if key == "" {
+		http.Error(w, "lock key not passed", http.StatusBadRequest)
+		return
+	}
+	policy := r.FormValue("policy")
+	if _, err := parseLockPolicy(policy); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := server.SetLockPolicy(key, policy); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, map[string]string{"key": key, "policy": policy})
+}
+
+// AdminForceReleaseHandler serves POST /admin/locks/release with form values
+// key, operator and reason.
+func (server *Server) AdminForceReleaseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key := r.FormValue("key")
+	if key == "" {
+		http.Error(w, "lock key not passed", http.StatusBadRequest)
+		return
+	}
+	holder, err := server.ForceReleaseLock(key, r.FormValue("operator"), r.FormValue("reason"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, map[string]string{"key": key, "holder": holder})
+}
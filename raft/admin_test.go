@@ -0,0 +1,34 @@
+package raft
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminEndpointsRequireOperatorToken(t *testing.T) {
+	handler := requireOperator(func(w http.ResponseWriter, r *http.Request) {})
+	cases := []struct {
+		configured string
+		header     string
+		want       int
+	}{
+		{"", "Bearer anything", http.StatusForbidden},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "secret", http.StatusUnauthorized},
+		{"secret", "Bearer secret", http.StatusOK},
+	}
+	for _, c := range cases {
+		t.Setenv("RAFT_ADMIN_TOKEN", c.configured)
+		request := httptest.NewRequest(http.MethodGet, "/admin/locks", nil)
+		if c.header != "" {
+			request.Header.Set("Authorization", c.header)
+		}
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+		if recorder.Code != c.want {
+			t.Errorf("token %q, Authorization %q: got status %d, want %d", c.configured, c.header, recorder.Code, c.want)
+		}
+	}
+}
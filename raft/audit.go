@@ -0,0 +1,145 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// entryTime is the leader's timestamp of the log entry being applied. Entries
+// written before log entries carried a time fall back to the local clock.
+func (node *Node) entryTime() time.Time {
+	if node.applying.Time.IsZero() {
+		return time.Now()
+	}
+	return node.applying.Time
+}
+
+func lockAuditRecord(event string, key string, lockInfo LockInfo) LockAuditRecord {
+	return LockAuditRecord{
+		Event:        event,
+		Key:          key,
+		ClientID:     lockInfo.Holder,
+		SessionID:    lockInfo.SessionID,
+		FencingToken: lockInfo.FencingToken.Value,
+		AcquiredAt:   lockInfo.AcquiredAt,
+		ExpiryTime:   lockInfo.ExpiryTime,
+	}
+}
+
+// recordLockAudit appends record to the audit trail under the log entry
+// being applied. Every replica applies the same entries in the same order,
+// so every replica ends up with the same trail. Must only be called from
+// applyLogEntry.
+func (node *Node) recordLockAudit(record LockAuditRecord) {
+	record.Index = node.applying.Index
+	record.Term = node.applying.Term
+	record.Time = node.entryTime()
+	switch record.Event {
+	case AuditLockReleased, AuditLockExpired, AuditLockForceReleased:
+		record.HeldFor = record.Time.Sub(record.AcquiredAt)
+	}
+	node.auditSeq++
+	auditKey := fmt.Sprintf("%s%020d_%04d", AUDIT_KEY_PREFIX, record.Index, node.auditSeq)
+	node.setData(auditKey, record)
+	node.pruneLockAudit()
+}
+
+// pruneLockAudit drops the oldest records once the trail holds
+// AUDIT_PRUNE_BATCH more than MAX_AUDIT_RECORDS, in one range delete, so
+// most applies only pay for the count. Replicas record the same events in
+// the same order, so they drop the same ones.
+func (node *Node) pruneLockAudit() {
+	end := prefixEnd(AUDIT_KEY_PREFIX)
+	excess := node.db.CountRange(AUDIT_KEY_PREFIX, end) - MAX_AUDIT_RECORDS
+	if excess < AUDIT_PRUNE_BATCH {
+		return
+	}
+	oldest := node.db.Range(AUDIT_KEY_PREFIX, end, excess)
+	node.db.DeleteRange(AUDIT_KEY_PREFIX, oldest[len(oldest)-1].Key+"\x00")
+}
+
+// queryLockAudit returns the matching records, oldest first. With a limit
+// only the most recent ones are kept.
+func (node *Node) queryLockAudit(query AuditQuery) []LockAuditRecord {
+	records := []LockAuditRecord{}
+	for _, entry := range node.db.Range(AUDIT_KEY_PREFIX, prefixEnd(AUDIT_KEY_PREFIX), 0) {
+		var record LockAuditRecord
+		if found, _ := node.readFromStorage(entry.Key, &record); !found {
+			continue
+		}
+		if query.Key != "" && record.Key != query.Key {
+			continue
+		}
+		if query.ClientID != "" && record.ClientID != query.ClientID {
+			continue
+		}
+		if !query.From.IsZero() && record.Time.Before(query.From) {
+			continue
+		}
+		if !query.To.IsZero() && record.Time.After(query.To) {
+			continue
+		}
+		records = append(records, record)
+	}
+	if query.Limit > 0 && len(records) > query.Limit {
+		records = records[len(records)-query.Limit:]
+	}
+	return records
+}
+
+func (server *Server) QueryLockAudit(query AuditQuery) ([]LockAuditRecord, error) {
+	success, reply, err := server.SubmitToServer(query)
+	if err != nil {
+		return nil, err
+	}
+	if !success {
+		return nil, errors.New("audit query could not be served, try different server(leader)")
+	}
+	records, ok := reply.([]LockAuditRecord)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply for audit query: %T", reply)
+	}
+	return records, nil
+}
+
+// AdminAuditHandler serves GET /admin/audit with optional key, client, from,
+// to (RFC 3339) and limit parameters.
+func (server *Server) AdminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	params := r.URL.Query()
+	query := AuditQuery{
+		Key:      params.Get("key"),
+		ClientID: params.Get("client"),
+	}
+	var err error
+	if from := params.Get("from"); from != "" {
+		if query.From, err = time.Parse(time.RFC3339, from); err != nil {
+			http.Error(w, "invalid from time", http.StatusBadRequest)
+			return
+		}
+	}
+	if to := params.Get("to"); to != "" {
+		if query.To, err = time.Parse(time.RFC3339, to); err != nil {
+			http.Error(w, "invalid to time", http.StatusBadRequest)
+			return
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	records, err := server.QueryLockAudit(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, records)
+}
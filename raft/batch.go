@@ -0,0 +1,51 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+)
+
+func validateBatchWrite(batch BatchWrite) error {
+	if len(batch.Writes) == 0 {
+		return errors.New("batch has no writes")
+	}
+	if len(batch.Writes) > MAX_BATCH_WRITES {
+		return fmt.Errorf("batch of %d writes exceeds the limit of %d", len(batch.Writes), MAX_BATCH_WRITES)
+	}
+	for _, write := range batch.Writes {
+		if err := validateWrite(write); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyBatchWrite applies the writes in order; a key written twice ends up
+// with the later value.
+func (node *Node) applyBatchWrite(batch BatchWrite) BatchWriteResult {
+	for _, write := range batch.Writes {
+		node.applyWrite(write)
+	}
+	return BatchWriteResult{Revision: node.applying.Index, Count: len(batch.Writes)}
+}
+
+// write many keys with a single log entry and wait until they are applied;
+// the returned revision is the one all of them were written at
+func SetDataBatch(server Submitter, writes []Write) (BatchWriteResult, error) {
+	cmd := BatchWrite{Writes: writes}
+	if err := validateBatchWrite(cmd); err != nil {
+		return BatchWriteResult{}, err
+	}
+	success, reply, err := server.SubmitToServer(cmd)
+	if err != nil {
+		return BatchWriteResult{}, err
+	}
+	if !success {
+		return BatchWriteResult{}, errors.New("command could not be submitted, try different server")
+	}
+	result, ok := reply.(BatchWriteResult)
+	if !ok {
+		return BatchWriteResult{}, fmt.Errorf("unexpected reply for batch write: %T", reply)
+	}
+	return result, nil
+}
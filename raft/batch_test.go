@@ -0,0 +1,64 @@
+package raft
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// BenchmarkWrites measures writes per second on a three node cluster: one
+// write per entry one at a time, concurrent writers whose entries share
+// persist and replication rounds through group commit, and writes batched
+// into one entry per request.
+func BenchmarkWrites(b *testing.B) {
+	leader := startCluster(b, 3)[0]
+	runs := []struct {
+		name      string
+		batchSize int
+		writers   int
+	}{
+		{"sequential", 1, 1},
+		{"group-commit", 1, 16},
+		{"batched", 100, 1},
+		{"batched-group-commit", 100, 16},
+	}
+	for _, run := range runs {
+		b.Run(run.name, func(b *testing.B) {
+			prefix := fmt.Sprintf("bench/%s/%d/", run.name, b.N)
+			b.ResetTimer()
+			writeKeys(b, leader, prefix, b.N, run.batchSize, run.writers)
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "writes/s")
+		})
+	}
+}
+
+// writeKeys writes count keys under prefix from writers goroutines, batchSize
+// puts per request, and returns once every one has been applied.
+func writeKeys(b *testing.B, server *Server, prefix string, count int, batchSize int, writers int) {
+	var next int64
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				from := int(atomic.AddInt64(&next, int64(batchSize))) - batchSize
+				if from >= count {
+					return
+				}
+				to := min(from+batchSize, count)
+				writes := make([]Write, 0, to-from)
+				for i := from; i < to; i++ {
+					writes = append(writes, Write{Key: fmt.Sprintf("%s%08d", prefix, i), Value: []byte(strconv.Itoa(i))})
+				}
+				if _, err := SetDataBatch(server, writes); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
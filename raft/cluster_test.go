@@ -0,0 +1,118 @@
+package raft
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ports are derived from server ids, so every cluster started by the tests
+// takes ids no earlier cluster used
+var nextClusterId uint64 = 100
+
+// startCluster runs size servers in this process and joins them to the first
+// one once it leads.
+func startCluster(t testing.TB, size int) []*Server {
+	t.Helper()
+	firstId := atomic.AddUint64(&nextClusterId, uint64(size)) - uint64(size)
+	registerGobTypes()
+	servers := make([]*Server, 0, size)
+	for i := 0; i < size; i++ {
+		server, err := CreateServer(firstId + uint64(i))
+		if err != nil {
+			t.Fatalf("creating server %d: %v", firstId+uint64(i), err)
+		}
+		servers = append(servers, server)
+		t.Cleanup(server.node.Stop)
+	}
+	leader := servers[0]
+	waitFor(t, 5*time.Second, "first server to lead", func() bool {
+		_, _, isLeader := leader.node.Report()
+		return isLeader
+	})
+	leaderAddr := fmt.Sprintf("localhost:%d", 8080+firstId)
+	for _, server := range servers[1:] {
+		if err := server.RequestToJoinCluster(leader.id, leaderAddr); err != nil {
+			t.Fatalf("server %d joining the cluster: %v", server.id, err)
+		}
+		waitFor(t, 5*time.Second, fmt.Sprintf("server %d to be replicated to", server.id), func() bool {
+			status, err := leader.ReplicationStatus()
+			return err == nil && status[server.id].State == ProgressReplicate
+		})
+	}
+	return servers
+}
+
+func waitFor(t testing.TB, timeout time.Duration, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// dialClient connects to server over /ws as the client library does, and
+// returns the connection with the server's answer.
+func dialClient(t *testing.T, server *Server, req ConnectionRequest) (*websocket.Conn, ConnectionReply) {
+	t.Helper()
+	endpoint := httptest.NewServer(http.HandlerFunc(server.WSHandler))
+	t.Cleanup(endpoint.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(endpoint.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dialing server %d: %v", server.id, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.WriteJSON(req); err != nil {
+		t.Fatalf("sending the connection request: %v", err)
+	}
+	var reply ConnectionReply
+	if err := conn.ReadJSON(&reply); err != nil || !reply.Success {
+		t.Fatalf("connecting %s: %+v, %v", req.ClientID, reply, err)
+	}
+	return conn, reply
+}
+
+func sendEnvelope(t *testing.T, conn *websocket.Conn, msgType MessageType, requestID string, payload interface{}) {
+	t.Helper()
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("encoding a %s request: %v", msgType, err)
+	}
+	env := Envelope{Version: LOCK_PROTOCOL_VERSION, RequestID: requestID, Type: msgType, Payload: data}
+	if err := conn.WriteJSON(env); err != nil {
+		t.Fatalf("sending %s request %s: %v", msgType, requestID, err)
+	}
+}
+
+// awaitReply reads off conn until the reply to requestID arrives, skipping
+// events, and decodes it into reply.
+func awaitReply(t *testing.T, conn *websocket.Conn, requestID string, reply interface{}) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var env Envelope
+		if err := conn.ReadJSON(&env); err != nil {
+			t.Fatalf("waiting for the reply to %s: %v", requestID, err)
+		}
+		if env.RequestID != requestID {
+			continue
+		}
+		if env.Type == MessageError {
+			t.Fatalf("request %s failed: %s", requestID, env.Payload)
+		}
+		if err := json.Unmarshal(env.Payload, reply); err != nil {
+			t.Fatalf("decoding the reply to %s: %v", requestID, err)
+		}
+		return
+	}
+}
@@ -33,3 +33,24 @@ func (c *Set) Remove(key uint64) error {
 func (c *Set) Size() int {
 	return len(c.peerSet)
 }
+
+// ReplicationConfig bounds the AppendEntries traffic from the leader to each
+// follower.
+type ReplicationConfig struct {
+	MaxEntriesPerAppend int // most log entries in one AppendEntries
+	MaxBytesPerAppend   int // most stored bytes of entries in one AppendEntries; a larger entry is sent on its own
+	MaxInflightAppends  int // most AppendEntries awaiting a reply while a follower is being replicated to
+}
+
+var DefaultReplicationConfig = ReplicationConfig{
+	MaxEntriesPerAppend: 512,
+	MaxBytesPerAppend:   1 << 20,
+	MaxInflightAppends:  16,
+}
+
+func (config ReplicationConfig) validate() error {
+	if config.MaxEntriesPerAppend <= 0 || config.MaxBytesPerAppend <= 0 || config.MaxInflightAppends <= 0 {
+		return fmt.Errorf("replication limits must be positive: %+v", config)
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+func barrierKey(name string) string {
+	return fmt.Sprintf("%s%s", BARRIER_KEY_PREFIX, name)
+}
+
+func latchKey(name string) string {
+	return fmt.Sprintf("%s%s", LATCH_KEY_PREFIX, name)
+}
+
+func (node *Node) getBarrier(name string) (Barrier, bool) {
+	var barrier Barrier
+	found, _ := node.readFromStorage(barrierKey(name), &barrier)
+	return barrier, found
+}
+
+func (node *Node) getLatch(name string) (Latch, bool) {
+	var latch Latch
+	found, _ := node.readFromStorage(latchKey(name), &latch)
+	return latch, found
+}
+
+// addCoordinationWaiter adds waiter, or refreshes its request ID if the
+// client is already waiting, e.g. after resending over a new connection.
+func addCoordinationWaiter(waiters []CoordinationWaiter, waiter CoordinationWaiter) []CoordinationWaiter {
+	for i := range waiters {
+		if waiters[i].ClientID == waiter.ClientID {
+			waiters[i] = waiter
+			return waiters
+		}
+	}
+	return append(waiters, waiter)
+}
+
+// validateCoordinationCommand is run by the leader before a barrier or latch
+// command is appended to the log.
+// expects node.mu to be held
+func (node *Node) validateCoordinationCommand(command interface{}) error {
+	switch cmd := command.(type) {
+	case BarrierArriveCommand:
+		if cmd.Parties <= 0 {
+			return errors.New("barrier needs at least one party")
+		}
+		if barrier, found := node.getBarrier(cmd.Name); found && len(barrier.Arrived) > 0 && barrier.Parties != cmd.Parties {
+			return fmt.Errorf("barrier %s is waiting for %d parties, not %d", cmd.Name, barrier.Parties, cmd.Parties)
+		}
+	case LatchCreateCommand:
+		if cmd.Count <= 0 {
+			return errors.New("latch count must be positive")
+		}
+		if latch, found := node.getLatch(cmd.Name); found && latch.Count > 0 {
+			return fmt.Errorf("latch %s is still counting down from %d", cmd.Name, latch.Count)
+		}
+	case LatchCountDownCommand:
+		latch, found := node.getLatch(cmd.Name)
+		if !found {
+			return fmt.Errorf("latch %s does not exist", cmd.Name)
+		}
+		if latch.Count == 0 {
+			return fmt.Errorf("latch %s is already open", cmd.Name)
+		}
+	case LatchWaitCommand:
+		if _, found := node.getLatch(cmd.Name); !found {
+			return fmt.Errorf("latch %s does not exist", cmd.Name)
+		}
+	}
+	return nil
+}
+
+func (node *Node) applyBarrierArrive(cmd BarrierArriveCommand) {
+	barrier, found := node.getBarrier(cmd.Name)
+	if !found || len(barrier.Arrived) == 0 {
+		barrier.Name = cmd.Name
+		barrier.Parties = cmd.Parties
+	}
+	barrier.Arrived = addCoordinationWaiter(barrier.Arrived, cmd.Waiter)
+	fmt.Printf("Client %s arrived at barrier %s (%d/%d)\n", cmd.Waiter.ClientID, cmd.Name, len(barrier.Arrived), barrier.Parties)
+	if len(barrier.Arrived) < barrier.Parties {
+		node.setData(barrierKey(cmd.Name), barrier)
+		return
+	}
+	released := barrier.Arrived
+	barrier.Arrived = nil
+	barrier.Generation++
+	node.setData(barrierKey(cmd.Name), barrier)
+	fmt.Printf("Barrier %s tripped, generation %d\n", cmd.Name, barrier.Generation)
+	if node.isLeader() {
+		for _, waiter := range released {
+			node.server.sendToClient(waiter.ClientID, waiter.RequestID, MessageBarrier, BarrierReply{
+				Success:    true,
+				Name:       cmd.Name,
+				Generation: barrier.Generation,
+			})
+		}
+	}
+}
+
+func (node *Node) applyLatchCreate(cmd LatchCreateCommand) {
+	node.setData(latchKey(cmd.Name), Latch{Name: cmd.Name, Count: cmd.Count})
+	fmt.Printf("Latch %s created with count %d\n", cmd.Name, cmd.Count)
+}
+
+func (node *Node) applyLatchCountDown(cmd LatchCountDownCommand) {
+	latch, found := node.getLatch(cmd.Name)
+	if !found || latch.Count == 0 {
+		return
+	}
+	latch.Count--
+	released := latch.Waiters
+	if latch.Count == 0 {
+		latch.Waiters = nil
+		fmt.Printf("Latch %s opened\n", cmd.Name)
+	}
+	node.setData(latchKey(cmd.Name), latch)
+	if latch.Count == 0 && node.isLeader() {
+		for _, waiter := range released {
+			node.notifyLatchOpen(waiter, cmd.Name)
+		}
+	}
+}
+
+func (node *Node) applyLatchWait(cmd LatchWaitCommand) {
+	latch, found := node.getLatch(cmd.Name)
+	if !found {
+		return
+	}
+	if latch.Count == 0 {
+		if node.isLeader() {
+			node.notifyLatchOpen(cmd.Waiter, cmd.Name)
+		}
+		return
+	}
+	latch.Waiters = addCoordinationWaiter(latch.Waiters, cmd.Waiter)
+	node.setData(latchKey(cmd.Name), latch)
+}
+
+func (node *Node) notifyLatchOpen(waiter CoordinationWaiter, name string) {
+	node.server.sendToClient(waiter.ClientID, waiter.RequestID, MessageLatch, LatchReply{
+		Success: true,
+		Name:    name,
+	})
+}
+
+// dropCoordinationWaiters forgets every barrier arrival and latch waiter of
+// an expired session, so a barrier is not tripped by a client that is gone.
+func (node *Node) dropCoordinationWaiters(sessionID string) {
+	keep := func(waiters []CoordinationWaiter) []CoordinationWaiter {
+		remaining := waiters[:0]
+		for _, waiter := range waiters {
+			if waiter.SessionID != sessionID {
+				remaining = append(remaining, waiter)
+			}
+		}
+		return remaining
+	}
+	for _, key := range node.db.Keys() {
+		switch {
+		case strings.HasPrefix(key, BARRIER_KEY_PREFIX):
+			var barrier Barrier
+			if found, _ := node.readFromStorage(key, &barrier); found {
+				if arrived := keep(barrier.Arrived); len(arrived) != len(barrier.Arrived) {
+					barrier.Arrived = arrived
+					node.setData(key, barrier)
+				}
+			}
+		case strings.HasPrefix(key, LATCH_KEY_PREFIX):
+			var latch Latch
+			if found, _ := node.readFromStorage(key, &latch); found {
+				if waiters := keep(latch.Waiters); len(waiters) != len(latch.Waiters) {
+					latch.Waiters = waiters
+					node.setData(key, latch)
+				}
+			}
+		}
+	}
+}
+
+func (node *Node) isLeader() bool {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	return node.state == Leader
+}
+
+// handleCoordinationRequest turns a barrier or latch message into a log
+// command. Arrivals and waits are answered once the barrier trips or the
+// latch opens; everything else is answered right away.
+func (server *Server) handleCoordinationRequest(clientID string, sessionID string, env Envelope, req CoordinationRequest) {
+	waiter := CoordinationWaiter{ClientID: clientID, SessionID: sessionID, RequestID: env.RequestID}
+	var cmd interface{}
+	deferred := false
+	switch {
+	case env.Type == MessageBarrier && req.Op == CoordinationArrive:
+		cmd = BarrierArriveCommand{Name: req.Name, Parties: req.Parties, Waiter: waiter}
+		deferred = true
+	case env.Type == MessageLatch && req.Op == CoordinationCreate:
+		cmd = LatchCreateCommand{Name: req.Name, Count: req.Count}
+	case env.Type == MessageLatch && req.Op == CoordinationCountDown:
+		cmd = LatchCountDownCommand{Name: req.Name, ClientID: clientID}
+	case env.Type == MessageLatch && req.Op == CoordinationWait:
+		cmd = LatchWaitCommand{Name: req.Name, Waiter: waiter}
+		deferred = true
+	default:
+		server.sendToClient(clientID, env.RequestID, MessageError, ErrorReply{
+			Message: fmt.Sprintf("unknown %s operation %q", env.Type, req.Op),
+		})
+		return
+	}
+	if req.Name == "" {
+		server.sendToClient(clientID, env.RequestID, MessageError, ErrorReply{Message: "name not passed"})
+		return
+	}
+
+	success, _, err := server.SubmitToServer(cmd)
+	if err == nil && !success {
+		err = errors.New("command could not be submitted, try different server(leader)")
+	}
+	if err == nil && deferred {
+		return
+	}
+	if env.Type == MessageBarrier {
+		reply := BarrierReply{Success: err == nil, Name: req.Name}
+		if err != nil {
+			reply.Error = err.Error()
+		}
+		server.sendToClient(clientID, env.RequestID, MessageBarrier, reply)
+		return
+	}
+	reply := LatchReply{Success: err == nil, Name: req.Name}
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	server.sendToClient(clientID, env.RequestID, MessageLatch, reply)
+}
@@ -0,0 +1,58 @@
+package raft
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Counters are ordinary user keys holding a decimal integer, so they can be
+// read, watched and given a TTL like any other key. Increment reads and
+// writes them in the state machine, which makes the read-modify-write atomic.
+
+func validateIncrement(cmd Increment) error {
+	if err := validateKV(cmd.Key, nil); err != nil {
+		return err
+	}
+	if cmd.Bounded && cmd.Min > cmd.Max {
+		return fmt.Errorf("invalid bounds [%d, %d]", cmd.Min, cmd.Max)
+	}
+	return nil
+}
+
+func parseCounter(value []byte) (int64, error) {
+	counter, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("value %q is not an integer", value)
+	}
+	return counter, nil
+}
+
+// applyIncrement keeps the counter's expiry time, so a counter created with
+// a TTL still expires when it was meant to.
+func (node *Node) applyIncrement(cmd Increment) IncrementResult {
+	previous, found := node.readKV(cmd.Key)
+	result := IncrementResult{Key: cmd.Key, Version: previous.Version}
+	if found {
+		counter, err := parseCounter(previous.Value)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		result.Value = counter
+	}
+	if (cmd.Delta > 0 && result.Value > math.MaxInt64-cmd.Delta) ||
+		(cmd.Delta < 0 && result.Value < math.MinInt64-cmd.Delta) {
+		result.Error = fmt.Sprintf("incrementing %d by %d overflows", result.Value, cmd.Delta)
+		return result
+	}
+	next := result.Value + cmd.Delta
+	if cmd.Bounded && (next < cmd.Min || next > cmd.Max) {
+		return result
+	}
+	ttl := previous.ttl(node.entryTime())
+	result.Version = node.putKV(cmd.Key, []byte(strconv.FormatInt(next, 10)), ttl, previous)
+	result.Value = next
+	result.Success = true
+	return result
+}
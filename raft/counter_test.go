@@ -0,0 +1,70 @@
+package raft
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"testing"
+)
+
+// Every case increments a counter of its own, seeded with start unless it
+// is empty. A refused increment reports the counter's current value and
+// leaves it alone; one that fails outright returns an error.
+func TestIncrementBoundsAndOverflow(t *testing.T) {
+	leader := startCluster(t, 3)[0]
+	type bounds struct{ low, high int64 }
+	maxInt, minInt := strconv.FormatInt(math.MaxInt64, 10), strconv.FormatInt(math.MinInt64, 10)
+	cases := []struct {
+		name    string
+		start   string
+		delta   int64
+		within  *bounds
+		success bool
+		failed  bool
+		value   int64
+	}{
+		{"absent counter starts at zero", "", 5, nil, true, false, 5},
+		{"negative result", "2", -7, nil, true, false, -5},
+		{"within bounds", "-2", 3, &bounds{-10, 1}, true, false, 1},
+		{"onto the upper bound", "1", 1, &bounds{0, 2}, true, false, 2},
+		{"onto the lower bound", "3", -3, &bounds{0, 5}, true, false, 0},
+		{"past the upper bound", "2", 1, &bounds{0, 2}, false, false, 2},
+		{"past the lower bound", "2", -3, &bounds{0, 2}, false, false, 2},
+		{"absent counter outside bounds", "", 1, &bounds{5, 10}, false, false, 0},
+		{"up to the largest value", "1", math.MaxInt64 - 1, nil, true, false, math.MaxInt64},
+		{"overflow", maxInt, 1, nil, false, true, math.MaxInt64},
+		{"overflow despite bounds", maxInt, 1, &bounds{math.MinInt64, math.MaxInt64}, false, true, math.MaxInt64},
+		{"down to the smallest value", "-1", math.MinInt64 + 1, nil, true, false, math.MinInt64},
+		{"underflow", minInt, -1, nil, false, true, math.MinInt64},
+		{"largest plus smallest", maxInt, math.MinInt64, nil, true, false, -1},
+		{"not an integer", "ten", 1, nil, false, true, 0},
+	}
+	for i, c := range cases {
+		key := fmt.Sprintf("counter/%d", i)
+		if c.start != "" {
+			if _, err := PutDataIfAbsent(leader, key, []byte(c.start)); err != nil {
+				t.Fatalf("%s: seeding the counter: %v", c.name, err)
+			}
+		}
+		var result IncrementResult
+		var err error
+		if c.within != nil {
+			result, err = IncrementDataWithin(leader, key, c.delta, c.within.low, c.within.high)
+		} else {
+			result, err = IncrementData(leader, key, c.delta)
+		}
+		if (err != nil) != c.failed || result.Success != c.success || result.Value != c.value {
+			t.Errorf("%s: got success %v, value %d, error %v; want %v, %d, an error: %v",
+				c.name, result.Success, result.Value, err, c.success, c.value, c.failed)
+		}
+		reply, _ := GetVersionedData(leader, key)
+		if stored := string(reply.Value); c.success && stored != strconv.FormatInt(c.value, 10) {
+			t.Errorf("%s: the counter holds %q after the increment, want %d", c.name, stored, c.value)
+		} else if !c.success && stored != c.start {
+			t.Errorf("%s: the counter holds %q after a refused increment, want %q", c.name, stored, c.start)
+		}
+	}
+	if _, err := IncrementDataWithin(leader, "counter/inverted", 1, 2, 0); err == nil {
+		t.Error("an increment with inverted bounds was submitted")
+	}
+}
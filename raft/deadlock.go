@@ -0,0 +1,115 @@
+package raft
+
+import (
+	"fmt"
+)
+
+// waitForEdge says that a queued request of one client is waiting on a lock
+// held by another client.
+type waitForEdge struct {
+	holder string
+	req    LockRequest
+}
+
+// waitForGraph maps each waiting client to the holders it is waiting on. A
+// client waiting on a lock it holds itself is left out: another of its own
+// goroutines may still release it.
+// expects node.mu to be held
+func (node *Node) waitForGraph() map[string][]waitForEdge {
+	graph := make(map[string][]waitForEdge)
+	holders := node.getAllLockKeyValues()
+	for key, queuePtr := range node.pendingLockQueue {
+		lockInfo, held := holders[key]
+		if !held {
+			continue
+		}
+		for _, req := range *queuePtr {
+			if req.ClientID == lockInfo.Holder {
+				continue
+			}
+			graph[req.ClientID] = append(graph[req.ClientID], waitForEdge{holder: lockInfo.Holder, req: req})
+		}
+	}
+	return graph
+}
+
+// findWaitForCycle returns the requests along one cycle in graph, or nil if
+// the graph has none.
+func findWaitForCycle(graph map[string][]waitForEdge) []LockRequest {
+	const (
+		unvisited = iota
+		onPath
+		done
+	)
+	state := make(map[string]int, len(graph))
+	var path []waitForEdge
+	var cycle []LockRequest
+
+	var visit func(client string) bool
+	visit = func(client string) bool {
+		state[client] = onPath
+		for _, edge := range graph[client] {
+			switch state[edge.holder] {
+			case onPath:
+				// walk back along the path to where the cycle starts
+				cycle = append(cycle, edge.req)
+				for i := len(path) - 1; i >= 0 && path[i].holder != edge.holder; i-- {
+					cycle = append(cycle, path[i].req)
+				}
+				return true
+			case unvisited:
+				path = append(path, edge)
+				if visit(edge.holder) {
+					return true
+				}
+				path = path[:len(path)-1]
+			}
+		}
+		state[client] = done
+		return false
+	}
+
+	for client := range graph {
+		if state[client] == unvisited && visit(client) {
+			return cycle
+		}
+	}
+	return nil
+}
+
+// breakDeadlocks aborts waiting requests until the wait-for graph is free of
+// cycles. From each cycle the most recently queued request is the victim; it
+// is dropped from every queue and its client gets a DEADLOCK reply.
+func (node *Node) breakDeadlocks() {
+	node.mu.Lock()
+	if node.state != Leader {
+		node.mu.Unlock()
+		return
+	}
+	var victims []LockRequest
+	for {
+		cycle := findWaitForCycle(node.waitForGraph())
+		if cycle == nil {
+			break
+		}
+		victim := cycle[0]
+		for _, req := range cycle[1:] {
+			if req.arrival > victim.arrival {
+				victim = req
+			}
+		}
+		fmt.Printf("Deadlock detected between %d waiting requests, aborting request %s of client %s\n", len(cycle), victim.RequestID, victim.ClientID)
+		for _, key := range requestedLockKeys(victim) {
+			node.removePendingLockRequest(key, func(queued LockRequest) bool {
+				return queued.arrival == victim.arrival
+			})
+			node.pingLockQueue(key)
+		}
+		victims = append(victims, victim)
+	}
+	node.mu.Unlock()
+
+	for _, victim := range victims {
+		node.server.NotifyLockFailure(victim, LockReasonDeadlock)
+	}
+}
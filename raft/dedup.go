@@ -0,0 +1,219 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A client numbers its requests and keeps the number when it resends one, so
+// a request forwarded or retried after a timeout reaches the log more than
+// once but is applied once. The replicated dedup table remembers, per
+// client, the results of applied requests until the client acknowledges
+// them; a resend is answered from there.
+
+// A Submitter submits commands to the cluster, as Server.SubmitToServer does.
+type Submitter interface {
+	SubmitToServer(cmd interface{}) (bool, interface{}, error)
+}
+
+// clientSubmitter submits the commands of one client request, tagging those
+// that change the store with the request's sequence number.
+type clientSubmitter struct {
+	server   *Server
+	clientID string
+	seq      uint64
+	ackedSeq uint64
+}
+
+func (server *Server) clientSubmitter(clientID string, env Envelope) clientSubmitter {
+	return clientSubmitter{server: server, clientID: clientID, seq: env.Seq, ackedSeq: env.AckedSeq}
+}
+
+func (submitter clientSubmitter) SubmitToServer(cmd interface{}) (bool, interface{}, error) {
+	if submitter.seq == 0 {
+		return submitter.server.SubmitToServer(cmd)
+	}
+	switch cmd.(type) {
+	case Write, Delete, CompareAndSwap, PutIfAbsent, Increment, BatchWrite, Txn:
+		return submitter.server.SubmitToServer(ClientCommand{
+			ClientID: submitter.clientID,
+			Seq:      submitter.seq,
+			AckedSeq: submitter.ackedSeq,
+			Command:  cmd,
+		})
+	}
+	return submitter.server.SubmitToServer(cmd)
+}
+
+func clientRequestsKey(clientID string) string {
+	return fmt.Sprintf("%s%s", CLIENT_REQUESTS_PREFIX, clientID)
+}
+
+// clientResultsPrefix is the prefix of the keys of a client's results, which
+// sort by sequence number.
+func clientResultsPrefix(clientID string) string {
+	return fmt.Sprintf("%s%s\x00", CLIENT_RESULT_PREFIX, clientID)
+}
+
+func clientResultKey(clientID string, seq uint64) string {
+	return fmt.Sprintf("%s%020d", clientResultsPrefix(clientID), seq)
+}
+
+func (node *Node) clientRequests(clientID string) ClientRequests {
+	var requests ClientRequests
+	node.readFromStorage(clientRequestsKey(clientID), &requests)
+	return requests
+}
+
+// duplicateResult reports whether the client's request seq has already been
+// applied, and if so its result. It fails if the result has been dropped
+// because the client acknowledged it.
+func (node *Node) duplicateResult(clientID string, seq uint64) (interface{}, bool, error) {
+	if seq == 0 {
+		return nil, false, nil
+	}
+	var stored ClientResult
+	if found, _ := node.readFromStorage(clientResultKey(clientID, seq), &stored); found {
+		return stored.Result, true, nil
+	}
+	if seq <= node.clientRequests(clientID).AckedSeq {
+		return nil, true, fmt.Errorf("request %d of client %s was already answered", seq, clientID)
+	}
+	return nil, false, nil
+}
+
+// admitClientRequest refuses a new request from a client that would still
+// have MAX_CLIENT_RESULTS results it has not acknowledged once the
+// acknowledgement carried by the request itself is taken into account.
+// Results are only dropped once the client acknowledges them, as one dropped
+// early would let a resend of its request be applied a second time.
+func (node *Node) admitClientRequest(clientID string, seq uint64, ackedSeq uint64) error {
+	if seq == 0 {
+		return nil
+	}
+	prefix := clientResultsPrefix(clientID)
+	unacknowledged := node.db.CountRange(clientResultKey(clientID, ackedSeq+1), prefixEnd(prefix))
+	if unacknowledged >= MAX_CLIENT_RESULTS {
+		return fmt.Errorf("client %s has %d unacknowledged requests, acknowledge their results before sending more", clientID, unacknowledged)
+	}
+	return nil
+}
+
+// recordClientResult keeps the result of the client's request seq and drops
+// the results the client has acknowledged since.
+func (node *Node) recordClientResult(clientID string, seq uint64, ackedSeq uint64, result interface{}) {
+	if seq == 0 {
+		return
+	}
+	requests := node.clientRequests(clientID)
+	if ackedSeq > requests.AckedSeq {
+		requests.AckedSeq = ackedSeq
+	}
+	if seq > requests.LastSeq {
+		requests.LastSeq = seq
+	}
+	node.setData(clientResultKey(clientID, seq), ClientResult{Result: result})
+	node.db.DeleteRange(clientResultsPrefix(clientID), clientResultKey(clientID, requests.AckedSeq+1))
+	node.setData(clientRequestsKey(clientID), requests)
+}
+
+func validateClientCommand(cmd ClientCommand) error {
+	if cmd.ClientID == "" {
+		return errors.New("client id not passed")
+	}
+	switch command := cmd.Command.(type) {
+	case Write:
+		return validateWrite(command)
+	case Delete:
+		return validateKV(command.Key, nil)
+	case CompareAndSwap:
+		return validateKV(command.Key, command.Value)
+	case PutIfAbsent:
+		return validateKV(command.Key, command.Value)
+	case Increment:
+		return validateIncrement(command)
+	case BatchWrite:
+		return validateBatchWrite(command)
+	case Txn:
+		return validateTxn(command)
+	default:
+		return fmt.Errorf("%T commands are not deduplicated", cmd.Command)
+	}
+}
+
+// applyClientCommand applies the command unless its sequence number has been
+// applied already, and returns the result either way.
+func (node *Node) applyClientCommand(cmd ClientCommand) interface{} {
+	if result, duplicate, _ := node.duplicateResult(cmd.ClientID, cmd.Seq); duplicate {
+		fmt.Printf("Request %d of client %s was already applied\n", cmd.Seq, cmd.ClientID)
+		return result
+	}
+	if err := node.admitClientRequest(cmd.ClientID, cmd.Seq, cmd.AckedSeq); err != nil {
+		// refused on every replica alike; the proposer gets the error back
+		return err
+	}
+	var result interface{}
+	switch command := cmd.Command.(type) {
+	case Write:
+		node.applyWrite(command)
+	case Delete:
+		result = node.applyDelete(command)
+	case CompareAndSwap:
+		result = node.applyCompareAndSwap(command)
+	case PutIfAbsent:
+		result = node.applyPutIfAbsent(command)
+	case Increment:
+		result = node.applyIncrement(command)
+	case BatchWrite:
+		result = node.applyBatchWrite(command)
+	case Txn:
+		result = node.applyTxn(command)
+	}
+	node.recordClientResult(cmd.ClientID, cmd.Seq, cmd.AckedSeq, result)
+	return result
+}
+
+// answerDuplicateAcquire answers a resent acquire that was already granted
+// with the fencing tokens it was granted with, and reports whether it did. A
+// resend of a request the client has acknowledged is stale, and a new request
+// from a client whose dedup table is full is refused; both are answered with
+// an error rather than granted.
+func (node *Node) answerDuplicateAcquire(clientID string, requestID string, seq uint64, ackedSeq uint64) bool {
+	result, duplicate, err := node.duplicateResult(clientID, seq)
+	if !duplicate {
+		err = node.admitClientRequest(clientID, seq, ackedSeq)
+	}
+	if err != nil {
+		fmt.Printf("Acquire %d of client %s is refused: %v\n", seq, clientID, err)
+		if node.isLeader() {
+			node.server.sendToClient(clientID, requestID, MessageError, ErrorReply{Message: err.Error()})
+		}
+		return true
+	}
+	granted, ok := result.(LockAcquireResult)
+	if !duplicate || !ok {
+		return false
+	}
+	fmt.Printf("Acquire %d of client %s was already granted\n", seq, clientID)
+	if node.isLeader() {
+		if len(granted.Keys) > 0 {
+			node.server.NotifyMultiLockAcquire(clientID, requestID, granted.Keys, granted.FencingTokens)
+		} else {
+			node.server.NotifyLockAcquire(clientID, requestID, granted.Key, granted.FencingToken)
+		}
+	}
+	return true
+}
+
+// dropClientRequests forgets the dedup table entry of a client whose last
+// session has expired.
+func (node *Node) dropClientRequests(clientID string) {
+	for _, session := range node.getAllSessions() {
+		if session.ClientID == clientID {
+			return
+		}
+	}
+	node.db.Delete(clientRequestsKey(clientID))
+	prefix := clientResultsPrefix(clientID)
+	node.db.DeleteRange(prefix, prefixEnd(prefix))
+}
@@ -0,0 +1,68 @@
+package raft
+
+import (
+	"fmt"
+	"testing"
+)
+
+// A resent request is answered with the result of its first apply rather
+// than applied again, until the client acknowledges it; a client that stops
+// acknowledging is refused new requests rather than losing results.
+func TestResentRequestsApplyOnce(t *testing.T) {
+	leader := startCluster(t, 3)[0]
+	increment := func(clientID string, seq uint64, ackedSeq uint64) (int64, error) {
+		cmd := ClientCommand{ClientID: clientID, Seq: seq, AckedSeq: ackedSeq, Command: Increment{Key: "resent", Delta: 1}}
+		success, reply, err := leader.SubmitToServer(cmd)
+		if err != nil {
+			return 0, err
+		}
+		result, ok := reply.(IncrementResult)
+		if !success || !ok {
+			return 0, fmt.Errorf("unexpected reply %v, %T", success, reply)
+		}
+		return result.Value, nil
+	}
+	steps := []struct {
+		name     string
+		seq      uint64
+		ackedSeq uint64
+		value    int64 // the counter the request answers with, -1 for an error
+	}{
+		{"first request", 1, 0, 1},
+		{"its resend", 1, 0, 1},
+		{"second request", 2, 0, 2},
+		{"first request resent late", 1, 0, 1},
+		{"second request resent", 2, 0, 2},
+		{"third request acknowledging the first", 3, 1, 3},
+		{"acknowledged request resent", 1, 0, -1},
+		{"unacknowledged request resent", 2, 1, 2},
+		{"third request resent", 3, 1, 3},
+	}
+	for _, step := range steps {
+		value, err := increment("client", step.seq, step.ackedSeq)
+		if err != nil {
+			value = -1
+		}
+		if value != step.value {
+			t.Errorf("%s (seq %d): answered %d (%v), want %d", step.name, step.seq, value, err, step.value)
+		}
+	}
+	if reply, err := GetVersionedData(leader, "resent"); err != nil || string(reply.Value) != "3" {
+		t.Errorf("the counter is %q (%v) after three distinct requests, want %q", reply.Value, err, "3")
+	}
+
+	for seq := uint64(1); seq <= uint64(MAX_CLIENT_RESULTS); seq++ {
+		if _, err := increment("silent", seq, 0); err != nil {
+			t.Fatalf("request %d of a client with room for its results: %v", seq, err)
+		}
+	}
+	if _, err := increment("silent", uint64(MAX_CLIENT_RESULTS)+1, 0); err == nil {
+		t.Error("a client with a full dedup table had a new request applied")
+	}
+	if value, err := increment("silent", 1, 0); err != nil || value != 4 {
+		t.Errorf("resending the first request of a full table answered %d (%v), want 4", value, err)
+	}
+	if value, err := increment("silent", uint64(MAX_CLIENT_RESULTS)+1, 1); err != nil || value != int64(MAX_CLIENT_RESULTS)+4 {
+		t.Errorf("a new request acknowledging one result answered %d (%v), want %d", value, err, MAX_CLIENT_RESULTS+4)
+	}
+}
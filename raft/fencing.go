@@ -0,0 +1,116 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// fencingTokenStatus reports the latest fencing token handed out for a lock
+// key together with the current holder of that lock, if any.
+func (node *Node) fencingTokenStatus(key string) (FencingTokenStatus, error) {
+	key = strings.TrimPrefix(key, FENCING_TOKEN_PREFIX)
+	status := FencingTokenStatus{Key: key}
+
+	var token uint64
+	fencingTokenKey := fmt.Sprintf("%s%s", FENCING_TOKEN_PREFIX, key)
+	found, readErr := node.readFromStorage(fencingTokenKey, &token)
+	if readErr != nil {
+		return status, readErr
+	}
+	status.Issued = found
+	status.Token = token
+
+	var lockInfo LockInfo
+	lockKey := fmt.Sprintf("%s%s", LOCKING_KEY_PREFIX, key)
+	found, readErr = node.readFromStorage(lockKey, &lockInfo)
+	if readErr != nil {
+		return status, readErr
+	}
+	status.Held = found
+	status.Holder = lockInfo.Holder
+	return status, nil
+}
+
+// A fencing token is valid only while it is the latest token issued for the
+// key and the lock it was issued with is still held.
+func validateFencingToken(status FencingTokenStatus, token uint64) FencingTokenValidation {
+	return FencingTokenValidation{
+		Key:    status.Key,
+		Token:  token,
+		Latest: status.Token,
+		Held:   status.Held,
+		Valid:  status.Issued && status.Held && status.Token == token,
+	}
+}
+
+func (server *Server) GetFencingToken(key string) (FencingTokenStatus, error) {
+	success, reply, err := server.SubmitToServer(FencingTokenQuery{Key: key})
+	if err != nil {
+		return FencingTokenStatus{}, err
+	}
+	if !success {
+		return FencingTokenStatus{}, errors.New("fencing token query could not be served, try different server(leader)")
+	}
+	status, ok := reply.(FencingTokenStatus)
+	if !ok {
+		return FencingTokenStatus{}, fmt.Errorf("unexpected reply for fencing token query: %T", reply)
+	}
+	return status, nil
+}
+
+func (server *Server) ValidateFencingToken(key string, token uint64) (FencingTokenValidation, error) {
+	status, err := server.GetFencingToken(key)
+	if err != nil {
+		return FencingTokenValidation{}, err
+	}
+	return validateFencingToken(status, token), nil
+}
+
+// FencingHandler serves GET /fencing?key=<lockKey>
+func (server *Server) FencingHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "lock key not passed", http.StatusBadRequest)
+		return
+	}
+	status, err := server.GetFencingToken(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, status)
+}
+
+// FencingValidateHandler serves GET /fencing/validate?key=<lockKey>&token=<value>
+func (server *Server) FencingValidateHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "lock key not passed", http.StatusBadRequest)
+		return
+	}
+	token, err := strconv.ParseUint(r.URL.Query().Get("token"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid fencing token", http.StatusBadRequest)
+		return
+	}
+	validation, err := server.ValidateFencingToken(key, token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, validation)
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,392 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A kvResultWaiter is a leader-side caller blocked until the conditional
+// command it proposed at some log index has been applied.
+type kvResultWaiter struct {
+	term uint64
+	ch   chan interface{}
+}
+
+// User keys live under their own prefix so they cannot clobber locks,
+// sessions or raft state.
+func kvKey(key string) string {
+	return fmt.Sprintf("%s%s", KV_KEY_PREFIX, key)
+}
+
+func validateKV(key string, value []byte) error {
+	if key == "" {
+		return errors.New("key not passed")
+	}
+	if strings.IndexByte(key, 0) >= 0 {
+		return errors.New("key must not contain NUL bytes")
+	}
+	if len(key) > MAX_KV_KEY_SIZE {
+		return fmt.Errorf("key of %d bytes exceeds the limit of %d bytes", len(key), MAX_KV_KEY_SIZE)
+	}
+	if len(value) > MAX_KV_VALUE_SIZE {
+		return fmt.Errorf("value of %d bytes exceeds the limit of %d bytes", len(value), MAX_KV_VALUE_SIZE)
+	}
+	return nil
+}
+
+func validateWrite(cmd Write) error {
+	if cmd.TTL < 0 {
+		return fmt.Errorf("invalid TTL %v", cmd.TTL)
+	}
+	return validateKV(cmd.Key, cmd.Value)
+}
+
+func (entry KVEntry) expired(now time.Time) bool {
+	return !entry.ExpiryTime.IsZero() && !now.Before(entry.ExpiryTime)
+}
+
+// ttl is the time left before the entry expires, or 0 if it never does.
+func (entry KVEntry) ttl(now time.Time) time.Duration {
+	if entry.ExpiryTime.IsZero() {
+		return 0
+	}
+	return entry.ExpiryTime.Sub(now)
+}
+
+// readKVAt returns the entry under key unless it had expired by now.
+func (node *Node) readKVAt(key string, now time.Time) (KVEntry, bool) {
+	var entry KVEntry
+	if found, _ := node.readFromStorage(kvKey(key), &entry); !found || entry.expired(now) {
+		return KVEntry{}, false
+	}
+	return entry, true
+}
+
+// readKV reads key as of the entry being applied, so every replica sees the
+// same keys as expired.
+func (node *Node) readKV(key string) (KVEntry, bool) {
+	return node.readKVAt(key, node.entryTime())
+}
+
+// readKVReply serves a Read at its revision, or the latest value if it has
+// none. Reads at a past revision do not report a TTL.
+func (node *Node) readKVReply(cmd Read) (ReadReply, error) {
+	now := time.Now()
+	revision := cmd.Revision
+	var entry KVEntry
+	var found bool
+	if revision > 0 {
+		if err := node.checkRevision(revision); err != nil {
+			return ReadReply{}, err
+		}
+		entry, found = node.readKVAtRevision(cmd.Key, revision)
+		entry.ExpiryTime = time.Time{}
+	} else {
+		revision = node.currentRevision()
+		entry, found = node.readKVAt(cmd.Key, now)
+	}
+	return ReadReply{
+		Key:            cmd.Key,
+		Value:          entry.Value,
+		Version:        entry.Version,
+		CreateRevision: entry.CreateRevision,
+		ModRevision:    entry.ModRevision,
+		TTL:            entry.ttl(now),
+		Found:          found,
+		Revision:       revision,
+	}, nil
+}
+
+func (node *Node) putKV(key string, value []byte, ttl time.Duration, previous KVEntry) uint64 {
+	entry := KVEntry{
+		Value:          value,
+		Version:        previous.Version + 1,
+		CreateRevision: previous.CreateRevision,
+		ModRevision:    node.applying.Index,
+	}
+	if entry.CreateRevision == 0 {
+		entry.CreateRevision = node.applying.Index
+	}
+	if ttl > 0 {
+		entry.ExpiryTime = node.entryTime().Add(ttl)
+	}
+	node.setData(kvKey(key), entry)
+	node.recordKVHistory(key, entry)
+	if ttl > 0 {
+		node.scheduleKVExpiry(key, entry.ExpiryTime)
+	}
+	node.recordKVEvent(WatchEvent{Type: WatchEventPut, Key: key, Value: value, Version: entry.Version})
+	return entry.Version
+}
+
+func (node *Node) deleteKV(key string) {
+	node.db.Delete(kvKey(key))
+	node.recordKVHistory(key, KVEntry{ModRevision: node.applying.Index, Tombstone: true})
+	node.recordKVEvent(WatchEvent{Type: WatchEventDelete, Key: key})
+}
+
+func (node *Node) applyWrite(cmd Write) {
+	previous, _ := node.readKV(cmd.Key)
+	node.putKV(cmd.Key, cmd.Value, cmd.TTL, previous)
+}
+
+func (node *Node) applyDelete(cmd Delete) KVResult {
+	previous, found := node.readKV(cmd.Key)
+	result := KVResult{Key: cmd.Key, Existed: found, Previous: previous.Value, PreviousVersion: previous.Version}
+	if found {
+		node.deleteKV(cmd.Key)
+		result.Success = true
+	}
+	return result
+}
+
+func (node *Node) applyCompareAndSwap(cmd CompareAndSwap) KVResult {
+	previous, found := node.readKV(cmd.Key)
+	result := KVResult{Key: cmd.Key, Existed: found, Previous: previous.Value, PreviousVersion: previous.Version}
+	var matched bool
+	if cmd.CompareVersion {
+		matched = previous.Version == cmd.ExpectedVersion
+	} else {
+		matched = found && bytes.Equal(previous.Value, cmd.Expected)
+	}
+	if matched {
+		// a swap keeps the key's remaining time to live, as Increment does
+		ttl := previous.ttl(node.entryTime())
+		result.Version = node.putKV(cmd.Key, cmd.Value, ttl, previous)
+		result.Success = true
+	}
+	return result
+}
+
+// applyPutIfAbsent only writes keys that are absent or have expired, so there
+// is no time to live to carry over and the new key never expires.
+func (node *Node) applyPutIfAbsent(cmd PutIfAbsent) KVResult {
+	previous, found := node.readKV(cmd.Key)
+	result := KVResult{Key: cmd.Key, Existed: found, Previous: previous.Value, PreviousVersion: previous.Version}
+	if !found {
+		result.Version = node.putKV(cmd.Key, cmd.Value, 0, previous)
+		result.Success = true
+	}
+	return result
+}
+
+func kvPair(key string, entry KVEntry, now time.Time) KVPair {
+	return KVPair{
+		Key:            key,
+		Value:          entry.Value,
+		Version:        entry.Version,
+		CreateRevision: entry.CreateRevision,
+		ModRevision:    entry.ModRevision,
+		TTL:            entry.ttl(now),
+	}
+}
+
+// rangeKV reads one page of user keys for a RangeQuery. The page token is
+// the key the next page starts at.
+func (node *Node) rangeKV(query RangeQuery) (RangeReply, error) {
+	start := query.Start
+	if query.PageToken != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(query.PageToken)
+		if err != nil || string(decoded) < query.Start {
+			return RangeReply{}, errors.New("invalid page token")
+		}
+		start = string(decoded)
+	}
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DEFAULT_RANGE_LIMIT
+	} else if limit > MAX_RANGE_LIMIT {
+		limit = MAX_RANGE_LIMIT
+	}
+	if query.Revision > 0 {
+		if err := node.checkRevision(query.Revision); err != nil {
+			return RangeReply{}, err
+		}
+		return node.rangeKVAtRevision(start, query.End, limit, query.Revision), nil
+	}
+	end := prefixEnd(KV_KEY_PREFIX)
+	if query.End != "" {
+		end = kvKey(query.End)
+	}
+
+	// expired keys stay in storage until ExpireKeys is applied, so the scan
+	// keeps reading past them until it has found a live key beyond the page
+	// or the range ends
+	now := time.Now()
+	reply := RangeReply{KVs: []KVPair{}, Revision: node.currentRevision()}
+	cursor := kvKey(start)
+	for {
+		entries := node.db.Range(cursor, end, limit+1)
+		for _, entry := range entries {
+			var kvEntry KVEntry
+			if found, _ := node.readFromStorage(entry.Key, &kvEntry); !found || kvEntry.expired(now) {
+				continue
+			}
+			key := strings.TrimPrefix(entry.Key, KV_KEY_PREFIX)
+			if len(reply.KVs) == limit {
+				reply.NextPageToken = base64.RawURLEncoding.EncodeToString([]byte(key))
+				return reply, nil
+			}
+			reply.KVs = append(reply.KVs, kvPair(key, kvEntry, now))
+		}
+		if len(entries) <= limit {
+			return reply, nil
+		}
+		cursor = entries[len(entries)-1].Key + "\x00"
+	}
+}
+
+// proposeKVCommand appends a conditional KV command or transaction to the
+// leader's log and waits for it to be applied, since its outcome depends on
+// the state it is applied against. node.mu must be held and is released
+// before waiting.
+func (node *Node) proposeKVCommand(command interface{}) (bool, interface{}, error) {
+	index := node.appendEntry(command)
+	waiter := kvResultWaiter{term: node.currentTerm, ch: make(chan interface{}, 1)}
+	node.kvResultWaiters[index] = waiter
+	node.mu.Unlock()
+
+	select {
+	case result, ok := <-waiter.ch:
+		if !ok {
+			return false, nil, errors.New("leadership lost before the command was applied")
+		}
+		if err, refused := result.(error); refused {
+			return false, nil, err
+		}
+		return true, result, nil
+	case <-time.After(KV_APPLY_TIMEOUT):
+		node.mu.Lock()
+		delete(node.kvResultWaiters, index)
+		node.mu.Unlock()
+		return false, nil, errors.New("timed out waiting for the command to be applied")
+	}
+}
+
+// deliverKVResult hands the result of an applied entry to the caller waiting
+// on its index, provided the entry is the one that caller proposed.
+func (node *Node) deliverKVResult(commit CommitEntry, result interface{}) {
+	node.mu.Lock()
+	waiter, exists := node.kvResultWaiters[commit.Index]
+	delete(node.kvResultWaiters, commit.Index)
+	node.mu.Unlock()
+	if !exists {
+		return
+	}
+	if waiter.term == commit.Term {
+		waiter.ch <- result
+	} else {
+		close(waiter.ch)
+	}
+}
+
+// handleKVRequest serves key-value operations sent over the /ws connection.
+func (server *Server) handleKVRequest(clientID string, env Envelope, req KVRequest) {
+	submitter := server.clientSubmitter(clientID, env)
+	reply := KVReply{Key: req.Key}
+	switch req.Op {
+	case KVPut:
+		if err := SetDataWithTTL(submitter, req.Key, req.Value, req.TTL); err != nil {
+			reply.Error = err.Error()
+		} else {
+			reply.Success = true
+		}
+	case KVBatchPut:
+		writes := make([]Write, len(req.KVs))
+		for i, kv := range req.KVs {
+			writes[i] = Write{Key: kv.Key, Value: kv.Value, TTL: kv.TTL}
+		}
+		result, err := SetDataBatch(submitter, writes)
+		if err != nil {
+			reply.Error = err.Error()
+		} else {
+			reply.Success = true
+			reply.Revision = result.Revision
+		}
+	case KVGet:
+		readReply, err := GetDataAtRevision(server, req.Key, req.Revision)
+		if err != nil {
+			reply.Error = err.Error()
+		} else {
+			reply.Success = true
+			reply.Value = readReply.Value
+			reply.Version = readReply.Version
+			reply.CreateRevision = readReply.CreateRevision
+			reply.ModRevision = readReply.ModRevision
+			reply.Revision = readReply.Revision
+			reply.TTL = readReply.TTL
+			reply.Found = readReply.Found
+		}
+	case KVRange, KVPrefix:
+		end := req.End
+		if req.Op == KVPrefix {
+			end = prefixEnd(req.Key)
+		}
+		rangeReply, err := RangeDataAtRevision(server, req.Key, end, req.Limit, req.PageToken, req.Revision)
+		if err != nil {
+			reply.Error = err.Error()
+		} else {
+			reply.Success = true
+			reply.KVs = rangeReply.KVs
+			reply.NextPageToken = rangeReply.NextPageToken
+			reply.Revision = rangeReply.Revision
+		}
+	case KVIncrement:
+		var result IncrementResult
+		var err error
+		if req.Bounded {
+			result, err = IncrementDataWithin(submitter, req.Key, req.Delta, req.Min, req.Max)
+		} else {
+			result, err = IncrementData(submitter, req.Key, req.Delta)
+		}
+		if err != nil {
+			reply.Error = err.Error()
+		} else {
+			reply.Success = result.Success
+			reply.Counter = result.Value
+			reply.Version = result.Version
+		}
+	case KVCompact:
+		result, err := CompactData(server, req.Revision)
+		if err != nil {
+			reply.Error = err.Error()
+		} else {
+			reply.Success = true
+			reply.Revision = result.Revision
+		}
+	case KVDelete, KVCas, KVPutIfAbsent:
+		var result KVResult
+		var err error
+		switch req.Op {
+		case KVDelete:
+			result, err = DeleteData(submitter, req.Key)
+		case KVPutIfAbsent:
+			result, err = PutDataIfAbsent(submitter, req.Key, req.Value)
+		default:
+			if req.CompareVersion {
+				result, err = CompareVersionAndSwapData(submitter, req.Key, req.ExpectedVersion, req.Value)
+			} else {
+				result, err = CompareAndSwapData(submitter, req.Key, req.Expected, req.Value)
+			}
+		}
+		if err != nil {
+			reply.Error = err.Error()
+		} else {
+			reply.Success = result.Success
+			reply.Found = result.Existed
+			reply.Version = result.Version
+			reply.Previous = result.Previous
+			reply.PreviousVersion = result.PreviousVersion
+		}
+	default:
+		server.sendToClient(clientID, env.RequestID, MessageError, ErrorReply{
+			Message: fmt.Sprintf("unknown kv operation %q", req.Op),
+		})
+		return
+	}
+	server.sendToClient(clientID, env.RequestID, MessageKV, reply)
+}
@@ -0,0 +1,90 @@
+package raft
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Each step runs against the key as the steps before it left it, so the
+// table reads as the key's history.
+func TestConditionalWrites(t *testing.T) {
+	leader := startCluster(t, 3)[0]
+	steps := []struct {
+		name     string
+		run      func() (KVResult, error)
+		success  bool
+		version  uint64
+		previous string
+	}{
+		{"swap an absent key", func() (KVResult, error) { return CompareAndSwapData(leader, "k", []byte("a"), []byte("b")) }, false, 0, ""},
+		{"put an absent key", func() (KVResult, error) { return PutDataIfAbsent(leader, "k", []byte("a")) }, true, 1, ""},
+		{"put a present key", func() (KVResult, error) { return PutDataIfAbsent(leader, "k", []byte("b")) }, false, 0, "a"},
+		{"swap a different value", func() (KVResult, error) { return CompareAndSwapData(leader, "k", []byte("x"), []byte("b")) }, false, 0, "a"},
+		{"swap the current value", func() (KVResult, error) { return CompareAndSwapData(leader, "k", []byte("a"), []byte("b")) }, true, 2, "a"},
+		{"swap an old version", func() (KVResult, error) { return CompareVersionAndSwapData(leader, "k", 1, []byte("c")) }, false, 0, "b"},
+		{"swap the current version", func() (KVResult, error) { return CompareVersionAndSwapData(leader, "k", 2, []byte("c")) }, true, 3, "b"},
+		{"delete a present key", func() (KVResult, error) { return DeleteData(leader, "k") }, true, 0, "c"},
+		{"delete an absent key", func() (KVResult, error) { return DeleteData(leader, "k") }, false, 0, ""},
+		{"swap version 0 of an absent key", func() (KVResult, error) { return CompareVersionAndSwapData(leader, "k", 0, []byte("d")) }, true, 1, ""},
+	}
+	for _, step := range steps {
+		result, err := step.run()
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if result.Success != step.success || result.Version != step.version || string(result.Previous) != step.previous {
+			t.Errorf("%s: got success %v, version %d, previous %q; want %v, %d, %q",
+				step.name, result.Success, result.Version, result.Previous, step.success, step.version, step.previous)
+		}
+	}
+	reply, err := GetVersionedData(leader, "k")
+	if err != nil || !reply.Found || string(reply.Value) != "d" || reply.Version != 1 {
+		t.Errorf("reading the key after the steps: got %q at version %d (found %v, err %v), want %q at version 1",
+			reply.Value, reply.Version, reply.Found, err, "d")
+	}
+}
+
+// Expired keys stay in storage until the leader's ExpireKeys entry is
+// applied; a page that runs into them must still point at the live keys
+// after them.
+func TestRangePagesPastExpiredKeys(t *testing.T) {
+	leader := startCluster(t, 3)[0]
+	leader.node.mu.Lock()
+	leader.node.stopKVExpiry() // keep the expired keys in storage
+	leader.node.mu.Unlock()
+	for _, key := range []string{"r/b", "r/c", "r/d"} {
+		if err := SetDataWithTTL(leader, key, []byte("expiring"), 50*time.Millisecond); err != nil {
+			t.Fatalf("writing %s: %v", key, err)
+		}
+	}
+	for _, key := range []string{"r/a", "r/e", "r/f"} {
+		if _, err := PutDataIfAbsent(leader, key, []byte("live")); err != nil {
+			t.Fatalf("writing %s: %v", key, err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	for _, limit := range []int{1, 2, 3} {
+		var keys []string
+		var token string
+		for pages := 0; ; pages++ {
+			if pages > 6 {
+				t.Fatalf("limit %d: still paging after %d pages", limit, pages)
+			}
+			reply, err := PrefixData(leader, "r/", limit, token)
+			if err != nil {
+				t.Fatalf("limit %d: %v", limit, err)
+			}
+			for _, kv := range reply.KVs {
+				keys = append(keys, kv.Key)
+			}
+			if token = reply.NextPageToken; token == "" {
+				break
+			}
+		}
+		if got, want := strings.Join(keys, " "), "r/a r/e r/f"; got != want {
+			t.Errorf("limit %d: paged through %q, want %q", limit, got, want)
+		}
+	}
+}
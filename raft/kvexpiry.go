@@ -0,0 +1,151 @@
+package raft
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// kvExpiryItem is a key in the leader's expiry index. Items are not removed
+// when a key is rewritten or deleted; ExpireKeys skips keys that are no
+// longer expired when it is applied.
+type kvExpiryItem struct {
+	key        string
+	expiryTime time.Time
+}
+
+// kvExpiryHeap orders the leader's expiring keys by expiry time, so a single
+// goroutine can sleep until the next one is due.
+type kvExpiryHeap []kvExpiryItem
+
+func (h kvExpiryHeap) Len() int           { return len(h) }
+func (h kvExpiryHeap) Less(i, j int) bool { return h[i].expiryTime.Before(h[j].expiryTime) }
+func (h kvExpiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *kvExpiryHeap) Push(x interface{}) {
+	*h = append(*h, x.(kvExpiryItem))
+}
+
+func (h *kvExpiryHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// scheduleKVExpiry adds key to the leader's expiry index. It is called while
+// applying writes, so followers ignore it and rebuild the index from the
+// store if they become leader.
+func (node *Node) scheduleKVExpiry(key string, expiryTime time.Time) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if node.state != Leader || node.kvExpiryCancel == nil {
+		return
+	}
+	heap.Push(&node.kvExpiry, kvExpiryItem{key: key, expiryTime: expiryTime})
+	select {
+	case node.kvExpiryWake <- struct{}{}:
+	default:
+	}
+}
+
+// startKVExpiry builds the expiry index from the store and starts the
+// goroutine that expires keys on the leader.
+// expects node.mu to be held
+func (node *Node) startKVExpiry() {
+	node.kvExpiry = node.kvExpiry[:0]
+	for _, entry := range node.db.Range(KV_KEY_PREFIX, prefixEnd(KV_KEY_PREFIX), 0) {
+		var kvEntry KVEntry
+		if found, _ := node.readFromStorage(entry.Key, &kvEntry); found && !kvEntry.ExpiryTime.IsZero() {
+			node.kvExpiry = append(node.kvExpiry, kvExpiryItem{
+				key:        strings.TrimPrefix(entry.Key, KV_KEY_PREFIX),
+				expiryTime: kvEntry.ExpiryTime,
+			})
+		}
+	}
+	heap.Init(&node.kvExpiry)
+	ctx, cancel := context.WithCancel(context.Background())
+	node.kvExpiryCancel = cancel
+	node.kvExpiryWake = make(chan struct{}, 1)
+	go node.runKVExpiry(ctx, node.kvExpiryWake)
+}
+
+// stopKVExpiry is called when the node stops being leader.
+// expects node.mu to be held
+func (node *Node) stopKVExpiry() {
+	if node.kvExpiryCancel != nil {
+		node.kvExpiryCancel()
+		node.kvExpiryCancel = nil
+	}
+	node.kvExpiry = nil
+}
+
+// runKVExpiry sleeps until the earliest key in the index is due, then
+// proposes the deletion of every due key in batches, so replicas delete
+// expired keys at the same point in the log.
+func (node *Node) runKVExpiry(ctx context.Context, wake <-chan struct{}) {
+	for {
+		now := time.Now()
+		var due []kvExpiryItem
+		wait := time.Hour
+		node.mu.Lock()
+		for len(node.kvExpiry) > 0 && len(due) < MAX_KV_EXPIRY_BATCH {
+			next := node.kvExpiry[0]
+			if next.expiryTime.After(now) {
+				wait = next.expiryTime.Sub(now)
+				break
+			}
+			heap.Pop(&node.kvExpiry)
+			// skip keys rewritten or deleted since they were scheduled
+			var entry KVEntry
+			if found, _ := node.readFromStorage(kvKey(next.key), &entry); found && entry.ExpiryTime.Equal(next.expiryTime) {
+				due = append(due, next)
+			}
+		}
+		node.mu.Unlock()
+
+		if len(due) > 0 {
+			keys := make([]string, 0, len(due))
+			for _, item := range due {
+				keys = append(keys, item.key)
+			}
+			success, _, err := node.newLogEntry(ExpireKeys{Keys: keys})
+			if success && err == nil {
+				continue
+			}
+			fmt.Printf("Could not expire keys %v: %v\n", keys, err)
+			// put the keys back while this node still leads and try them
+			// again after a pause
+			node.mu.Lock()
+			if ctx.Err() == nil {
+				for _, item := range due {
+					heap.Push(&node.kvExpiry, item)
+				}
+			}
+			node.mu.Unlock()
+			wait = KV_EXPIRY_RETRY_INTERVAL
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// applyExpireKeys deletes the keys that have expired as of the entry's time.
+func (node *Node) applyExpireKeys(cmd ExpireKeys) {
+	now := node.entryTime()
+	for _, key := range cmd.Keys {
+		var entry KVEntry
+		if found, _ := node.readFromStorage(kvKey(key), &entry); found && entry.expired(now) {
+			node.deleteKV(key)
+		}
+	}
+}
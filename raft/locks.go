@@ -0,0 +1,303 @@
+package raft
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// reenterLock bumps the hold count of a reentrant lock its holder asked for
+// again. The holder keeps its fencing token and the lease is extended to
+// cover the new TTL.
+func (node *Node) reenterLock(cmd LockAcquireCommand, lockInfo LockInfo) {
+	lockInfo.HoldCount++
+	extended := false
+	if expiryTime := node.entryTime().Add(cmd.TTL); expiryTime.After(lockInfo.ExpiryTime) {
+		lockInfo.ExpiryTime = expiryTime
+		extended = true
+	}
+	node.setData(fmt.Sprintf("%s%s", LOCKING_KEY_PREFIX, cmd.Key), lockInfo)
+	node.recordLockAudit(lockAuditRecord(AuditLockReentered, cmd.Key, lockInfo))
+	node.recordClientResult(cmd.ClientID, cmd.Seq, cmd.AckedSeq, LockAcquireResult{Key: cmd.Key, FencingToken: lockInfo.FencingToken})
+	fmt.Printf("Lock %s re-entered by %s, hold count %d\n", cmd.Key, cmd.ClientID, lockInfo.HoldCount)
+
+	node.mu.Lock()
+	if node.state != Leader {
+		node.mu.Unlock()
+		return
+	}
+	if extended {
+		node.startLockMonitor(cmd.Key, lockInfo.ExpiryTime)
+	}
+	node.mu.Unlock()
+	node.server.NotifyLockAcquire(cmd.ClientID, cmd.RequestID, cmd.Key, lockInfo.FencingToken)
+}
+
+func (node *Node) nextFencingToken(key string) FencingToken {
+	fencingTokenKey := fmt.Sprintf("%s%s", FENCING_TOKEN_PREFIX, key)
+	token := FencingToken{Key: fencingTokenKey}
+	var value uint64
+	if found, _ := node.readFromStorage(fencingTokenKey, &value); found {
+		token.Value = value + 1
+	}
+	return token
+}
+
+func (node *Node) nextFencingTokens(keys []string) []FencingToken {
+	tokens := make([]FencingToken, len(keys))
+	for i, key := range keys {
+		tokens[i] = node.nextFencingToken(key)
+	}
+	return tokens
+}
+
+// multiLockReady reports whether req is next in line for every key it asks
+// for and all of those keys are free.
+// expects node.mu to be held
+func (node *Node) multiLockReady(req LockRequest) bool {
+	for _, key := range req.Keys {
+		queuePtr, exists := node.pendingLockQueue[key]
+		if !exists || len(*queuePtr) == 0 || (*queuePtr)[node.selectLockRequest(key)].arrival != req.arrival {
+			return false
+		}
+		if _, granting := node.grantingLocks[key]; granting {
+			return false
+		}
+		if node.db.Exists(fmt.Sprintf("%s%s", LOCKING_KEY_PREFIX, key)) {
+			return false
+		}
+	}
+	return true
+}
+
+// applyMultiLockAcquire grants all keys of cmd together, or none of them if
+// any is already held.
+func (node *Node) applyMultiLockAcquire(cmd MultiLockAcquireCommand) {
+	node.mu.Lock()
+	for _, key := range cmd.Keys {
+		delete(node.grantingLocks, key)
+	}
+	node.mu.Unlock()
+	if node.answerDuplicateAcquire(cmd.ClientID, cmd.RequestID, cmd.Seq, cmd.AckedSeq) {
+		node.mu.Lock()
+		for _, key := range cmd.Keys {
+			node.pingLockQueue(key)
+		}
+		node.mu.Unlock()
+		return
+	}
+
+	req := LockRequest{Keys: cmd.Keys, ClientID: cmd.ClientID, SessionID: cmd.SessionID, RequestID: cmd.RequestID}
+	if _, found := node.getSession(cmd.SessionID); cmd.SessionID != "" && !found {
+		node.failLockGrant(req, LockReasonSessionExpired)
+		return
+	}
+	for _, key := range cmd.Keys {
+		if node.db.Exists(fmt.Sprintf("%s%s", LOCKING_KEY_PREFIX, key)) {
+			fmt.Printf("Key %s already exists\n", key)
+			node.failLockGrant(req, LockReasonHeld)
+			return
+		}
+	}
+
+	expiryTime := node.entryTime().Add(cmd.TTL)
+	for i, key := range cmd.Keys {
+		lockInfo := LockInfo{
+			Holder:       cmd.ClientID,
+			SessionID:    cmd.SessionID,
+			AcquiredAt:   node.entryTime(),
+			ExpiryTime:   expiryTime,
+			FencingToken: cmd.FencingTokens[i],
+			HoldCount:    1,
+			Group:        cmd.Keys,
+		}
+		node.setData(fmt.Sprintf("%s%s", LOCKING_KEY_PREFIX, key), lockInfo)
+		node.setData(cmd.FencingTokens[i].Key, cmd.FencingTokens[i].Value)
+		node.recordLockAudit(lockAuditRecord(AuditLockAcquired, key, lockInfo))
+	}
+	node.recordClientResult(cmd.ClientID, cmd.Seq, cmd.AckedSeq, LockAcquireResult{Keys: cmd.Keys, FencingTokens: cmd.FencingTokens})
+
+	node.mu.Lock()
+	if node.state != Leader {
+		node.mu.Unlock()
+		return
+	}
+	for _, key := range cmd.Keys {
+		node.startLockMonitor(key, expiryTime)
+	}
+	node.mu.Unlock()
+	node.server.NotifyMultiLockAcquire(cmd.ClientID, cmd.RequestID, cmd.Keys, cmd.FencingTokens)
+	for _, key := range cmd.Keys {
+		node.failTryAcquireRequests(key)
+	}
+	node.breakDeadlocks()
+}
+
+// expects node.mu to be held
+func (node *Node) startLockMonitor(key string, expiryTime time.Time) {
+	node.startExpiryMonitor(node.activeLockExpiryMonitorCancel, key, expiryTime, func() {
+		node.expireLock(key)
+	})
+}
+
+// applyLockRenew extends the lock on key if cmd's client still holds it. The
+// reply carries the expiry time the replicas applied.
+func (node *Node) applyLockRenew(cmd LockRenewCommand) LockRenewReply {
+	reply := LockRenewReply{Key: cmd.Key}
+	var lockInfo LockInfo
+	lockKey := fmt.Sprintf("%s%s", LOCKING_KEY_PREFIX, cmd.Key)
+	if found, _ := node.readFromStorage(lockKey, &lockInfo); !found || lockInfo.Holder != cmd.ClientID {
+		reply.Reason = LockReasonNotHeld
+		reply.Error = fmt.Sprintf("lock %s is no longer held by %s", cmd.Key, cmd.ClientID)
+		return reply
+	}
+	lockInfo.ExpiryTime = node.entryTime().Add(cmd.TTL)
+	node.setData(lockKey, lockInfo)
+	node.recordLockAudit(lockAuditRecord(AuditLockRenewed, cmd.Key, lockInfo))
+	if node.state == Leader {
+		node.mu.Lock()
+		node.startLockMonitor(cmd.Key, lockInfo.ExpiryTime)
+		node.mu.Unlock()
+	}
+	reply.Success = true
+	reply.ExpiryTime = lockInfo.ExpiryTime
+	return reply
+}
+
+// releaseLockHold gives up one hold on a lock; the lock itself is only
+// released once its hold count drops to zero.
+func (node *Node) releaseLockHold(cmd LockReleaseCommand) {
+	var lockInfo LockInfo
+	lockKey := fmt.Sprintf("%s%s", LOCKING_KEY_PREFIX, cmd.Key)
+	found, readErr := node.readFromStorage(lockKey, &lockInfo)
+	if readErr != nil || !found || lockInfo.Holder != cmd.ClientID || lockInfo.OwnerToken != cmd.OwnerToken {
+		return
+	}
+	if lockInfo.HoldCount > 1 {
+		lockInfo.HoldCount--
+		node.setData(lockKey, lockInfo)
+		fmt.Printf("Lock %s still held by %s, hold count %d\n", cmd.Key, cmd.ClientID, lockInfo.HoldCount)
+		return
+	}
+	if _, released := node.releaseLock(cmd.Key, cmd.ClientID); released {
+		node.recordLockAudit(lockAuditRecord(AuditLockReleased, cmd.Key, lockInfo))
+	}
+}
+
+// releaseLock drops the lock on key if it is still held by holder. On the
+// leader it also stops the expiry monitor and wakes up the next waiter.
+func (node *Node) releaseLock(key string, holder string) (LockInfo, bool) {
+	var lockInfo LockInfo
+	lockKey := fmt.Sprintf("%s%s", LOCKING_KEY_PREFIX, key)
+	found, readErr := node.readFromStorage(lockKey, &lockInfo)
+	if readErr != nil || !found || lockInfo.Holder != holder {
+		return lockInfo, false
+	}
+	node.db.Delete(lockKey)
+	fmt.Printf("Successfully deleted data for the lock %s\n", key)
+
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if node.state != Leader {
+		return lockInfo, true
+	}
+	if cancelMonitor, exists := node.activeLockExpiryMonitorCancel[key]; exists {
+		cancelMonitor()
+		delete(node.activeLockExpiryMonitorCancel, key)
+	}
+	node.pingLockQueue(key)
+	return lockInfo, true
+}
+
+// lockRequestOf is the part of the request behind cmd needed to answer it.
+func lockRequestOf(cmd LockAcquireCommand) LockRequest {
+	return LockRequest{Key: cmd.Key, ClientID: cmd.ClientID, SessionID: cmd.SessionID, RequestID: cmd.RequestID}
+}
+
+// failLockGrant answers a request taken off the queue whose grant could not
+// be applied, and lets the queues of its keys move on. Only the leader
+// answers, as it holds the client connections.
+func (node *Node) failLockGrant(req LockRequest, reason string) {
+	node.mu.Lock()
+	for _, key := range requestedLockKeys(req) {
+		node.pingLockQueue(key)
+	}
+	isLeader := node.state == Leader
+	node.mu.Unlock()
+	if isLeader {
+		node.server.NotifyLockFailure(req, reason)
+	}
+}
+
+// pingLockQueue wakes up the goroutine serving waiters on key.
+// expects node.mu to be held
+func (node *Node) pingLockQueue(key string) {
+	if ping, exists := node.pullLockRequestChan[key]; exists {
+		select {
+		case ping <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// expects node.mu to be held
+func (node *Node) describeLock(key string) (LockDescription, error) {
+	lock := LockDescription{Key: key, Policy: node.lockPolicy(key), Waiters: []LockWaiter{}}
+	var lockInfo LockInfo
+	lockKey := fmt.Sprintf("%s%s", LOCKING_KEY_PREFIX, key)
+	found, readErr := node.readFromStorage(lockKey, &lockInfo)
+	if readErr != nil {
+		return lock, readErr
+	}
+	if found {
+		lock.Held = true
+		lock.Holder = lockInfo.Holder
+		lock.AcquiredAt = lockInfo.AcquiredAt
+		lock.ExpiryTime = lockInfo.ExpiryTime
+		lock.FencingToken = lockInfo.FencingToken.Value
+		lock.Reentrant = lockInfo.Reentrant
+		lock.OwnerToken = lockInfo.OwnerToken
+		lock.HoldCount = lockInfo.HoldCount
+		lock.Group = lockInfo.Group
+	}
+	if queuePtr, exists := node.pendingLockQueue[key]; exists {
+		for _, req := range *queuePtr {
+			lock.Waiters = append(lock.Waiters, LockWaiter{
+				ClientID:    req.ClientID,
+				Keys:        req.Keys,
+				RequestID:   req.RequestID,
+				Priority:    req.Priority,
+				TTL:         req.TTL,
+				TryAcquire:  req.TryAcquire,
+				WaitTimeout: req.WaitTimeout,
+			})
+		}
+	}
+	return lock, nil
+}
+
+// listLocks describes every lock that is either held or has waiters.
+// expects node.mu to be held
+func (node *Node) listLocks() ([]LockDescription, error) {
+	keys := make(map[string]struct{})
+	for key := range node.getAllLockKeyValues() {
+		keys[key] = struct{}{}
+	}
+	for key, queuePtr := range node.pendingLockQueue {
+		if len(*queuePtr) > 0 {
+			keys[key] = struct{}{}
+		}
+	}
+	locks := make([]LockDescription, 0, len(keys))
+	for key := range keys {
+		lock, err := node.describeLock(key)
+		if err != nil {
+			return nil, err
+		}
+		locks = append(locks, lock)
+	}
+	sort.Slice(locks, func(i, j int) bool {
+		return locks[i].Key < locks[j].Key
+	})
+	return locks, nil
+}
@@ -0,0 +1,248 @@
+package raft
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// acquireLock sends an acquire over conn and waits for its reply.
+func acquireLock(t *testing.T, conn *websocket.Conn, requestID string, req LockRequest) LockAcquireReply {
+	t.Helper()
+	sendEnvelope(t, conn, MessageAcquire, requestID, req)
+	var reply LockAcquireReply
+	awaitReply(t, conn, requestID, &reply)
+	return reply
+}
+
+// lockHeldEverywhere reports whether every server has key locked, or has it
+// free if held is false.
+func lockHeldEverywhere(servers []*Server, key string, held bool) bool {
+	for _, server := range servers {
+		if server.node.db.Exists(fmt.Sprintf("%s%s", LOCKING_KEY_PREFIX, key)) != held {
+			return false
+		}
+	}
+	return true
+}
+
+// When a session expires, every lock it holds is released on every replica,
+// long before the locks' own TTL, and the release is audited.
+func TestSessionExpiryReleasesLocks(t *testing.T) {
+	servers := startCluster(t, 3)
+	leader := servers[0]
+	conn, connected := dialClient(t, leader, ConnectionRequest{ClientID: "lapsing", SessionTTL: 500 * time.Millisecond})
+	keys := []string{"session/a", "session/b"}
+	for _, key := range keys {
+		if reply := acquireLock(t, conn, key, LockRequest{Key: key, TTL: time.Minute}); !reply.Success {
+			t.Fatalf("acquiring %s: %+v", key, reply)
+		}
+	}
+	for _, key := range keys {
+		waitFor(t, 5*time.Second, key+" to be held on every server", func() bool {
+			return lockHeldEverywhere(servers, key, true)
+		})
+	}
+
+	conn.Close() // no more keepalives
+	for _, key := range keys {
+		waitFor(t, 5*time.Second, key+" to be released on every server", func() bool {
+			return lockHeldEverywhere(servers, key, false)
+		})
+	}
+	if _, found := leader.node.getSession(connected.SessionID); found {
+		t.Errorf("session %s is still open after its locks were released", connected.SessionID)
+	}
+	records, err := leader.QueryLockAudit(AuditQuery{ClientID: "lapsing"})
+	if err != nil {
+		t.Fatalf("querying the audit trail: %v", err)
+	}
+	expired := map[string]bool{}
+	for _, record := range records {
+		if record.Event == AuditLockExpired && record.Reason == "session expired" {
+			expired[record.Key] = true
+		}
+	}
+	for _, key := range keys {
+		if !expired[key] {
+			t.Errorf("no session expiry recorded for %s in %+v", key, records)
+		}
+	}
+}
+
+// holdCountEverywhere reports whether every server has key held hold times,
+// where 0 means not held.
+func holdCountEverywhere(servers []*Server, key string, hold int) bool {
+	for _, server := range servers {
+		var lockInfo LockInfo
+		server.node.readFromStorage(fmt.Sprintf("%s%s", LOCKING_KEY_PREFIX, key), &lockInfo)
+		if lockInfo.HoldCount != hold {
+			return false
+		}
+	}
+	return true
+}
+
+// A reentrant lock taken again by the same holder and owner token counts
+// the holds and keeps its fencing token; it is only free once every hold is
+// released.
+func TestReentrantLockCountsHolds(t *testing.T) {
+	servers := startCluster(t, 3)
+	leader := servers[0]
+	owner, _ := dialClient(t, leader, ConnectionRequest{ClientID: "owner"})
+	rival, _ := dialClient(t, leader, ConnectionRequest{ClientID: "rival"})
+	const key = "reentrant"
+	hold := LockRequest{Key: key, TTL: time.Minute, Reentrant: true, OwnerToken: "first"}
+	release := func(requestID string) {
+		t.Helper()
+		sendEnvelope(t, owner, MessageRelease, requestID, LockRequest{Key: key, OwnerToken: "first"})
+		var reply LockReleaseReply
+		if awaitReply(t, owner, requestID, &reply); !reply.Success {
+			t.Fatalf("release %s: %+v", requestID, reply)
+		}
+	}
+
+	first := acquireLock(t, owner, "hold-1", hold)
+	second := acquireLock(t, owner, "hold-2", hold)
+	if !first.Success || !second.Success || second.FencingToken != first.FencingToken {
+		t.Fatalf("holding the lock twice: got %+v then %+v, want the same fencing token", first, second)
+	}
+	waitFor(t, 5*time.Second, "a hold count of 2 on every server", func() bool {
+		return holdCountEverywhere(servers, key, 2)
+	})
+
+	contenders := []struct {
+		name string
+		conn *websocket.Conn
+		req  LockRequest
+	}{
+		{"another owner token", owner, LockRequest{Key: key, TTL: time.Minute, Reentrant: true, OwnerToken: "second", TryAcquire: true}},
+		{"another client", rival, LockRequest{Key: key, TTL: time.Minute, Reentrant: true, OwnerToken: "first", TryAcquire: true}},
+		{"a non-reentrant request", owner, LockRequest{Key: key, TTL: time.Minute, OwnerToken: "first", TryAcquire: true}},
+	}
+	for i, c := range contenders {
+		if reply := acquireLock(t, c.conn, fmt.Sprintf("contender-%d", i), c.req); reply.Success || reply.Reason != LockReasonHeld {
+			t.Errorf("%s: got %+v, want to be refused as held", c.name, reply)
+		}
+	}
+
+	release("release-1")
+	waitFor(t, 5*time.Second, "a hold count of 1 on every server", func() bool {
+		return holdCountEverywhere(servers, key, 1)
+	})
+	release("release-2")
+	waitFor(t, 5*time.Second, "the lock to be free on every server", func() bool {
+		return lockHeldEverywhere(servers, key, false)
+	})
+	if reply := acquireLock(t, rival, "rival", LockRequest{Key: key, TTL: time.Minute}); !reply.Success || reply.FencingToken.Value <= first.FencingToken.Value {
+		t.Errorf("taking the released lock: got %+v, want a fencing token above %d", reply, first.FencingToken.Value)
+	}
+}
+
+// A multi-key acquire takes every key or none: while one key is held the
+// others stay free, and once granted the keys are held and released as one.
+func TestMultiKeyAcquireIsAllOrNothing(t *testing.T) {
+	servers := startCluster(t, 3)
+	leader := servers[0]
+	owner, _ := dialClient(t, leader, ConnectionRequest{ClientID: "owner"})
+	rival, _ := dialClient(t, leader, ConnectionRequest{ClientID: "rival"})
+	keys := []string{"multi/a", "multi/b", "multi/c"}
+	heldEverywhere := func(held bool) func() bool {
+		return func() bool {
+			for _, key := range keys {
+				if !lockHeldEverywhere(servers, key, held) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	release := func(conn *websocket.Conn, requestID string, req LockRequest) {
+		t.Helper()
+		sendEnvelope(t, conn, MessageRelease, requestID, req)
+		var reply LockReleaseReply
+		if awaitReply(t, conn, requestID, &reply); !reply.Success {
+			t.Fatalf("release %s: %+v", requestID, reply)
+		}
+	}
+
+	if reply := acquireLock(t, rival, "rival-b", LockRequest{Key: "multi/b", TTL: time.Minute}); !reply.Success {
+		t.Fatalf("acquiring multi/b: %+v", reply)
+	}
+	try := LockRequest{Keys: keys, TTL: time.Minute, TryAcquire: true}
+	if reply := acquireLock(t, owner, "try-all", try); reply.Success || reply.Reason != LockReasonHeld {
+		t.Fatalf("acquiring every key while one is held: got %+v, want to be refused as held", reply)
+	}
+	for _, key := range []string{"multi/a", "multi/c"} {
+		if !lockHeldEverywhere(servers, key, false) {
+			t.Errorf("%s was taken by a multi-key acquire that failed", key)
+		}
+	}
+
+	release(rival, "rival-release", LockRequest{Key: "multi/b"})
+	waitFor(t, 5*time.Second, "multi/b to be free", func() bool { return lockHeldEverywhere(servers, "multi/b", false) })
+	shuffled := LockRequest{Keys: []string{"multi/c", "multi/a", "multi/b", "multi/a"}, TTL: time.Minute, TryAcquire: true}
+	reply := acquireLock(t, owner, "all", shuffled)
+	if !reply.Success || fmt.Sprint(reply.Keys) != fmt.Sprint(keys) || len(reply.FencingTokens) != len(keys) {
+		t.Fatalf("acquiring every free key: got %+v, want %v each with a fencing token", reply, keys)
+	}
+	waitFor(t, 5*time.Second, "every key to be held on every server", heldEverywhere(true))
+	if reply := acquireLock(t, rival, "rival-c", LockRequest{Key: "multi/c", TTL: time.Minute, TryAcquire: true}); reply.Success {
+		t.Errorf("multi/c was granted while held as part of a group: %+v", reply)
+	}
+
+	release(owner, "release-all", LockRequest{Keys: keys})
+	waitFor(t, 5*time.Second, "every key to be free on every server", heldEverywhere(false))
+}
+
+// Every replica applies the same lock commands in the same order, so every
+// replica ends up with the same audit trail, expiry times included.
+func TestAuditTrailMatchesAcrossReplicas(t *testing.T) {
+	servers := startCluster(t, 3)
+	leader := servers[0]
+	conn, _ := dialClient(t, leader, ConnectionRequest{ClientID: "audited"})
+	steps := []struct {
+		msgType MessageType
+		req     LockRequest
+	}{
+		{MessageAcquire, LockRequest{Key: "audit/a", TTL: time.Minute, Reentrant: true, OwnerToken: "o"}},
+		{MessageAcquire, LockRequest{Key: "audit/a", TTL: 2 * time.Minute, Reentrant: true, OwnerToken: "o"}},
+		{MessageRenew, LockRequest{Key: "audit/a", TTL: 3 * time.Minute}},
+		{MessageAcquire, LockRequest{Keys: []string{"audit/b", "audit/c"}, TTL: time.Minute}},
+		{MessageRelease, LockRequest{Key: "audit/a", OwnerToken: "o"}},
+		{MessageRelease, LockRequest{Key: "audit/a", OwnerToken: "o"}},
+		{MessageRelease, LockRequest{Keys: []string{"audit/b", "audit/c"}}},
+	}
+	for i, step := range steps {
+		requestID := fmt.Sprintf("step-%d", i)
+		sendEnvelope(t, conn, step.msgType, requestID, step.req)
+		var reply struct {
+			Success bool `json:"success"`
+		}
+		if awaitReply(t, conn, requestID, &reply); !reply.Success {
+			t.Fatalf("%s %+v was not applied", step.msgType, step.req)
+		}
+	}
+	// acquire, reenter and renew of a, acquires of b and c, the last release
+	// of a, and releases of b and c
+	const recorded = 8
+	trails := make([][]LockAuditRecord, len(servers))
+	waitFor(t, 5*time.Second, "every server to record the whole audit trail", func() bool {
+		for i, server := range servers {
+			if trails[i] = server.node.queryLockAudit(AuditQuery{}); len(trails[i]) != recorded {
+				return false
+			}
+		}
+		return true
+	})
+	for i, trail := range trails[1:] {
+		for j := range trail {
+			if !reflect.DeepEqual(trail[j], trails[0][j]) {
+				t.Errorf("server %d audit record %d is %+v, the leader's is %+v", servers[i+1].id, j, trail[j], trails[0][j])
+			}
+		}
+	}
+}
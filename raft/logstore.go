@@ -0,0 +1,121 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"log"
+)
+
+// The raft state is kept under separate keys so that persisting it costs in
+// proportion to what changed: currentTerm and votedFor each under their own
+// key and every log entry under its index. persistedLength is the prefix of
+// node.log known to be stored; the entries after it are written by the next
+// persist.
+
+func logEntryKey(index uint64) string {
+	return fmt.Sprintf("%s%020d", LOG_ENTRY_PREFIX, index)
+}
+
+func (node *Node) storeValue(key string, value interface{}) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		log.Fatal("encode error: ", err)
+	}
+	node.db.Set(key, buf.Bytes())
+}
+
+// storeEntries stores entries as the log entries following index after.
+// persistMu must be held.
+func (node *Node) storeEntries(after uint64, entries []LogEntry) {
+	for i, entry := range entries {
+		node.storeValue(logEntryKey(after+uint64(i)+1), entry)
+	}
+}
+
+// persistTermAndVote stores currentTerm and votedFor. node.mu must be held.
+func (node *Node) persistTermAndVote() {
+	node.persistMu.Lock()
+	defer node.persistMu.Unlock()
+	node.storeValue("currentTerm", node.currentTerm)
+	node.storeValue("votedFor", node.votedFor)
+}
+
+// persistToStorage stores the term, the vote and the entries appended to the
+// log since it was last persisted. node.mu must be held.
+func (node *Node) persistToStorage() {
+	node.persistTermAndVote()
+	node.persistMu.Lock()
+	node.storeEntries(node.persistedLength, node.log[node.persistedLength:])
+	node.persistMu.Unlock()
+	node.persistedLength = uint64(len(node.log))
+}
+
+// persistAppendedEntries stores everything the leader has appended since the
+// last persist in one go. The entries are encoded without node.mu held, so
+// proposals keep appending to the log meanwhile and make up the next write.
+func (node *Node) persistAppendedEntries() {
+	node.mu.Lock()
+	if node.state != Leader || uint64(len(node.log)) <= node.persistedLength {
+		node.mu.Unlock()
+		return
+	}
+	term, after := node.currentTerm, node.persistedLength
+	entries := append([]LogEntry(nil), node.log[after:]...)
+	node.persistMu.Lock()
+	node.mu.Unlock()
+	node.storeEntries(after, entries)
+	node.persistMu.Unlock()
+
+	node.mu.Lock()
+	if node.currentTerm == term && after+uint64(len(entries)) > node.persistedLength {
+		node.persistedLength = after + uint64(len(entries))
+	}
+	node.mu.Unlock()
+}
+
+// truncateLog drops the entries after length from the log and from storage.
+// node.mu must be held.
+func (node *Node) truncateLog(length uint64) {
+	node.log = node.log[:length]
+	if node.persistedLength > length {
+		node.persistedLength = length
+	}
+	node.persistMu.Lock()
+	defer node.persistMu.Unlock()
+	// a leader that stepped down may have stored entries past persistedLength
+	node.db.DeleteRange(logEntryKey(length+1), prefixEnd(LOG_ENTRY_PREFIX))
+}
+
+func (node *Node) restoreFromStorage() {
+	fmt.Printf("Restoring from storage on node: %d\n", node.id)
+	for _, data := range []struct {
+		name  string
+		value interface{}
+	}{
+		{"currentTerm", &node.currentTerm},
+		{"votedFor", &node.votedFor},
+	} {
+		if value, found := node.db.Get(data.name); found {
+			dec := gob.NewDecoder(bytes.NewBuffer(value))
+			if err := dec.Decode(data.value); err != nil {
+				log.Fatal("decode error: ", err)
+			}
+		} else {
+			log.Fatal("No data found for", data.name)
+		}
+	}
+	node.log = nil
+	for _, stored := range node.db.Range(LOG_ENTRY_PREFIX, prefixEnd(LOG_ENTRY_PREFIX), 0) {
+		if stored.Key != logEntryKey(uint64(len(node.log))+1) {
+			log.Fatalf("log entry %d missing from storage, found %s", len(node.log)+1, stored.Key)
+		}
+		var entry LogEntry
+		if err := gob.NewDecoder(bytes.NewBuffer(stored.Value)).Decode(&entry); err != nil {
+			log.Fatal("decode error: ", err)
+		}
+		node.log = append(node.log, entry)
+	}
+	node.persistedLength = uint64(len(node.log))
+	node.restoreWatchRevisions()
+}
@@ -5,10 +5,13 @@ import (
 	"encoding/gob"
 	"errors"
 	"fmt"
+	"math"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 var mu sync.Mutex
@@ -34,31 +37,193 @@ func CreateServer(serverId uint64) (*Server, error) {
 	return server, nil
 }
 
-// write integer value to a string key in the database
-// OPTIONAL to pass a particular server id to send command to
-func SetData(server *Server, key string, val int) error {
-	cmd := Write{Key: key, Val: val}
-	if success, _, _ := server.SubmitToServer(cmd); success {
-		return nil
-	} else {
+// write a value to a string key in the database
+func SetData(server *Server, key string, value []byte) error {
+	return SetDataWithTTL(server, key, value, 0)
+}
+
+// set the value of a key that is deleted once ttl has passed; a zero ttl
+// keeps the key until it is overwritten or deleted
+func SetDataWithTTL(server Submitter, key string, value []byte, ttl time.Duration) error {
+	cmd := Write{Key: key, Value: value, TTL: ttl}
+	if err := validateWrite(cmd); err != nil {
+		return err
+	}
+	success, _, err := server.SubmitToServer(cmd)
+	if err != nil {
+		return err
+	}
+	if !success {
 		return errors.New("command could not be submitted, try different server(leader)")
 	}
+	return nil
 }
 
-// read integer value of a string key from the database
-// OPTIONAL to pass a particular server id to send command to
-func GetData(server *Server, key string) (LockInfo, error) {
-	cmd := Read{Key: key}
-	if success, reply, err := server.SubmitToServer(cmd); success {
-		if err != nil {
-			return LockInfo{}, err
-		} else {
-			value, _ := reply.(LockInfo)
-			return value, nil
-		}
-	} else {
-		return LockInfo{}, errors.New("command could not be submitted, try different server")
+// read the value of a string key from the database; found is false if the
+// key is not set
+func GetData(server *Server, key string) (value []byte, found bool, err error) {
+	reply, err := GetVersionedData(server, key)
+	return reply.Value, reply.Found, err
+}
+
+// read the value of a key together with its version
+func GetVersionedData(server *Server, key string) (ReadReply, error) {
+	return GetDataAtRevision(server, key, 0)
+}
+
+// read the value a key held as of a past revision; a revision of 0 reads
+// the latest value
+func GetDataAtRevision(server *Server, key string, revision uint64) (ReadReply, error) {
+	cmd := Read{Key: key, Revision: revision}
+	success, reply, err := server.SubmitToServer(cmd)
+	if err != nil {
+		return ReadReply{}, err
+	}
+	if !success {
+		return ReadReply{}, errors.New("command could not be submitted, try different server")
+	}
+	readReply, ok := reply.(ReadReply)
+	if !ok {
+		return ReadReply{}, fmt.Errorf("unexpected reply for read: %T", reply)
+	}
+	return readReply, nil
+}
+
+// read one page of the keys in [start, end); an empty end means no upper
+// bound and pageToken continues from an earlier page
+func RangeData(server *Server, start string, end string, limit int, pageToken string) (RangeReply, error) {
+	return RangeDataAtRevision(server, start, end, limit, pageToken, 0)
+}
+
+// read one page of the keys in [start, end) as they were at a past
+// revision; a revision of 0 reads the latest values
+func RangeDataAtRevision(server *Server, start string, end string, limit int, pageToken string, revision uint64) (RangeReply, error) {
+	query := RangeQuery{Start: start, End: end, Limit: limit, PageToken: pageToken, Revision: revision}
+	success, reply, err := server.SubmitToServer(query)
+	if err != nil {
+		return RangeReply{}, err
+	}
+	if !success {
+		return RangeReply{}, errors.New("command could not be submitted, try different server")
+	}
+	rangeReply, ok := reply.(RangeReply)
+	if !ok {
+		return RangeReply{}, fmt.Errorf("unexpected reply for range: %T", reply)
+	}
+	return rangeReply, nil
+}
+
+// read one page of the keys starting with prefix
+func PrefixData(server *Server, prefix string, limit int, pageToken string) (RangeReply, error) {
+	return RangeData(server, prefix, prefixEnd(prefix), limit, pageToken)
+}
+
+// optionalArg returns tokens[i], or "" if it is missing or "-"
+func optionalArg(tokens []string, i int) string {
+	if i >= len(tokens) || tokens[i] == "-" {
+		return ""
+	}
+	return tokens[i]
+}
+
+// submit a conditional KV command and wait for the result of applying it
+func submitKVCommand(server Submitter, cmd interface{}) (KVResult, error) {
+	success, reply, err := server.SubmitToServer(cmd)
+	if err != nil {
+		return KVResult{}, err
+	}
+	if !success {
+		return KVResult{}, errors.New("command could not be submitted, try different server")
+	}
+	result, ok := reply.(KVResult)
+	if !ok {
+		return KVResult{}, fmt.Errorf("unexpected reply for %T: %T", cmd, reply)
+	}
+	return result, nil
+}
+
+// delete a key; Success is false if the key was not set
+func DeleteData(server Submitter, key string) (KVResult, error) {
+	if err := validateKV(key, nil); err != nil {
+		return KVResult{}, err
+	}
+	return submitKVCommand(server, Delete{Key: key})
+}
+
+// write value to key only if it currently holds expected
+func CompareAndSwapData(server Submitter, key string, expected []byte, value []byte) (KVResult, error) {
+	if err := validateKV(key, value); err != nil {
+		return KVResult{}, err
+	}
+	return submitKVCommand(server, CompareAndSwap{Key: key, Expected: expected, Value: value})
+}
+
+// write value to key only if it is at version expectedVersion (0 if unset)
+func CompareVersionAndSwapData(server Submitter, key string, expectedVersion uint64, value []byte) (KVResult, error) {
+	if err := validateKV(key, value); err != nil {
+		return KVResult{}, err
+	}
+	return submitKVCommand(server, CompareAndSwap{Key: key, ExpectedVersion: expectedVersion, CompareVersion: true, Value: value})
+}
+
+// write value to key only if the key is not set
+func PutDataIfAbsent(server Submitter, key string, value []byte) (KVResult, error) {
+	if err := validateKV(key, value); err != nil {
+		return KVResult{}, err
+	}
+	return submitKVCommand(server, PutIfAbsent{Key: key, Value: value})
+}
+
+// add delta, which may be negative, to the counter stored under key and
+// return its new value
+func IncrementData(server Submitter, key string, delta int64) (IncrementResult, error) {
+	return submitIncrement(server, Increment{Key: key, Delta: delta})
+}
+
+// add delta to the counter under key only if the new value stays within
+// [low, high]; Success is false otherwise
+func IncrementDataWithin(server Submitter, key string, delta int64, low int64, high int64) (IncrementResult, error) {
+	return submitIncrement(server, Increment{Key: key, Delta: delta, Bounded: true, Min: low, Max: high})
+}
+
+func submitIncrement(server Submitter, cmd Increment) (IncrementResult, error) {
+	if err := validateIncrement(cmd); err != nil {
+		return IncrementResult{}, err
+	}
+	success, reply, err := server.SubmitToServer(cmd)
+	if err != nil {
+		return IncrementResult{}, err
 	}
+	if !success {
+		return IncrementResult{}, errors.New("command could not be submitted, try different server")
+	}
+	result, ok := reply.(IncrementResult)
+	if !ok {
+		return IncrementResult{}, fmt.Errorf("unexpected reply for increment: %T", reply)
+	}
+	if result.Error != "" {
+		return result, errors.New(result.Error)
+	}
+	return result, nil
+}
+
+// discard the history of keys older than revision
+func CompactData(server *Server, revision uint64) (CompactResult, error) {
+	if revision == 0 {
+		return CompactResult{}, errors.New("revision not passed")
+	}
+	success, reply, err := server.SubmitToServer(Compact{Revision: revision})
+	if err != nil {
+		return CompactResult{}, err
+	}
+	if !success {
+		return CompactResult{}, errors.New("command could not be submitted, try different server")
+	}
+	result, ok := reply.(CompactResult)
+	if !ok {
+		return CompactResult{}, fmt.Errorf("unexpected reply for compact: %T", reply)
+	}
+	return result, nil
 }
 
 // // add new server to the raft cluster
@@ -190,6 +355,27 @@ func Stop(server *Server) error {
 	return nil
 }
 
+func printLock(lock LockDescription) {
+	if lock.Held {
+		fmt.Printf("LOCK %s HELD BY %s SINCE %v, EXPIRES %v, FENCING TOKEN %d\n",
+			lock.Key, lock.Holder, lock.AcquiredAt.Format(time.RFC3339), lock.ExpiryTime.Format(time.RFC3339), lock.FencingToken)
+		if len(lock.Group) > 1 {
+			fmt.Printf("    ACQUIRED TOGETHER WITH %v\n", lock.Group)
+		}
+		if lock.Reentrant {
+			fmt.Printf("    REENTRANT, OWNER %q, HOLD COUNT %d\n", lock.OwnerToken, lock.HoldCount)
+		}
+	} else {
+		fmt.Printf("LOCK %s FREE\n", lock.Key)
+	}
+	if lock.Policy != LockPolicyFIFO {
+		fmt.Printf("    WAITERS SERVED BY %s\n", lock.Policy)
+	}
+	for i, waiter := range lock.Waiters {
+		fmt.Printf("    WAITER %d: CLIENT %s, PRIORITY %d, TTL %v\n", i+1, waiter.ClientID, waiter.Priority, waiter.TTL)
+	}
+}
+
 func PrintMenu() {
 	fmt.Println("\n\n           	RAFT MENU: [nodes are 0 indexed]")
 	fmt.Println("+---------------------------+------------------------------------+")
@@ -208,6 +394,23 @@ func PrintMenu() {
 	fmt.Println("| 11 | add servers (x)      |      [peerIds]                     |")
 	fmt.Println("| 12 | remove server        |                                    |")
 	fmt.Println("| 13 | join cluster         |      leaderId, leaderAddress       |")
+	fmt.Println("| 14 | list locks           |      _                             |")
+	fmt.Println("| 15 | describe lock        |      lockKey                       |")
+	fmt.Println("| 16 | force release lock   |      lockKey, operator, [reason]   |")
+	fmt.Println("| 17 | set lock policy      |      lockKey, policy               |")
+	fmt.Println("| 18 | lock audit trail     |      [lockKey], [clientId]         |")
+	fmt.Println("| 19 | delete data          |      key                           |")
+	fmt.Println("| 20 | compare and swap     |      key, expected, value          |")
+	fmt.Println("| 21 | put if absent        |      key, value                    |")
+	fmt.Println("| 22 | range scan           |      start, [end], [limit], [token]|")
+	fmt.Println("| 23 | prefix scan          |      prefix, [limit], [token]      |")
+	fmt.Println("| 24 | set data with ttl    |      key, ttlSecs, value           |")
+	fmt.Println("| 25 | get data at revision |      key, revision                 |")
+	fmt.Println("| 26 | compact history      |      revision                      |")
+	fmt.Println("| 27 | increment counter    |      key, delta, [min], [max]      |")
+	fmt.Println("| 28 | set data in batch    |      key=value key=value ...       |")
+	fmt.Println("| 29 | replication limits   | [maxEntries] [maxBytes] [inflight] |")
+	fmt.Println("| 30 | replication status   |      _                             |")
 	fmt.Println("+----+----------------------+------------------------------------+")
 	fmt.Println("")
 	fmt.Println("+--------------------      USER      ----------------------------+")
@@ -218,6 +421,63 @@ func PrintMenu() {
 	fmt.Println("")
 }
 
+// registerGobTypes registers every type carried inside an interface in log
+// entries and RPCs.
+func registerGobTypes() {
+	gob.Register(Write{})
+	gob.Register(ExpireKeys{})
+	gob.Register(Read{})
+	gob.Register(ReadReply{})
+	gob.Register(Delete{})
+	gob.Register(CompareAndSwap{})
+	gob.Register(PutIfAbsent{})
+	gob.Register(KVResult{})
+	gob.Register(Txn{})
+	gob.Register(TxnResult{})
+	gob.Register(RangeQuery{})
+	gob.Register(RangeReply{})
+	gob.Register(Increment{})
+	gob.Register(BatchWrite{})
+	gob.Register(BatchWriteResult{})
+	gob.Register(ClientCommand{})
+	gob.Register(LockAcquireResult{})
+	gob.Register(IncrementResult{})
+	gob.Register(Compact{})
+	gob.Register(CompactResult{})
+	gob.Register(AddServer{})
+	gob.Register(RemoveServer{})
+	gob.Register(LockAcquireCommand{})
+	gob.Register(LockReleaseCommand{})
+	gob.Register(LockRenewCommand{})
+	gob.Register(LockRenewReply{})
+	gob.Register(SessionKeepAliveReply{})
+	gob.Register(FencingTokenQuery{})
+	gob.Register(FencingTokenStatus{})
+	gob.Register(ListLocks{})
+	gob.Register(DescribeLock{})
+	gob.Register(LockDescription{})
+	gob.Register([]LockDescription{})
+	gob.Register(LockForceReleaseCommand{})
+	gob.Register(MultiLockAcquireCommand{})
+	gob.Register(MultiLockReleaseCommand{})
+	gob.Register(LockPolicyCommand{})
+	gob.Register(AuditQuery{})
+	gob.Register(BarrierArriveCommand{})
+	gob.Register(LatchCreateCommand{})
+	gob.Register(LatchCountDownCommand{})
+	gob.Register(LatchWaitCommand{})
+	gob.Register(QueueEnqueueCommand{})
+	gob.Register(QueueDequeueCommand{})
+	gob.Register(QueueAckCommand{})
+	gob.Register(QueueNackCommand{})
+	gob.Register(QueueRedeliverCommand{})
+	gob.Register(LockAuditRecord{})
+	gob.Register([]LockAuditRecord{})
+	gob.Register(SessionCreateCommand{})
+	gob.Register(SessionKeepAliveCommand{})
+	gob.Register(SessionExpireCommand{})
+}
+
 func ServerInput(sigCh chan os.Signal) {
 	var input string
 	var server *Server = nil
@@ -230,12 +490,7 @@ func ServerInput(sigCh chan os.Signal) {
 		os.Exit(0)
 	}()
 
-	gob.Register(Write{})
-	gob.Register(Read{})
-	gob.Register(AddServer{})
-	gob.Register(RemoveServer{})
-	gob.Register(LockAcquireCommand{})
-	gob.Register(LockReleaseCommand{})
+	registerGobTypes()
 
 	fmt.Println("\n\n=============================================================")
 	fmt.Println(".............CONFIGURE YOUR SERVER.......................")
@@ -291,14 +546,10 @@ func ServerInput(sigCh chan os.Signal) {
 				fmt.Println("key or value not passed")
 				break
 			}
-			val, err := strconv.Atoi(tokens[2])
-			if err != nil {
-				fmt.Println("invalid value passed")
-				break
-			}
-			err = SetData(server, tokens[1], val)
+			val := strings.Join(tokens[2:], " ")
+			err := SetData(server, tokens[1], []byte(val))
 			if err == nil {
-				fmt.Printf("WRITE TO KEY %s WITH VALUE %d SUCCESSFUL\n", tokens[1], val)
+				fmt.Printf("WRITE TO KEY %s WITH VALUE %q SUCCESSFUL\n", tokens[1], val)
 			} else {
 				fmt.Printf("%v\n", err)
 			}
@@ -307,9 +558,13 @@ func ServerInput(sigCh chan os.Signal) {
 				fmt.Println("key not passed")
 				break
 			}
-			val, err := GetData(server, tokens[1])
-			if err == nil {
-				fmt.Printf("READ KEY %s VALUE %v\n", tokens[1], val)
+			reply, err := GetVersionedData(server, tokens[1])
+			if err == nil && !reply.Found {
+				fmt.Printf("KEY %s NOT SET\n", tokens[1])
+			} else if err == nil && reply.TTL > 0 {
+				fmt.Printf("READ KEY %s VALUE %q VERSION %d MOD REVISION %d TTL %v\n", tokens[1], reply.Value, reply.Version, reply.ModRevision, reply.TTL.Round(time.Millisecond))
+			} else if err == nil {
+				fmt.Printf("READ KEY %s VALUE %q VERSION %d MOD REVISION %d\n", tokens[1], reply.Value, reply.Version, reply.ModRevision)
 			} else {
 				fmt.Printf("%v\n", err)
 			}
@@ -425,6 +680,292 @@ func ServerInput(sigCh chan os.Signal) {
 		// 	} else {
 		// 		fmt.Printf("%v\n", err)
 		// 	}
+		case 14:
+			locks, err := server.ListLocks()
+			if err != nil {
+				fmt.Printf("%v\n", err)
+				break
+			}
+			if len(locks) == 0 {
+				fmt.Println("NO LOCKS HELD OR WAITED ON")
+			}
+			for _, lock := range locks {
+				printLock(lock)
+			}
+		case 15:
+			if len(tokens) < 2 {
+				fmt.Println("lock key not passed")
+				break
+			}
+			lock, err := server.DescribeLock(tokens[1])
+			if err != nil {
+				fmt.Printf("%v\n", err)
+				break
+			}
+			printLock(lock)
+		case 16:
+			if len(tokens) < 3 {
+				fmt.Println("lock key or operator not passed")
+				break
+			}
+			holder, err := server.ForceReleaseLock(tokens[1], tokens[2], strings.Join(tokens[3:], " "))
+			if err == nil {
+				fmt.Printf("LOCK %s FORCE RELEASED FROM %s\n", tokens[1], holder)
+			} else {
+				fmt.Printf("%v\n", err)
+			}
+		case 19:
+			if len(tokens) < 2 {
+				fmt.Println("key not passed")
+				break
+			}
+			result, err := DeleteData(server, tokens[1])
+			if err != nil {
+				fmt.Printf("%v\n", err)
+			} else if result.Success {
+				fmt.Printf("DELETED KEY %s (VALUE %q, VERSION %d)\n", tokens[1], result.Previous, result.PreviousVersion)
+			} else {
+				fmt.Printf("KEY %s NOT SET\n", tokens[1])
+			}
+		case 20:
+			if len(tokens) < 4 {
+				fmt.Println("key, expected value or new value not passed")
+				break
+			}
+			value := strings.Join(tokens[3:], " ")
+			var result KVResult
+			var err error
+			// an expected value of the form #<n> compares against the key's version
+			if version, parseErr := strconv.ParseUint(strings.TrimPrefix(tokens[2], "#"), 10, 64); strings.HasPrefix(tokens[2], "#") && parseErr == nil {
+				result, err = CompareVersionAndSwapData(server, tokens[1], version, []byte(value))
+			} else {
+				result, err = CompareAndSwapData(server, tokens[1], []byte(tokens[2]), []byte(value))
+			}
+			if err != nil {
+				fmt.Printf("%v\n", err)
+			} else if result.Success {
+				fmt.Printf("SWAPPED KEY %s TO %q (VERSION %d)\n", tokens[1], value, result.Version)
+			} else if result.Existed {
+				fmt.Printf("COMPARE FAILED: KEY %s HOLDS %q (VERSION %d)\n", tokens[1], result.Previous, result.PreviousVersion)
+			} else {
+				fmt.Printf("COMPARE FAILED: KEY %s NOT SET\n", tokens[1])
+			}
+		case 21:
+			if len(tokens) < 3 {
+				fmt.Println("key or value not passed")
+				break
+			}
+			value := strings.Join(tokens[2:], " ")
+			result, err := PutDataIfAbsent(server, tokens[1], []byte(value))
+			if err != nil {
+				fmt.Printf("%v\n", err)
+			} else if result.Success {
+				fmt.Printf("WRITE TO KEY %s WITH VALUE %q SUCCESSFUL\n", tokens[1], value)
+			} else {
+				fmt.Printf("KEY %s ALREADY HOLDS %q (VERSION %d)\n", tokens[1], result.Previous, result.PreviousVersion)
+			}
+		case 22, 23:
+			if len(tokens) < 2 {
+				fmt.Println("start key or prefix not passed")
+				break
+			}
+			var page RangeReply
+			var err error
+			if command == 23 {
+				limit, _ := strconv.Atoi(optionalArg(tokens, 2))
+				page, err = PrefixData(server, tokens[1], limit, optionalArg(tokens, 3))
+			} else {
+				limit, _ := strconv.Atoi(optionalArg(tokens, 3))
+				page, err = RangeData(server, tokens[1], optionalArg(tokens, 2), limit, optionalArg(tokens, 4))
+			}
+			if err != nil {
+				fmt.Printf("%v\n", err)
+				break
+			}
+			for _, kv := range page.KVs {
+				fmt.Printf("KEY %s VALUE %q VERSION %d\n", kv.Key, kv.Value, kv.Version)
+			}
+			if page.NextPageToken != "" {
+				fmt.Printf("MORE KEYS, NEXT PAGE TOKEN %s\n", page.NextPageToken)
+			}
+		case 24:
+			if len(tokens) < 4 {
+				fmt.Println("key, ttl or value not passed")
+				break
+			}
+			ttlSecs, err := strconv.Atoi(tokens[2])
+			if err != nil || ttlSecs <= 0 {
+				fmt.Println("invalid ttl")
+				break
+			}
+			val := strings.Join(tokens[3:], " ")
+			if err := SetDataWithTTL(server, tokens[1], []byte(val), time.Duration(ttlSecs)*time.Second); err == nil {
+				fmt.Printf("WRITE TO KEY %s WITH VALUE %q SUCCESSFUL, EXPIRES IN %ds\n", tokens[1], val, ttlSecs)
+			} else {
+				fmt.Printf("%v\n", err)
+			}
+		case 25:
+			if len(tokens) < 3 {
+				fmt.Println("key or revision not passed")
+				break
+			}
+			revision, err := strconv.ParseUint(tokens[2], 10, 64)
+			if err != nil || revision == 0 {
+				fmt.Println("invalid revision")
+				break
+			}
+			reply, err := GetDataAtRevision(server, tokens[1], revision)
+			if err != nil {
+				fmt.Printf("%v\n", err)
+			} else if !reply.Found {
+				fmt.Printf("KEY %s NOT SET AT REVISION %d\n", tokens[1], revision)
+			} else {
+				fmt.Printf("READ KEY %s AT REVISION %d VALUE %q VERSION %d MOD REVISION %d\n", tokens[1], revision, reply.Value, reply.Version, reply.ModRevision)
+			}
+		case 26:
+			if len(tokens) < 2 {
+				fmt.Println("revision not passed")
+				break
+			}
+			revision, err := strconv.ParseUint(tokens[1], 10, 64)
+			if err != nil {
+				fmt.Println("invalid revision")
+				break
+			}
+			result, err := CompactData(server, revision)
+			if err != nil {
+				fmt.Printf("%v\n", err)
+			} else {
+				fmt.Printf("COMPACTED HISTORY UP TO REVISION %d, REMOVED %d RECORDS\n", result.Revision, result.Removed)
+			}
+		case 27:
+			if len(tokens) < 3 {
+				fmt.Println("key or delta not passed")
+				break
+			}
+			delta, err := strconv.ParseInt(tokens[2], 10, 64)
+			if err != nil {
+				fmt.Println("invalid delta")
+				break
+			}
+			var result IncrementResult
+			if len(tokens) > 3 {
+				low, high := int64(math.MinInt64), int64(math.MaxInt64)
+				if arg := optionalArg(tokens, 3); arg != "" {
+					low, err = strconv.ParseInt(arg, 10, 64)
+				}
+				if arg := optionalArg(tokens, 4); arg != "" && err == nil {
+					high, err = strconv.ParseInt(arg, 10, 64)
+				}
+				if err != nil {
+					fmt.Println("invalid bounds")
+					break
+				}
+				result, err = IncrementDataWithin(server, tokens[1], delta, low, high)
+			} else {
+				result, err = IncrementData(server, tokens[1], delta)
+			}
+			if err != nil {
+				fmt.Printf("%v\n", err)
+			} else if result.Success {
+				fmt.Printf("COUNTER %s IS NOW %d (VERSION %d)\n", tokens[1], result.Value, result.Version)
+			} else {
+				fmt.Printf("COUNTER %s LEFT AT %d, %d WOULD BE OUT OF BOUNDS\n", tokens[1], result.Value, result.Value+delta)
+			}
+		case 28:
+			if len(tokens) < 2 {
+				fmt.Println("no key=value pairs passed")
+				break
+			}
+			writes := make([]Write, 0, len(tokens)-1)
+			for _, token := range tokens[1:] {
+				key, value, found := strings.Cut(token, "=")
+				if !found {
+					fmt.Printf("%q is not of the form key=value\n", token)
+					writes = nil
+					break
+				}
+				writes = append(writes, Write{Key: key, Value: []byte(value)})
+			}
+			if writes == nil {
+				break
+			}
+			result, err := SetDataBatch(server, writes)
+			if err != nil {
+				fmt.Printf("%v\n", err)
+			} else {
+				fmt.Printf("WROTE %d KEYS AT REVISION %d\n", result.Count, result.Revision)
+			}
+		case 29:
+			config := server.GetReplicationConfig()
+			var err error
+			if arg := optionalArg(tokens, 1); arg != "" {
+				config.MaxEntriesPerAppend, err = strconv.Atoi(arg)
+			}
+			if arg := optionalArg(tokens, 2); arg != "" && err == nil {
+				config.MaxBytesPerAppend, err = strconv.Atoi(arg)
+			}
+			if arg := optionalArg(tokens, 3); arg != "" && err == nil {
+				config.MaxInflightAppends, err = strconv.Atoi(arg)
+			}
+			if err == nil {
+				err = server.SetReplicationConfig(config)
+			}
+			if err != nil {
+				fmt.Printf("%v\n", err)
+				break
+			}
+			fmt.Printf("AT MOST %d ENTRIES AND %d BYTES PER APPEND, %d APPENDS IN FLIGHT PER FOLLOWER\n",
+				config.MaxEntriesPerAppend, config.MaxBytesPerAppend, config.MaxInflightAppends)
+		case 30:
+			status, err := server.ReplicationStatus()
+			if err != nil {
+				fmt.Printf("%v\n", err)
+				break
+			}
+			peers := make([]uint64, 0, len(status))
+			for peer := range status {
+				peers = append(peers, peer)
+			}
+			sort.Slice(peers, func(i, j int) bool { return peers[i] < peers[j] })
+			for _, peer := range peers {
+				pr := status[peer]
+				fmt.Printf("PEER %d %-9s MATCH %d NEXT %d IN FLIGHT %d\n", peer, pr.State, pr.Match, pr.Next, pr.Inflight)
+			}
+		case 18:
+			query := AuditQuery{}
+			if len(tokens) > 1 && tokens[1] != "-" {
+				query.Key = tokens[1]
+			}
+			if len(tokens) > 2 {
+				query.ClientID = tokens[2]
+			}
+			records, err := server.QueryLockAudit(query)
+			if err != nil {
+				fmt.Printf("%v\n", err)
+				break
+			}
+			for _, record := range records {
+				fmt.Printf("%s TERM %d %-13s LOCK %s CLIENT %s FENCING TOKEN %d",
+					record.Time.Format(time.RFC3339), record.Term, record.Event, record.Key, record.ClientID, record.FencingToken)
+				if record.HeldFor > 0 {
+					fmt.Printf(" HELD FOR %v", record.HeldFor.Round(time.Millisecond))
+				}
+				if record.Operator != "" {
+					fmt.Printf(" BY %s (%s)", record.Operator, record.Reason)
+				}
+				fmt.Println()
+			}
+		case 17:
+			if len(tokens) < 3 {
+				fmt.Println("lock key or policy not passed")
+				break
+			}
+			if err := server.SetLockPolicy(tokens[1], strings.ToUpper(tokens[2])); err == nil {
+				fmt.Printf("LOCK %s POLICY SET TO %s\n", tokens[1], strings.ToUpper(tokens[2]))
+			} else {
+				fmt.Printf("%v\n", err)
+			}
 		case 12:
 			RemoveServerFromCluster(server)
 			fmt.Printf("Server %d removed from cluster\n", server.GetServerId())
@@ -2,6 +2,7 @@ package raft
 
 import (
 	"context"
+	"encoding/json"
 	"net"
 	"net/rpc"
 	"sync"
@@ -12,6 +13,148 @@ import (
 
 const FENCING_TOKEN_PREFIX string = "FENCING_TOKEN_"
 const LOCKING_KEY_PREFIX string = "LOCK_"
+const SESSION_KEY_PREFIX string = "SESSION_"
+const LOCK_POLICY_PREFIX string = "POLICY_"
+const AUDIT_KEY_PREFIX string = "AUDIT_"
+const BARRIER_KEY_PREFIX string = "BARRIER_"
+const LATCH_KEY_PREFIX string = "LATCH_"
+const QUEUE_KEY_PREFIX string = "QUEUE_"
+const QUEUE_READY_PREFIX string = "QUEUEREADY_"
+const QUEUE_DELIVERY_PREFIX string = "QUEUEDELIVERY_"
+const KV_KEY_PREFIX string = "KV_"
+const WATCH_EVENT_PREFIX string = "EVENT_"
+const KV_HISTORY_PREFIX string = "HISTORY_"
+const CLUSTER_REVISION_KEY string = "CLUSTER_REVISION"
+const COMPACTED_REVISION_KEY string = "COMPACTED_REVISION"
+const CLIENT_REQUESTS_PREFIX string = "CLIENT_REQUESTS_"
+const CLIENT_RESULT_PREFIX string = "CLIENTRESULT_"
+const LOG_ENTRY_PREFIX string = "LOG_"
+
+// Limits on the size of keys and values in the key-value store
+const MAX_KV_KEY_SIZE int = 1024
+const MAX_KV_VALUE_SIZE int = 1 << 20
+
+// Limits on the payload of a queue item and the items a queue holds, ready
+// or delivered
+const MAX_QUEUE_PAYLOAD_SIZE int = 1 << 20
+const MAX_QUEUE_ITEMS int = 100000
+
+// How long the leader waits for a conditional KV command to be applied
+const KV_APPLY_TIMEOUT time.Duration = 5 * time.Second
+
+// Most puts carried by one BatchWrite
+const MAX_BATCH_WRITES int = 1000
+
+// Most AppendEntries a leader keeps awaiting a reply on the stream to one
+// follower; the stream stops writing until replies come back
+const MAX_STREAM_APPENDS int = 64
+
+// How long a follower holds an AppendEntries that arrived ahead of the one
+// before it, waiting for the gap in its log to be filled
+const APPEND_REORDER_WAIT time.Duration = 20 * time.Millisecond
+
+// Most keys the leader expires with a single log entry
+const MAX_KV_EXPIRY_BATCH int = 100
+
+// How long the leader waits before proposing keys whose expiry failed again
+const KV_EXPIRY_RETRY_INTERVAL time.Duration = 500 * time.Millisecond
+
+// Most lock audit records kept; the oldest are dropped beyond it
+const MAX_AUDIT_RECORDS int = 10000
+
+// Records the audit trail may grow past MAX_AUDIT_RECORDS before they are
+// dropped together
+const AUDIT_PRUNE_BATCH int = 1000
+
+// Most KV and txn requests read from a client's connection that may wait to
+// be proposed; reading stops until there is room
+const MAX_PENDING_KV_REQUESTS int = 64
+
+// Most results of unacknowledged requests kept per client for deduplication;
+// new requests are refused beyond it
+const MAX_CLIENT_RESULTS int = 1024
+
+// Number of revisions of key-value events kept for watches that resume from
+// the past
+const WATCH_HISTORY_REVISIONS uint64 = 10000
+
+// Most messages queued for a watcher before it is cancelled; enough for a
+// replay of the whole watch history
+const MAX_WATCH_BACKLOG int = 2 * int(WATCH_HISTORY_REVISIONS)
+
+// Page sizes for range and prefix scans of the key-value store
+const DEFAULT_RANGE_LIMIT int = 100
+const MAX_RANGE_LIMIT int = 1000
+
+// Upper bound on the comparisons plus operations in one transaction
+const MAX_TXN_OPS int = 128
+
+// TTL given to a client session that does not ask for one
+const DEFAULT_SESSION_TTL time.Duration = 10 * time.Second
+
+const DEFAULT_QUEUE_VISIBILITY_TIMEOUT time.Duration = 30 * time.Second
+
+// A waiter under the PRIORITY policy gains one priority level for every
+// interval it has waited, so low priority requests are not starved.
+const LOCK_PRIORITY_AGING_INTERVAL time.Duration = 5 * time.Second
+
+// A waiter under the FAIR_SHARE policy that has waited this long is served in
+// arrival order, however often its client has held the lock.
+const LOCK_FAIR_SHARE_MAX_WAIT time.Duration = 30 * time.Second
+
+// Reason codes sent back in a failed LockAcquireReply or LockRenewReply
+const (
+	LockReasonHeld           string = "LOCK_HELD"
+	LockReasonWaitTimeout    string = "WAIT_TIMEOUT"
+	LockReasonDeadlock       string = "DEADLOCK"
+	LockReasonSessionExpired string = "SESSION_EXPIRED"
+	LockReasonNotHeld        string = "NOT_HELD"
+)
+
+// Version of the Envelope format spoken on the /ws connection
+const LOCK_PROTOCOL_VERSION int = 1
+
+type MessageType string
+
+const (
+	MessageAcquire MessageType = "acquire"
+	MessageRelease MessageType = "release"
+	MessageRenew   MessageType = "renew"
+	MessageSession MessageType = "keepalive"
+	MessageError   MessageType = "error"
+	MessageEvent   MessageType = "event"
+	MessageBarrier MessageType = "barrier"
+	MessageLatch   MessageType = "latch"
+	MessageQueue   MessageType = "queue"
+	MessageKV      MessageType = "kv"
+	MessageTxn     MessageType = "txn"
+	MessageWatch   MessageType = "watch"
+)
+
+// Events pushed to a client without a matching request
+const (
+	LockEventExpired string = "LOCK_EXPIRED"
+	LockEventRevoked string = "LOCK_REVOKED"
+)
+
+// Lock audit events
+const (
+	AuditLockAcquired      string = "ACQUIRE"
+	AuditLockReentered     string = "REENTER"
+	AuditLockRenewed       string = "RENEW"
+	AuditLockReleased      string = "RELEASE"
+	AuditLockExpired       string = "EXPIRE"
+	AuditLockForceReleased string = "FORCE_RELEASE"
+)
+
+// LockPolicy decides which waiter is served next once a lock is free.
+type LockPolicy string
+
+const (
+	LockPolicyFIFO      LockPolicy = "FIFO"
+	LockPolicyPriority  LockPolicy = "PRIORITY"
+	LockPolicyFairShare LockPolicy = "FAIR_SHARE"
+)
 
 type LockCommandType int
 
@@ -28,50 +171,783 @@ type FencingToken struct {
 type LockAcquireCommand struct {
 	Key          string
 	ClientID     string
+	SessionID    string
 	TTL          time.Duration
 	Contact      uint64
 	FencingToken FencingToken
+	RequestID    string
+	Reentrant    bool
+	OwnerToken   string
+	Seq          uint64
+	AckedSeq     uint64
+}
+
+// MultiLockAcquireCommand grants every key in Keys to the client at once.
+// FencingTokens[i] belongs to Keys[i].
+type MultiLockAcquireCommand struct {
+	Keys          []string
+	ClientID      string
+	SessionID     string
+	TTL           time.Duration
+	FencingTokens []FencingToken
+	RequestID     string
+	Seq           uint64
+	AckedSeq      uint64
+}
+
+type MultiLockReleaseCommand struct {
+	Keys     []string
+	ClientID string
 }
 
+// Expired marks a release proposed by the leader because the lease ran out;
+// it drops the lock whatever its hold count.
 type LockReleaseCommand struct {
+	Key        string
+	ClientID   string
+	OwnerToken string
+	Expired    bool
+}
+
+// LockForceReleaseCommand releases a lock on an operator's behalf regardless
+// of who holds it. Holder is filled in by the leader when proposing.
+type LockForceReleaseCommand struct {
+	Key      string
+	Operator string
+	Reason   string
+	Holder   string
+}
+
+type LockRenewCommand struct {
 	Key      string
 	ClientID string
+	TTL      time.Duration
 }
 
 type LockInfo struct {
-	Holder     string
-	ExpiryTime time.Time
+	Holder       string
+	SessionID    string
+	AcquiredAt   time.Time
+	ExpiryTime   time.Time
+	FencingToken FencingToken
+	Reentrant    bool
+	OwnerToken   string
+	HoldCount    int
+	Group        []string
+}
+
+type LockPolicyCommand struct {
+	Key    string
+	Policy LockPolicy
+}
+
+// LockAuditRecord is one entry of the replicated lock audit trail. Index,
+// Term and Time are those of the log entry that caused the event.
+type LockAuditRecord struct {
+	Index        uint64        `json:"index"`
+	Term         uint64        `json:"term"`
+	Time         time.Time     `json:"time"`
+	Event        string        `json:"event"`
+	Key          string        `json:"key"`
+	ClientID     string        `json:"clientId"`
+	SessionID    string        `json:"sessionId,omitempty"`
+	FencingToken uint64        `json:"fencingToken"`
+	AcquiredAt   time.Time     `json:"acquiredAt"`
+	ExpiryTime   time.Time     `json:"expiryTime"`
+	HeldFor      time.Duration `json:"heldFor,omitempty"`
+	Operator     string        `json:"operator,omitempty"`
+	Reason       string        `json:"reason,omitempty"`
+}
+
+// AuditQuery selects audit records; empty fields match everything.
+type AuditQuery struct {
+	Key      string
+	ClientID string
+	From     time.Time
+	To       time.Time
+	Limit    int
+}
+
+type ListLocks struct{}
+
+type DescribeLock struct {
+	Key string
+}
+
+type LockWaiter struct {
+	ClientID    string        `json:"clientId"`
+	Keys        []string      `json:"keys,omitempty"`
+	RequestID   string        `json:"requestId"`
+	Priority    int           `json:"priority"`
+	TTL         time.Duration `json:"ttl"`
+	TryAcquire  bool          `json:"tryAcquire"`
+	WaitTimeout time.Duration `json:"waitTimeout"`
+}
+
+type LockDescription struct {
+	Key          string       `json:"key"`
+	Policy       LockPolicy   `json:"policy"`
+	Held         bool         `json:"held"`
+	Holder       string       `json:"holder"`
+	AcquiredAt   time.Time    `json:"acquiredAt"`
+	ExpiryTime   time.Time    `json:"expiryTime"`
+	FencingToken uint64       `json:"fencingToken"`
+	Reentrant    bool         `json:"reentrant"`
+	OwnerToken   string       `json:"ownerToken,omitempty"`
+	HoldCount    int          `json:"holdCount"`
+	Group        []string     `json:"group,omitempty"`
+	Waiters      []LockWaiter `json:"waiters"`
 }
 
 type LockRequest struct {
 	CommandType LockCommandType
 	Key         string
+	Keys        []string
 	ClientID    string
 	TTL         time.Duration
+	TryAcquire  bool
+	WaitTimeout time.Duration
+	RequestID   string
+	SessionID   string
+	Reentrant   bool
+	OwnerToken  string
+	Priority    int
+	Seq         uint64 `json:"-"` // the client's sequence number, for dedup
+	AckedSeq    uint64 `json:"-"`
+	arrival     uint64 // the order in which the leader queued the request
+	queuedAt    time.Time
 }
 
-type LockAcquireReply struct {
-	Success      bool         `json:"success"`
+// Envelope wraps every message exchanged over the /ws connection. Replies
+// carry the RequestID of the request they answer; events carry none.
+// Seq numbers the client's requests and is kept when a request is resent, so
+// the cluster can apply it once. AckedSeq is the highest sequence number up to
+// which the client has the answer to every request.
+type Envelope struct {
+	Version   int             `json:"version"`
+	RequestID string          `json:"requestId,omitempty"`
+	Seq       uint64          `json:"seq,omitempty"`
+	AckedSeq  uint64          `json:"ackedSeq,omitempty"`
+	Type      MessageType     `json:"type"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+}
+
+type ErrorReply struct {
+	Message string `json:"message"`
+}
+
+type LockEvent struct {
+	Event        string       `json:"event"`
+	Key          string       `json:"key"`
 	FencingToken FencingToken `json:"fencingToken"`
 }
+
+type LockAcquireReply struct {
+	Success       bool           `json:"success"`
+	Key           string         `json:"key"`
+	Keys          []string       `json:"keys,omitempty"`
+	FencingToken  FencingToken   `json:"fencingToken"`
+	FencingTokens []FencingToken `json:"fencingTokens,omitempty"`
+	Reason        string         `json:"reason,omitempty"`
+}
+
+type LockReleaseReply struct {
+	Success bool     `json:"success"`
+	Key     string   `json:"key"`
+	Keys    []string `json:"keys,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+type LockRenewReply struct {
+	Success    bool      `json:"success"`
+	Key        string    `json:"key"`
+	ExpiryTime time.Time `json:"expiryTime"`
+	Reason     string    `json:"reason,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+type FencingTokenQuery struct {
+	Key string
+}
+
+type FencingTokenStatus struct {
+	Key    string `json:"key"`
+	Token  uint64 `json:"token"`
+	Issued bool   `json:"issued"`
+	Held   bool   `json:"held"`
+	Holder string `json:"holder"`
+}
+
+type FencingTokenValidation struct {
+	Key    string `json:"key"`
+	Token  uint64 `json:"token"`
+	Latest uint64 `json:"latest"`
+	Held   bool   `json:"held"`
+	Valid  bool   `json:"valid"`
+}
 type ConnectionRequest struct {
-	ClientID string `json:"clientID"`
+	ClientID   string        `json:"clientID"`
+	SessionID  string        `json:"sessionID,omitempty"`
+	SessionTTL time.Duration `json:"sessionTTL,omitempty"`
 }
 
 type ConnectionReply struct {
-	Success bool  `json:"success"`
-	Leader  int64 `json:"leader"`
+	Success    bool          `json:"success"`
+	Leader     int64         `json:"leader"`
+	SessionID  string        `json:"sessionID,omitempty"`
+	SessionTTL time.Duration `json:"sessionTTL,omitempty"`
+}
+
+// Session ties the locks a client holds to its liveness. It is kept alive by
+// heartbeats on the client's connection and expires TTL after the last one.
+type Session struct {
+	ID         string
+	ClientID   string
+	TTL        time.Duration
+	ExpiryTime time.Time
+}
+
+type SessionCreateCommand struct {
+	SessionID string
+	ClientID  string
+	TTL       time.Duration
+}
+
+type SessionKeepAliveCommand struct {
+	SessionID string
+}
+
+type SessionExpireCommand struct {
+	SessionID string
+}
+
+// Operations carried by barrier and latch messages
+const (
+	CoordinationArrive    string = "arrive"
+	CoordinationCreate    string = "create"
+	CoordinationCountDown string = "countdown"
+	CoordinationWait      string = "wait"
+)
+
+type CoordinationRequest struct {
+	Op      string `json:"op"`
+	Name    string `json:"name"`
+	Parties int    `json:"parties,omitempty"`
+	Count   int    `json:"count,omitempty"`
+}
+
+// CoordinationWaiter is a client blocked on a barrier or latch. RequestID is
+// the request its reply is sent under once it is released.
+type CoordinationWaiter struct {
+	ClientID  string
+	SessionID string
+	RequestID string
+}
+
+// Barrier trips once Parties clients have arrived, releasing all of them and
+// starting the next generation.
+type Barrier struct {
+	Name       string
+	Parties    int
+	Generation uint64
+	Arrived    []CoordinationWaiter
+}
+
+// Latch releases its waiters once Count has been counted down to zero. It
+// stays open until it is created again.
+type Latch struct {
+	Name    string
+	Count   int
+	Waiters []CoordinationWaiter
+}
+
+type BarrierArriveCommand struct {
+	Name    string
+	Parties int
+	Waiter  CoordinationWaiter
+}
+
+type LatchCreateCommand struct {
+	Name  string
+	Count int
+}
+
+type LatchCountDownCommand struct {
+	Name     string
+	ClientID string
+}
+
+type LatchWaitCommand struct {
+	Name   string
+	Waiter CoordinationWaiter
 }
 
+// Operations carried by queue messages
+const (
+	QueueEnqueue string = "enqueue"
+	QueueDequeue string = "dequeue"
+	QueueAck     string = "ack"
+	QueueNack    string = "nack"
+)
+
+type QueueRequest struct {
+	Op                string        `json:"op"`
+	Queue             string        `json:"queue"`
+	Payload           []byte        `json:"payload,omitempty"`
+	ItemID            uint64        `json:"itemId,omitempty"`
+	VisibilityTimeout time.Duration `json:"visibilityTimeout,omitempty"`
+}
+
+type QueueItem struct {
+	ID         uint64    `json:"id"`
+	Payload    []byte    `json:"payload"`
+	EnqueuedAt time.Time `json:"enqueuedAt"`
+	Deliveries int       `json:"deliveries"`
+}
+
+// QueueDelivery is an item handed to a consumer and hidden from others until
+// it is acknowledged or InvisibleUntil passes.
+type QueueDelivery struct {
+	Queue          string
+	Item           QueueItem
+	Consumer       string
+	InvisibleUntil time.Time
+}
+
+// WorkQueue holds the counters of a queue; its items are stored under keys
+// of their own. The ready items take the places in line from Head up to
+// Tail, so both ends are found without a scan: enqueued items join at Tail
+// and redelivered ones go back in front of Head.
+type WorkQueue struct {
+	Name     string
+	NextID   uint64
+	Head     uint64
+	Tail     uint64
+	InFlight int
+}
+
+// Queue commands carry the request they came from so that the leader can
+// answer it once the command is applied.
+type QueueEnqueueCommand struct {
+	Queue     string
+	Payload   []byte
+	Requester CoordinationWaiter
+}
+
+type QueueDequeueCommand struct {
+	Queue             string
+	VisibilityTimeout time.Duration
+	Requester         CoordinationWaiter
+}
+
+type QueueAckCommand struct {
+	Queue     string
+	ItemID    uint64
+	Requester CoordinationWaiter
+}
+
+type QueueNackCommand struct {
+	Queue     string
+	ItemID    uint64
+	Requester CoordinationWaiter
+}
+
+// QueueRedeliverCommand is proposed by the leader when a delivery's
+// visibility timeout runs out. Deliveries guards against redelivering an
+// item that has since been delivered again.
+type QueueRedeliverCommand struct {
+	Queue      string
+	ItemID     uint64
+	Deliveries int
+}
+
+type QueueReply struct {
+	Success bool       `json:"success"`
+	Queue   string     `json:"queue"`
+	ItemID  uint64     `json:"itemId,omitempty"`
+	Item    *QueueItem `json:"item,omitempty"`
+	Empty   bool       `json:"empty,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+type BarrierReply struct {
+	Success    bool   `json:"success"`
+	Name       string `json:"name"`
+	Generation uint64 `json:"generation"`
+	Error      string `json:"error,omitempty"`
+}
+
+type LatchReply struct {
+	Success bool   `json:"success"`
+	Name    string `json:"name"`
+	Error   string `json:"error,omitempty"`
+}
+
+type SessionKeepAliveReply struct {
+	Success    bool      `json:"success"`
+	SessionID  string    `json:"sessionID"`
+	ExpiryTime time.Time `json:"expiryTime"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Write sets Key to Value. A positive TTL makes the key expire that long
+// after the entry was created by the leader.
 type Write struct {
-	Key string
-	Val int
+	Key   string
+	Value []byte
+	TTL   time.Duration
+}
+
+// BatchWrite applies Writes in order as one log entry, so they all take
+// effect at the same revision.
+type BatchWrite struct {
+	Writes []Write
 }
 
+// BatchWriteResult is returned once a BatchWrite has been applied.
+type BatchWriteResult struct {
+	Revision uint64
+	Count    int
+}
+
+// Read reads Key as of Revision, or the latest value if Revision is 0.
 type Read struct {
+	Key      string
+	Revision uint64
+}
+
+// ReadReply is the result of a Read; Found is false if the key is not set.
+// Revision is the cluster revision the read was served at.
+type ReadReply struct {
+	Key            string
+	Value          []byte
+	Version        uint64
+	CreateRevision uint64
+	ModRevision    uint64
+	TTL            time.Duration // time left before the key expires, 0 if it does not
+	Found          bool
+	Revision       uint64
+}
+
+// RangeQuery reads the keys in [Start, End) in order, at most Limit of them.
+// An empty End means no upper bound. PageToken continues an earlier scan
+// from where its reply left off. A non-zero Revision reads the keys as they
+// were at that revision.
+type RangeQuery struct {
+	Start     string
+	End       string
+	Limit     int
+	PageToken string
+	Revision  uint64
+}
+
+type KVPair struct {
+	Key            string        `json:"key"`
+	Value          []byte        `json:"value"`
+	Version        uint64        `json:"version"`
+	CreateRevision uint64        `json:"createRevision"`
+	ModRevision    uint64        `json:"modRevision"`
+	TTL            time.Duration `json:"ttl,omitempty"`
+}
+
+// RangeReply holds one page of a scan; NextPageToken is empty on the last
+// page.
+type RangeReply struct {
+	KVs           []KVPair
+	NextPageToken string
+	Revision      uint64
+}
+
+// KVEntry is what the store keeps under a user key. Version counts the
+// writes to the key since it was last created, so it starts at 1.
+// CreateRevision and ModRevision are the cluster revisions of the write that
+// created the key and of the latest write. A key with an ExpiryTime is
+// treated as absent once it has passed, even before the leader's ExpireKeys
+// entry deletes it. Tombstone is only set in a key's history, for the
+// revision that deleted it.
+type KVEntry struct {
+	Value          []byte
+	Version        uint64
+	CreateRevision uint64
+	ModRevision    uint64
+	ExpiryTime     time.Time
+	Tombstone      bool
+}
+
+// Compact discards the history of user keys older than Revision, after
+// which reads at earlier revisions fail.
+type Compact struct {
+	Revision uint64
+}
+
+// CompactResult reports how many historical records a Compact removed.
+type CompactResult struct {
+	Revision uint64
+	Removed  int
+}
+
+// ExpireKeys is proposed by the leader to delete keys whose TTL has run
+// out. Keys written again since are left alone.
+type ExpireKeys struct {
+	Keys []string
+}
+
+type Delete struct {
 	Key string
 }
 
+// CompareAndSwap writes Value only if the key currently holds Expected, or
+// when CompareVersion is set, only if it is at ExpectedVersion (0 meaning the
+// key must not exist).
+type CompareAndSwap struct {
+	Key             string
+	Expected        []byte
+	ExpectedVersion uint64
+	CompareVersion  bool
+	Value           []byte
+}
+
+type PutIfAbsent struct {
+	Key   string
+	Value []byte
+}
+
+// ClientCommand is a client's command tagged with the sequence number of the
+// request that carried it. The state machine applies a sequence number once
+// and answers resends with the cached result.
+type ClientCommand struct {
+	ClientID string
+	Seq      uint64
+	AckedSeq uint64
+	Command  interface{}
+}
+
+// ClientRequests is a client's entry in the replicated dedup table. LastSeq
+// is the highest sequence number applied. The results of applied requests
+// above AckedSeq, which the client may still resend, are each kept under
+// their own key as a ClientResult.
+type ClientRequests struct {
+	LastSeq  uint64
+	AckedSeq uint64
+}
+
+// ClientResult is the result of one applied client request; Result is nil
+// for commands that have none.
+type ClientResult struct {
+	Result interface{}
+}
+
+// LockAcquireResult is cached for a granted acquire so that a resent request
+// gets the same fencing token instead of taking the lock again.
+type LockAcquireResult struct {
+	Key           string
+	FencingToken  FencingToken
+	Keys          []string // set instead of Key for a multi-key acquire
+	FencingTokens []FencingToken
+}
+
+// Increment adds Delta, which may be negative, to the integer counter stored
+// under Key as decimal text, creating it at 0. If Bounded, the increment is
+// refused when the new value would fall outside [Min, Max].
+type Increment struct {
+	Key     string
+	Delta   int64
+	Bounded bool
+	Min     int64
+	Max     int64
+}
+
+// IncrementResult is the outcome of an applied Increment. Value is the new
+// value, or the unchanged one if Success is false because the bounds check
+// failed. Error is set if the key holds something other than an integer.
+type IncrementResult struct {
+	Success bool
+	Key     string
+	Value   int64
+	Version uint64
+	Error   string
+}
+
+// KVResult is returned in AppendDataReply.Result once a Delete,
+// CompareAndSwap or PutIfAbsent has been applied. Previous and
+// PreviousVersion describe the key before the command ran.
+type KVResult struct {
+	Success         bool
+	Key             string
+	Previous        []byte
+	PreviousVersion uint64
+	Existed         bool
+	Version         uint64
+}
+
+// Operations carried by kv messages
+const (
+	KVPut         string = "put"
+	KVGet         string = "get"
+	KVDelete      string = "delete"
+	KVCas         string = "cas"
+	KVPutIfAbsent string = "putIfAbsent"
+	KVRange       string = "range"
+	KVPrefix      string = "prefix"
+	KVCompact     string = "compact"
+	KVIncrement   string = "increment"
+	KVBatchPut    string = "batchPut"
+)
+
+// Kinds of change reported to watchers
+const (
+	WatchEventPut    string = "PUT"
+	WatchEventDelete string = "DELETE"
+)
+
+// Operations carried by watch messages
+const (
+	WatchCreate string = "create"
+	WatchCancel string = "cancel"
+)
+
+// WatchEvent is a change to one key. Revision is the index of the log entry
+// that made it, so events sharing a revision were applied together.
+type WatchEvent struct {
+	Type     string `json:"type"`
+	Key      string `json:"key"`
+	Value    []byte `json:"value,omitempty"`
+	Version  uint64 `json:"version"`
+	Revision uint64 `json:"revision"`
+}
+
+// WatchRequest creates or cancels a watch on Key, or on every key starting
+// with Key if Prefix is set. A StartRevision replays the changes made since
+// that revision before streaming new ones. WatchID is chosen by the client.
+type WatchRequest struct {
+	Op            string `json:"op"`
+	WatchID       string `json:"watchId"`
+	Key           string `json:"key"`
+	Prefix        bool   `json:"prefix,omitempty"`
+	StartRevision uint64 `json:"startRevision,omitempty"`
+}
+
+// WatchReply answers a WatchRequest. Revision is the latest revision the
+// leader has applied changes for; CompactRevision is the newest revision no
+// longer kept for replay.
+type WatchReply struct {
+	Success         bool   `json:"success"`
+	WatchID         string `json:"watchId"`
+	Revision        uint64 `json:"revision"`
+	CompactRevision uint64 `json:"compactRevision"`
+	Error           string `json:"error,omitempty"`
+}
+
+// WatchResponse streams the matching events of one revision to a watch. A
+// Canceled response ends the watch on the server, which the client opens
+// again from the last revision it received.
+type WatchResponse struct {
+	WatchID  string       `json:"watchId"`
+	Revision uint64       `json:"revision"`
+	Events   []WatchEvent `json:"events"`
+	Canceled bool         `json:"canceled,omitempty"`
+	Error    string       `json:"error,omitempty"`
+}
+
+// What a transaction comparison looks at
+const (
+	TxnTargetValue   string = "value"
+	TxnTargetVersion string = "version"
+)
+
+// How a transaction comparison relates the key to the expected value
+const (
+	TxnEqual    string = "="
+	TxnNotEqual string = "!="
+	TxnLess     string = "<"
+	TxnGreater  string = ">"
+)
+
+// TxnCompare checks the current value or version of a key. A key that is not
+// set compares as an empty value at version 0.
+type TxnCompare struct {
+	Key     string `json:"key"`
+	Target  string `json:"target"`
+	Result  string `json:"result"`
+	Value   []byte `json:"value,omitempty"`
+	Version uint64 `json:"version,omitempty"`
+}
+
+// TxnOp is a put, get or delete run as part of a transaction.
+type TxnOp struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value []byte `json:"value,omitempty"`
+}
+
+// Txn runs Success if every comparison in Compare holds and Failure
+// otherwise, all as a single log entry.
+type Txn struct {
+	Compare []TxnCompare `json:"compare"`
+	Success []TxnOp      `json:"success"`
+	Failure []TxnOp      `json:"failure"`
+}
+
+// TxnOpResult is the outcome of one operation of a transaction; for a get,
+// Value and Version are what was read, for a put, Version is the new version
+// and for a delete, Found reports whether there was anything to delete.
+type TxnOpResult struct {
+	Op      string `json:"op"`
+	Key     string `json:"key"`
+	Value   []byte `json:"value,omitempty"`
+	Version uint64 `json:"version,omitempty"`
+	Found   bool   `json:"found"`
+}
+
+type TxnResult struct {
+	Succeeded bool          `json:"succeeded"`
+	Results   []TxnOpResult `json:"results"`
+}
+
+type TxnReply struct {
+	Success   bool          `json:"success"`
+	Succeeded bool          `json:"succeeded"`
+	Results   []TxnOpResult `json:"results"`
+	Error     string        `json:"error,omitempty"`
+}
+
+type KVRequest struct {
+	Op              string        `json:"op"`
+	Key             string        `json:"key"`
+	Value           []byte        `json:"value,omitempty"`
+	TTL             time.Duration `json:"ttl,omitempty"`
+	Expected        []byte        `json:"expected,omitempty"`
+	ExpectedVersion uint64        `json:"expectedVersion,omitempty"`
+	CompareVersion  bool          `json:"compareVersion,omitempty"`
+	End             string        `json:"end,omitempty"`
+	Limit           int           `json:"limit,omitempty"`
+	PageToken       string        `json:"pageToken,omitempty"`
+	Revision        uint64        `json:"revision,omitempty"`
+	Delta           int64         `json:"delta,omitempty"`
+	Bounded         bool          `json:"bounded,omitempty"`
+	Min             int64         `json:"min,omitempty"`
+	Max             int64         `json:"max,omitempty"`
+	KVs             []KVPair      `json:"kvs,omitempty"`
+}
+
+type KVReply struct {
+	Success         bool          `json:"success"`
+	Key             string        `json:"key"`
+	Value           []byte        `json:"value,omitempty"`
+	Version         uint64        `json:"version,omitempty"`
+	CreateRevision  uint64        `json:"createRevision,omitempty"`
+	ModRevision     uint64        `json:"modRevision,omitempty"`
+	TTL             time.Duration `json:"ttl,omitempty"`
+	Found           bool          `json:"found"`
+	Previous        []byte        `json:"previous,omitempty"`
+	PreviousVersion uint64        `json:"previousVersion,omitempty"`
+	KVs             []KVPair      `json:"kvs,omitempty"`
+	NextPageToken   string        `json:"nextPageToken,omitempty"`
+	Revision        uint64        `json:"revision,omitempty"`
+	Counter         int64         `json:"counter,omitempty"`
+	Error           string        `json:"error,omitempty"`
+}
+
 type AddServer struct {
 	ServerId uint64
 	Addr     string
@@ -94,11 +970,15 @@ type CommitEntry struct {
 	Command interface{}
 	Term    uint64
 	Index   uint64
+	Time    time.Time
 }
 
+// Time is when the leader accepted the command, so every replica applying
+// the entry sees the same timestamp.
 type LogEntry struct {
 	Command interface{}
 	Term    uint64
+	Time    time.Time
 }
 
 type Server struct {
@@ -122,6 +1002,7 @@ type Server struct {
 type Node struct {
 	id                            uint64
 	mu                            sync.Mutex
+	persistMu                     sync.Mutex // orders writes of raft state; taken after mu
 	peerList                      Set
 	server                        *Server
 	db                            *Database
@@ -132,15 +1013,34 @@ type Node struct {
 	potentialLeader               int64
 	votedFor                      int64
 	log                           []LogEntry
+	persistedLength               uint64 // prefix of log known to be stored
 	commitLength                  uint64
 	lastApplied                   uint64
 	state                         NodeState
 	electionResetEvent            time.Time
-	nextIndex                     map[uint64]uint64
-	matchedIndex                  map[uint64]uint64
+	progress                      map[uint64]*Progress
+	appendStreams                 map[uint64]*appendStream
+	logAppended                   *sync.Cond // broadcast when a follower's log grows
+	replication                   ReplicationConfig
 	activeLockExpiryMonitorCancel map[string]context.CancelFunc
+	activeSessionMonitorCancel    map[string]context.CancelFunc
+	activeQueueMonitorCancel      map[string]context.CancelFunc
 	pendingLockQueue              map[string]*[]LockRequest
 	pullLockRequestChan           map[string](chan struct{})
+	grantingLocks                 map[string]struct{}
+	lockGrantCounts               map[string]map[string]int
+	lockArrivals                  uint64
+	kvResultWaiters               map[uint64]kvResultWaiter
+	kvEvents                      []WatchEvent // only touched by applyLogEntry
+	watchMu                       sync.Mutex
+	watchers                      map[string]*watcher
+	watchRevision                 uint64
+	watchCompactRevision          uint64
+	kvExpiry                      kvExpiryHeap
+	kvExpiryWake                  chan struct{}
+	kvExpiryCancel                context.CancelFunc
+	applying                      CommitEntry // only touched by applyLogEntry
+	auditSeq                      int
 }
 
 type RequestVoteArgs struct {
@@ -219,6 +1119,6 @@ type AppendDataReply struct {
 	Result   struct {
 		Success bool
 		Value   interface{}
-		Error   error
+		Error   string // an error interface does not survive gob encoding
 	}
 }
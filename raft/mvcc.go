@@ -0,0 +1,173 @@
+package raft
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The cluster revision is the index of the last applied log entry. Every
+// write to a user key is also kept in the key's history, stored under
+// HISTORY_<key>\x00<revision> so that a key's records sort by revision and
+// keys sort as they do in the store. The history serves reads at past
+// revisions until a Compact discards it.
+
+func historyPrefix(key string) string {
+	return fmt.Sprintf("%s%s\x00", KV_HISTORY_PREFIX, key)
+}
+
+func historyKey(key string, revision uint64) string {
+	return fmt.Sprintf("%s%020d", historyPrefix(key), revision)
+}
+
+func parseHistoryKey(storageKey string) (string, uint64, bool) {
+	storageKey = strings.TrimPrefix(storageKey, KV_HISTORY_PREFIX)
+	i := strings.LastIndexByte(storageKey, 0)
+	if i < 0 {
+		return "", 0, false
+	}
+	revision, err := strconv.ParseUint(storageKey[i+1:], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return storageKey[:i], revision, true
+}
+
+func (node *Node) currentRevision() uint64 {
+	var revision uint64
+	node.readFromStorage(CLUSTER_REVISION_KEY, &revision)
+	return revision
+}
+
+func (node *Node) compactedRevision() uint64 {
+	var revision uint64
+	node.readFromStorage(COMPACTED_REVISION_KEY, &revision)
+	return revision
+}
+
+func (node *Node) recordKVHistory(key string, entry KVEntry) {
+	node.setData(historyKey(key, entry.ModRevision), entry)
+}
+
+// checkRevision fails if reads at revision cannot be served, because its
+// history has been compacted or it has not been reached yet.
+func (node *Node) checkRevision(revision uint64) error {
+	if compacted := node.compactedRevision(); revision < compacted {
+		return fmt.Errorf("revision %d has been compacted, the oldest readable revision is %d", revision, compacted)
+	}
+	if current := node.currentRevision(); revision > current {
+		return fmt.Errorf("revision %d is ahead of the current revision %d", revision, current)
+	}
+	return nil
+}
+
+// readKVAtRevision returns the entry key held as of revision. Expiry is not
+// applied: an expired key is only gone from the revision its ExpireKeys
+// entry was applied at.
+func (node *Node) readKVAtRevision(key string, revision uint64) (KVEntry, bool) {
+	record, found := node.db.Last(historyPrefix(key), historyKey(key, revision+1))
+	if !found {
+		return KVEntry{}, false
+	}
+	var entry KVEntry
+	if found, _ := node.readFromStorage(record.Key, &entry); !found || entry.Tombstone {
+		return KVEntry{}, false
+	}
+	return entry, true
+}
+
+// rangeKVAtRevision reads one page of the keys in [start, end) as they were
+// at revision. It seeks from one key's history to the next, reading only the
+// record each key had at revision, and stops once the page is full.
+func (node *Node) rangeKVAtRevision(start string, end string, limit int, revision uint64) RangeReply {
+	historyEnd := prefixEnd(KV_HISTORY_PREFIX)
+	if end != "" {
+		historyEnd = KV_HISTORY_PREFIX + end
+	}
+	reply := RangeReply{KVs: []KVPair{}, Revision: revision}
+	cursor := KV_HISTORY_PREFIX + start
+	for {
+		records := node.db.Range(cursor, historyEnd, 1)
+		if len(records) == 0 {
+			return reply
+		}
+		key, _, ok := parseHistoryKey(records[0].Key)
+		if !ok {
+			cursor = records[0].Key + "\x00"
+			continue
+		}
+		cursor = prefixEnd(historyPrefix(key))
+		entry, found := node.readKVAtRevision(key, revision)
+		if !found {
+			continue
+		}
+		if len(reply.KVs) == limit {
+			reply.NextPageToken = base64.RawURLEncoding.EncodeToString([]byte(key))
+			return reply
+		}
+		reply.KVs = append(reply.KVs, KVPair{
+			Key:            key,
+			Value:          entry.Value,
+			Version:        entry.Version,
+			CreateRevision: entry.CreateRevision,
+			ModRevision:    entry.ModRevision,
+		})
+	}
+}
+
+func (node *Node) validateCompact(cmd Compact) error {
+	if compacted := node.compactedRevision(); cmd.Revision <= compacted {
+		return fmt.Errorf("revision %d has already been compacted", cmd.Revision)
+	}
+	if current := node.currentRevision(); cmd.Revision > current {
+		return fmt.Errorf("revision %d is ahead of the current revision %d", cmd.Revision, current)
+	}
+	return nil
+}
+
+// applyCompact drops every history record older than the revision, keeping
+// for each key its newest record at or below it so reads at the revision
+// still see the key. That record is dropped too if it is a deletion. The
+// watch events up to the revision go with it, so a watch cannot replay
+// changes that reads no longer serve.
+func (node *Node) applyCompact(cmd Compact) CompactResult {
+	result := CompactResult{Revision: node.compactedRevision()}
+	if cmd.Revision <= result.Revision {
+		return result
+	}
+	var key string
+	var older []string
+	flush := func() {
+		if len(older) == 0 {
+			return
+		}
+		drop := older[:len(older)-1]
+		var newest KVEntry
+		if found, _ := node.readFromStorage(older[len(older)-1], &newest); found && newest.Tombstone {
+			drop = older
+		}
+		for _, storageKey := range drop {
+			node.db.Delete(storageKey)
+		}
+		result.Removed += len(drop)
+	}
+	for _, record := range node.db.Range(KV_HISTORY_PREFIX, prefixEnd(KV_HISTORY_PREFIX), 0) {
+		recordKey, recordRevision, ok := parseHistoryKey(record.Key)
+		if !ok {
+			continue
+		}
+		if recordKey != key {
+			flush()
+			key, older = recordKey, older[:0]
+		}
+		if recordRevision <= cmd.Revision {
+			older = append(older, record.Key)
+		}
+	}
+	flush()
+	node.compactWatchEvents(cmd.Revision)
+	node.setData(COMPACTED_REVISION_KEY, cmd.Revision)
+	result.Revision = cmd.Revision
+	return result
+}
@@ -0,0 +1,121 @@
+package raft
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// describeKVs renders a page of a range as "key=value", in order.
+func describeKVs(kvs []KVPair) string {
+	described := make([]string, 0, len(kvs))
+	for _, kv := range kvs {
+		described = append(described, fmt.Sprintf("%s=%s", kv.Key, kv.Value))
+	}
+	return strings.Join(described, ", ")
+}
+
+// Reads at a revision see the keys as they were then, page by page, until a
+// compaction past the revision makes them fail; reads at or after the
+// compacted revision keep working.
+func TestReadsAtRevision(t *testing.T) {
+	leader := startCluster(t, 3)[0]
+	var revisions []uint64
+	write := func(key string, value string) {
+		t.Helper()
+		reply, err := GetVersionedData(leader, key)
+		if err != nil {
+			t.Fatalf("reading %s: %v", key, err)
+		}
+		if result, err := CompareVersionAndSwapData(leader, key, reply.Version, []byte(value)); err != nil || !result.Success {
+			t.Fatalf("writing %s=%s: %+v, %v", key, value, result, err)
+		}
+		reply, _ = GetVersionedData(leader, key)
+		revisions = append(revisions, reply.ModRevision)
+	}
+	write("m/a", "1") // revisions[0]
+	write("m/b", "1") // revisions[1]
+	write("m/a", "2") // revisions[2]
+	write("m/c", "1") // revisions[3]
+	if _, err := DeleteData(leader, "m/b"); err != nil {
+		t.Fatalf("deleting m/b: %v", err)
+	}
+	write("m/a", "3") // revisions[4]
+
+	type read struct {
+		revision int // index into revisions
+		key      string
+		want     string // "-" if the key is not found, "error" if the read fails
+	}
+	type scan struct {
+		revision int
+		pages    []string // the pages of a range of m/ one key at a time
+	}
+	checkReads := func(when string, reads []read, scans []scan) {
+		t.Helper()
+		for _, r := range reads {
+			reply, err := GetDataAtRevision(leader, r.key, revisions[r.revision])
+			got := string(reply.Value)
+			switch {
+			case err != nil:
+				got = "error"
+			case !reply.Found:
+				got = "-"
+			}
+			if got != r.want {
+				t.Errorf("%s: %s at revision %d is %q, want %q (%v)", when, r.key, revisions[r.revision], got, r.want, err)
+			}
+		}
+		for _, s := range scans {
+			var pages []string
+			var token string
+			for {
+				reply, err := RangeDataAtRevision(leader, "m/", prefixEnd("m/"), 1, token, revisions[s.revision])
+				if err != nil {
+					pages = append(pages, "error")
+					break
+				}
+				pages = append(pages, describeKVs(reply.KVs))
+				if token = reply.NextPageToken; token == "" {
+					break
+				}
+			}
+			if got, want := strings.Join(pages, "; "), strings.Join(s.pages, "; "); got != want {
+				t.Errorf("%s: range at revision %d paged %q, want %q", when, revisions[s.revision], got, want)
+			}
+		}
+	}
+
+	checkReads("before compacting", []read{
+		{0, "m/a", "1"},
+		{0, "m/b", "-"},
+		{2, "m/a", "2"},
+		{2, "m/b", "1"},
+		{3, "m/b", "1"},
+		{4, "m/b", "-"},
+		{4, "m/a", "3"},
+	}, []scan{
+		{1, []string{"m/a=1", "m/b=1"}},
+		{3, []string{"m/a=2", "m/b=1", "m/c=1"}},
+		{4, []string{"m/a=3", "m/c=1"}},
+	})
+
+	if _, err := CompactData(leader, revisions[2]); err != nil {
+		t.Fatalf("compacting: %v", err)
+	}
+	checkReads("after compacting", []read{
+		{0, "m/a", "error"},
+		{1, "m/b", "error"},
+		{2, "m/a", "2"},
+		{2, "m/b", "1"},
+		{3, "m/c", "1"},
+		{4, "m/a", "3"},
+	}, []scan{
+		{1, []string{"error"}},
+		{2, []string{"m/a=2", "m/b=1"}},
+		{4, []string{"m/a=3", "m/c=1"}},
+	})
+	if _, err := CompactData(leader, revisions[1]); err == nil {
+		t.Error("compacting to a revision already compacted succeeded")
+	}
+}
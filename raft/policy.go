@@ -0,0 +1,105 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+func lockPolicyKey(key string) string {
+	return fmt.Sprintf("%s%s", LOCK_POLICY_PREFIX, key)
+}
+
+func parseLockPolicy(policy string) (LockPolicy, error) {
+	switch LockPolicy(policy) {
+	case LockPolicyFIFO, LockPolicyPriority, LockPolicyFairShare:
+		return LockPolicy(policy), nil
+	}
+	return "", fmt.Errorf("unknown lock policy %q", policy)
+}
+
+func (node *Node) lockPolicy(key string) LockPolicy {
+	var policy LockPolicy
+	if found, _ := node.readFromStorage(lockPolicyKey(key), &policy); found {
+		return policy
+	}
+	return LockPolicyFIFO
+}
+
+// SetLockPolicy changes how waiters on key are served from now on.
+func (server *Server) SetLockPolicy(key string, policy string) error {
+	lockPolicy, err := parseLockPolicy(policy)
+	if err != nil {
+		return err
+	}
+	success, _, err := server.SubmitToServer(LockPolicyCommand{Key: key, Policy: lockPolicy})
+	if err != nil {
+		return err
+	}
+	if !success {
+		return errors.New("lock policy could not be submitted, try different server(leader)")
+	}
+	return nil
+}
+
+func (node *Node) applyLockPolicy(cmd LockPolicyCommand) {
+	if cmd.Policy == LockPolicyFIFO {
+		node.db.Delete(lockPolicyKey(cmd.Key))
+	} else {
+		node.setData(lockPolicyKey(cmd.Key), cmd.Policy)
+	}
+	fmt.Printf("Lock %s now serves waiters by %s\n", cmd.Key, cmd.Policy)
+	node.mu.Lock()
+	if node.state == Leader {
+		node.pingLockQueue(cmd.Key)
+	}
+	node.mu.Unlock()
+}
+
+// selectLockRequest returns the index of the waiter to serve next on key
+// under the lock's policy. Ties are always broken in arrival order.
+// expects node.mu to be held
+func (node *Node) selectLockRequest(key string) int {
+	queue := *node.pendingLockQueue[key]
+	next := 0
+	switch node.lockPolicy(key) {
+	case LockPolicyPriority:
+		now := time.Now()
+		for i := range queue {
+			if effectiveLockPriority(queue[i], now) > effectiveLockPriority(queue[next], now) {
+				next = i
+			}
+		}
+	case LockPolicyFairShare:
+		// the queue is in arrival order, so if anyone has waited too long
+		// the first waiter has
+		if time.Since(queue[0].queuedAt) >= LOCK_FAIR_SHARE_MAX_WAIT {
+			return 0
+		}
+		grants := node.lockGrantCounts[key]
+		for i := range queue {
+			if grants[queue[i].ClientID] < grants[queue[next].ClientID] {
+				next = i
+			}
+		}
+	}
+	return next
+}
+
+// effectiveLockPriority ages a waiter's priority by the time it has spent in
+// the queue.
+func effectiveLockPriority(req LockRequest, now time.Time) int {
+	return req.Priority + int(now.Sub(req.queuedAt)/LOCK_PRIORITY_AGING_INTERVAL)
+}
+
+// countLockGrant records that key was handed to clientID, for the fair-share
+// policy. The counts only live on the leader and restart with each term.
+// expects node.mu to be held
+func (node *Node) countLockGrant(key string, clientID string) {
+	grants, exists := node.lockGrantCounts[key]
+	if !exists {
+		grants = make(map[string]int)
+		node.lockGrantCounts[key] = grants
+	}
+	grants[clientID]++
+}
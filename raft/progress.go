@@ -0,0 +1,278 @@
+package raft
+
+import "errors"
+
+// The leader tracks replication to each follower with a Progress, after
+// etcd/raft. A follower in the probe state is sent one AppendEntries at a
+// time until one succeeds and shows where its log matches the leader's. In
+// the replicate state entries are streamed optimistically: Next moves past
+// each batch as it is sent, and up to MaxInflightAppends batches may await a
+// reply. A rejection drops the follower back to probing.
+
+type ProgressState int
+
+const (
+	ProgressProbe ProgressState = iota
+	ProgressReplicate
+)
+
+func (state ProgressState) String() string {
+	if state == ProgressReplicate {
+		return "replicate"
+	}
+	return "probe"
+}
+
+type Progress struct {
+	State     ProgressState
+	Match     uint64 // highest index known to be replicated on the follower
+	Next      uint64 // index of the next entry to send
+	Inflight  int    // AppendEntries sent while replicating and not yet answered
+	ProbeSent bool   // the probe is awaiting a reply
+	// generation changes with the state, so replies to requests sent
+	// before do not free slots of the new state
+	generation uint64
+	sentCommit uint64 // LeaderCommit last sent to the follower
+}
+
+type appendKind int
+
+const (
+	appendProbe appendKind = iota
+	appendReplicate
+	appendHeartbeat // carries no entries and is not flow controlled
+)
+
+type appendRequest struct {
+	args       AppendEntriesArgs
+	kind       appendKind
+	generation uint64
+}
+
+func newProgress(next uint64) *Progress {
+	return &Progress{State: ProgressProbe, Next: next}
+}
+
+func (pr *Progress) paused(config ReplicationConfig) bool {
+	if pr.State == ProgressProbe {
+		return pr.ProbeSent
+	}
+	return pr.Inflight >= config.MaxInflightAppends
+}
+
+func (pr *Progress) becomeProbe(next uint64) {
+	pr.State = ProgressProbe
+	pr.Next = next
+	if pr.Next <= pr.Match {
+		pr.Next = pr.Match + 1
+	}
+	pr.ProbeSent = false
+	pr.Inflight = 0
+	pr.generation++
+}
+
+func (pr *Progress) becomeReplicate() {
+	pr.State = ProgressReplicate
+	pr.Next = pr.Match + 1
+	pr.ProbeSent = false
+	pr.Inflight = 0
+	pr.generation++
+}
+
+// release frees the slot request held, unless the state has changed since
+// it was sent.
+func (pr *Progress) release(request appendRequest) {
+	if request.generation != pr.generation {
+		return
+	}
+	switch request.kind {
+	case appendProbe:
+		pr.ProbeSent = false
+	case appendReplicate:
+		if pr.Inflight > 0 {
+			pr.Inflight--
+		}
+	}
+}
+
+// progressOf returns the progress of peer, starting it at the end of the log
+// if the peer is new. node.mu must be held.
+func (node *Node) progressOf(peer uint64) *Progress {
+	pr, exists := node.progress[peer]
+	if !exists {
+		pr = newProgress(uint64(len(node.log)) + 1)
+		node.progress[peer] = pr
+	}
+	return pr
+}
+
+// appendRequests builds the AppendEntries to send peer this round and marks
+// them sent. A paused or caught up peer is sent a heartbeat on heartbeat
+// rounds or when the commit index has moved. node.mu must be held.
+func (node *Node) appendRequests(peer uint64, heartbeat bool) []appendRequest {
+	pr := node.progressOf(peer)
+	var requests []appendRequest
+	for !pr.paused(node.replication) {
+		if pr.State == ProgressReplicate && pr.Next > node.persistedLength {
+			break
+		}
+		entries := node.appendBatch(pr.Next - 1)
+		request := appendRequest{args: node.appendEntriesArgs(pr.Next-1, entries), generation: pr.generation}
+		if pr.State == ProgressProbe {
+			request.kind = appendProbe
+			pr.ProbeSent = true
+		} else {
+			request.kind = appendReplicate
+			pr.Inflight++
+			pr.Next += uint64(len(entries))
+		}
+		requests = append(requests, request)
+		if pr.State == ProgressProbe {
+			break
+		}
+	}
+	if len(requests) == 0 && (heartbeat || node.commitLength > pr.sentCommit) {
+		// the follower is known to hold everything up to Match
+		requests = append(requests, appendRequest{args: node.appendEntriesArgs(pr.Match, nil), kind: appendHeartbeat})
+	}
+	if len(requests) > 0 {
+		pr.sentCommit = node.commitLength
+	}
+	return requests
+}
+
+// appendBatch returns the stored entries after index prev, up to the
+// replication limits. node.mu must be held.
+func (node *Node) appendBatch(prev uint64) []LogEntry {
+	last, size := prev, 0
+	for last < node.persistedLength && last-prev < uint64(node.replication.MaxEntriesPerAppend) {
+		value, _ := node.db.Get(logEntryKey(last + 1))
+		if last > prev && size+len(value) > node.replication.MaxBytesPerAppend {
+			break
+		}
+		size += len(value)
+		last++
+	}
+	return node.log[prev:last]
+}
+
+func (node *Node) appendEntriesArgs(prev uint64, entries []LogEntry) AppendEntriesArgs {
+	prevTerm := uint64(0)
+	if prev > 0 {
+		prevTerm = node.log[prev-1].Term
+	}
+	return AppendEntriesArgs{
+		Term:         node.currentTerm,
+		LeaderId:     node.id,
+		LastLogIndex: prev,
+		LastLogTerm:  prevTerm,
+		Entries:      entries,
+		LeaderCommit: node.commitLength,
+	}
+}
+
+// handleAppendEntriesReply updates the progress of peer with the answer to
+// request and advances the commit index. node.mu must be held.
+func (node *Node) handleAppendEntriesReply(peer uint64, request appendRequest, reply AppendEntriesReply) {
+	pr, exists := node.progress[peer]
+	if !exists {
+		return
+	}
+	pr.release(request)
+	last := request.args.LastLogIndex + uint64(len(request.args.Entries))
+	if !reply.Success {
+		if request.kind == appendHeartbeat || request.args.LastLogIndex < pr.Match {
+			return
+		}
+		if pr.State == ProgressProbe && request.args.LastLogIndex != pr.Next-1 {
+			return // answers an earlier probe
+		}
+		pr.becomeProbe(node.recoveryIndex(reply))
+		node.triggerRound()
+		return
+	}
+	if last > pr.Match {
+		pr.Match = last
+	}
+	if pr.Next <= pr.Match {
+		pr.Next = pr.Match + 1
+	}
+	if pr.State == ProgressProbe && request.kind != appendHeartbeat {
+		pr.becomeReplicate()
+	}
+	node.advanceCommit()
+	if pr.Next <= node.persistedLength {
+		node.triggerRound()
+	}
+}
+
+// recoveryIndex is where to resume sending to a follower that rejected an
+// AppendEntries: after the leader's last entry of the conflicting term, or
+// at the follower's hint if the leader has none.
+func (node *Node) recoveryIndex(reply AppendEntriesReply) uint64 {
+	if reply.RecoveryTerm != 0 {
+		for i := uint64(len(node.log)); i > 0; i-- {
+			if node.log[i-1].Term == reply.RecoveryTerm {
+				return i + 1
+			}
+		}
+	}
+	return reply.RecoveryIndex
+}
+
+// advanceCommit commits the entries of the current term stored on a
+// majority. node.mu must be held.
+func (node *Node) advanceCommit() {
+	commitLengthSaved := node.commitLength
+	for i := commitLengthSaved + 1; i <= node.persistedLength; i++ {
+		if node.log[i-1].Term != node.currentTerm {
+			continue
+		}
+		matchCount := 1
+		for p := range node.peerList.peerSet {
+			if pr, exists := node.progress[p]; exists && pr.Match >= i {
+				matchCount++
+			}
+		}
+		if matchCount*2 > node.peerList.Size()+1 {
+			node.commitLength = i
+		}
+	}
+	if commitLengthSaved != node.commitLength {
+		node.signalCommit()
+		node.triggerRound()
+	}
+}
+
+// SetReplicationConfig changes the limits on AppendEntries sent by this
+// node while it leads. They apply from the next round.
+func (server *Server) SetReplicationConfig(config ReplicationConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	server.node.mu.Lock()
+	defer server.node.mu.Unlock()
+	server.node.replication = config
+	return nil
+}
+
+func (server *Server) GetReplicationConfig() ReplicationConfig {
+	server.node.mu.Lock()
+	defer server.node.mu.Unlock()
+	return server.node.replication
+}
+
+// ReplicationStatus returns the progress of every follower, which is only
+// tracked while this node leads.
+func (server *Server) ReplicationStatus() (map[uint64]Progress, error) {
+	server.node.mu.Lock()
+	defer server.node.mu.Unlock()
+	if server.node.state != Leader {
+		return nil, errors.New("replication progress is only tracked by the leader")
+	}
+	status := make(map[uint64]Progress, server.node.peerList.Size())
+	for peer := range server.node.peerList.peerSet {
+		status[peer] = *server.node.progressOf(peer)
+	}
+	return status, nil
+}
@@ -0,0 +1,79 @@
+package raft
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Pipelined batches must reach a follower in order: one that overtook its
+// predecessor would be rejected and send the follower back to probing.
+func TestPipelinedFollowersStayReplicating(t *testing.T) {
+	servers := startCluster(t, 3)
+	leader, held := servers[0], servers[1]
+	config := ReplicationConfig{MaxEntriesPerAppend: 1, MaxBytesPerAppend: 1 << 20, MaxInflightAppends: 4}
+	if err := leader.SetReplicationConfig(config); err != nil {
+		t.Fatal(err)
+	}
+
+	progressOf := func(peer uint64) Progress {
+		leader.node.mu.Lock()
+		defer leader.node.mu.Unlock()
+		return *leader.node.progress[peer]
+	}
+	before := progressOf(held.id)
+
+	// with its handler held on node.mu the follower answers nothing, while
+	// the other follower lets entries commit, so the leader must fill the
+	// window to the held follower and stop there. The window is polled here
+	// rather than with waitFor so the follower is released before failing.
+	held.node.mu.Lock()
+	for i := 0; i < 4*config.MaxInflightAppends; i++ {
+		key := fmt.Sprintf("pipeline/%04d", i)
+		if err := SetData(leader, key, []byte("v")); err != nil {
+			held.node.mu.Unlock()
+			t.Fatalf("writing %s: %v", key, err)
+		}
+	}
+	filled := false
+	deadline := time.Now().Add(5 * time.Second)
+	for !filled && time.Now().Before(deadline) {
+		filled = progressOf(held.id).Inflight == config.MaxInflightAppends
+		time.Sleep(10 * time.Millisecond)
+	}
+	pr := progressOf(held.id)
+	held.node.mu.Unlock()
+	if !filled {
+		t.Fatalf("%d AppendEntries are in flight to the held follower, want the window of %d filled", pr.Inflight, config.MaxInflightAppends)
+	}
+	if pr.State != ProgressReplicate || pr.generation != before.generation {
+		t.Fatalf("held follower is %s after %d state changes, want it replicating throughout", pr.State, pr.generation-before.generation)
+	}
+
+	leader.node.mu.Lock()
+	length := uint64(len(leader.node.log))
+	leader.node.mu.Unlock()
+	waitFor(t, 5*time.Second, "the held follower to catch up", func() bool {
+		return progressOf(held.id).Match >= length
+	})
+	if after := progressOf(held.id); after.State != ProgressReplicate || after.generation != before.generation {
+		t.Errorf("held follower is %s after %d state changes, want the released batches accepted in order", after.State, after.generation-before.generation)
+	}
+}
+
+func TestQueuedHeartbeatsCollapse(t *testing.T) {
+	stream := &appendStream{wake: make(chan struct{}, 1)}
+	heartbeat := func(commit uint64) appendRequest {
+		return appendRequest{args: AppendEntriesArgs{LeaderCommit: commit}, kind: appendHeartbeat}
+	}
+	stream.push([]appendRequest{{kind: appendReplicate}})
+	for commit := uint64(1); commit <= 100; commit++ {
+		stream.push([]appendRequest{heartbeat(commit)})
+	}
+	if len(stream.queued) != 2 {
+		t.Fatalf("%d requests queued behind a stalled stream, want the batch and one heartbeat", len(stream.queued))
+	}
+	if last := stream.queued[1]; last.kind != appendHeartbeat || last.args.LeaderCommit != 100 {
+		t.Errorf("queued heartbeat carries commit %d, want the latest", last.args.LeaderCommit)
+	}
+}
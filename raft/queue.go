@@ -0,0 +1,252 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Places in line start in the middle of the range so that redelivered items
+// can always be put back in front.
+const queueStartPosition uint64 = 1 << 62
+
+func queueKey(name string) string {
+	return fmt.Sprintf("%s%s", QUEUE_KEY_PREFIX, name)
+}
+
+// queueReadyKey stores the ready item at position in line; NUL cannot occur
+// in a queue name, so the items of one queue sort together and in order.
+func queueReadyKey(name string, position uint64) string {
+	return fmt.Sprintf("%s%s\x00%020d", QUEUE_READY_PREFIX, name, position)
+}
+
+func queueInFlightKey(name string, itemID uint64) string {
+	return fmt.Sprintf("%s%s\x00%020d", QUEUE_DELIVERY_PREFIX, name, itemID)
+}
+
+func queueDeliveryKey(name string, itemID uint64) string {
+	return fmt.Sprintf("%s/%d", name, itemID)
+}
+
+func (node *Node) getQueue(name string) WorkQueue {
+	queue := WorkQueue{Name: name, Head: queueStartPosition, Tail: queueStartPosition}
+	node.readFromStorage(queueKey(name), &queue)
+	return queue
+}
+
+func (queue WorkQueue) size() int {
+	return int(queue.Tail-queue.Head) + queue.InFlight
+}
+
+// getDelivery returns the delivery of item itemID if it is delivered to
+// consumer.
+func (node *Node) getDelivery(name string, itemID uint64, consumer string) (QueueDelivery, error) {
+	var delivery QueueDelivery
+	if found, _ := node.readFromStorage(queueInFlightKey(name, itemID), &delivery); !found || delivery.Consumer != consumer {
+		return QueueDelivery{}, fmt.Errorf("item %d of queue %s is not delivered to %s", itemID, name, consumer)
+	}
+	return delivery, nil
+}
+
+// takeInFlight removes the delivery of an item, putting the item back at the
+// front of the queue if requeue is set.
+func (node *Node) takeInFlight(queue *WorkQueue, delivery QueueDelivery, requeue bool) {
+	node.db.Delete(queueInFlightKey(queue.Name, delivery.Item.ID))
+	queue.InFlight--
+	if requeue {
+		queue.Head--
+		node.setData(queueReadyKey(queue.Name, queue.Head), delivery.Item)
+	}
+	node.setData(queueKey(queue.Name), *queue)
+}
+
+func validateQueueName(name string) error {
+	if name == "" {
+		return errors.New("queue name not passed")
+	}
+	if strings.IndexByte(name, 0) >= 0 {
+		return errors.New("queue name must not contain NUL bytes")
+	}
+	if len(name) > MAX_KV_KEY_SIZE {
+		return fmt.Errorf("queue name of %d bytes exceeds the limit of %d bytes", len(name), MAX_KV_KEY_SIZE)
+	}
+	return nil
+}
+
+// validateQueueCommand is run by the leader before a queue command is
+// appended to the log.
+// expects node.mu to be held
+func (node *Node) validateQueueCommand(command interface{}) error {
+	switch cmd := command.(type) {
+	case QueueEnqueueCommand:
+		if err := validateQueueName(cmd.Queue); err != nil {
+			return err
+		}
+		if len(cmd.Payload) > MAX_QUEUE_PAYLOAD_SIZE {
+			return fmt.Errorf("payload of %d bytes exceeds the limit of %d bytes", len(cmd.Payload), MAX_QUEUE_PAYLOAD_SIZE)
+		}
+		if node.getQueue(cmd.Queue).size() >= MAX_QUEUE_ITEMS {
+			return fmt.Errorf("queue %s is full with %d items", cmd.Queue, MAX_QUEUE_ITEMS)
+		}
+		return nil
+	case QueueDequeueCommand:
+		return validateQueueName(cmd.Queue)
+	case QueueAckCommand:
+		_, err := node.getDelivery(cmd.Queue, cmd.ItemID, cmd.Requester.ClientID)
+		return err
+	case QueueNackCommand:
+		_, err := node.getDelivery(cmd.Queue, cmd.ItemID, cmd.Requester.ClientID)
+		return err
+	}
+	return nil
+}
+
+func (node *Node) replyToQueueRequest(requester CoordinationWaiter, reply QueueReply) {
+	if requester.ClientID == "" || !node.isLeader() {
+		return
+	}
+	node.server.sendToClient(requester.ClientID, requester.RequestID, MessageQueue, reply)
+}
+
+func (node *Node) applyQueueEnqueue(cmd QueueEnqueueCommand) {
+	queue := node.getQueue(cmd.Queue)
+	if queue.size() >= MAX_QUEUE_ITEMS {
+		// enqueues validated together may overshoot the limit
+		node.replyToQueueRequest(cmd.Requester, QueueReply{
+			Queue: cmd.Queue,
+			Error: fmt.Sprintf("queue %s is full with %d items", cmd.Queue, MAX_QUEUE_ITEMS),
+		})
+		return
+	}
+	queue.NextID++
+	item := QueueItem{
+		ID:         queue.NextID,
+		Payload:    cmd.Payload,
+		EnqueuedAt: node.entryTime(),
+	}
+	node.setData(queueReadyKey(cmd.Queue, queue.Tail), item)
+	queue.Tail++
+	node.setData(queueKey(cmd.Queue), queue)
+	node.replyToQueueRequest(cmd.Requester, QueueReply{Success: true, Queue: cmd.Queue, ItemID: item.ID})
+}
+
+func (node *Node) applyQueueDequeue(cmd QueueDequeueCommand) {
+	queue := node.getQueue(cmd.Queue)
+	var item QueueItem
+	if queue.Head == queue.Tail {
+		node.replyToQueueRequest(cmd.Requester, QueueReply{Success: true, Queue: cmd.Queue, Empty: true})
+		return
+	}
+	node.readFromStorage(queueReadyKey(cmd.Queue, queue.Head), &item)
+	node.db.Delete(queueReadyKey(cmd.Queue, queue.Head))
+	queue.Head++
+	item.Deliveries++
+	delivery := QueueDelivery{
+		Queue:          cmd.Queue,
+		Item:           item,
+		Consumer:       cmd.Requester.ClientID,
+		InvisibleUntil: node.entryTime().Add(cmd.VisibilityTimeout),
+	}
+	node.setData(queueInFlightKey(cmd.Queue, item.ID), delivery)
+	queue.InFlight++
+	node.setData(queueKey(cmd.Queue), queue)
+
+	node.mu.Lock()
+	if node.state == Leader {
+		node.startQueueMonitor(delivery)
+	}
+	node.mu.Unlock()
+	node.replyToQueueRequest(cmd.Requester, QueueReply{Success: true, Queue: cmd.Queue, ItemID: item.ID, Item: &item})
+}
+
+// applyQueueSettle acknowledges or, with requeue set, nacks a delivery.
+func (node *Node) applyQueueSettle(name string, itemID uint64, requester CoordinationWaiter, requeue bool) {
+	delivery, err := node.getDelivery(name, itemID, requester.ClientID)
+	if err != nil {
+		node.replyToQueueRequest(requester, QueueReply{Queue: name, Error: err.Error()})
+		return
+	}
+	queue := node.getQueue(name)
+	node.takeInFlight(&queue, delivery, requeue)
+	node.stopQueueMonitor(name, itemID)
+	node.replyToQueueRequest(requester, QueueReply{Success: true, Queue: name, ItemID: itemID})
+}
+
+func (node *Node) applyQueueRedeliver(cmd QueueRedeliverCommand) {
+	var delivery QueueDelivery
+	if found, _ := node.readFromStorage(queueInFlightKey(cmd.Queue, cmd.ItemID), &delivery); !found || delivery.Item.Deliveries != cmd.Deliveries {
+		return
+	}
+	fmt.Printf("Item %d of queue %s was not acknowledged by %s in time, redelivering\n", cmd.ItemID, cmd.Queue, delivery.Consumer)
+	queue := node.getQueue(cmd.Queue)
+	node.takeInFlight(&queue, delivery, true)
+	node.stopQueueMonitor(cmd.Queue, cmd.ItemID)
+}
+
+// startQueueMonitor arms the visibility timeout of delivery with the same
+// expiry machinery that releases expired locks.
+// expects node.mu to be held
+func (node *Node) startQueueMonitor(delivery QueueDelivery) {
+	redeliver := QueueRedeliverCommand{
+		Queue:      delivery.Queue,
+		ItemID:     delivery.Item.ID,
+		Deliveries: delivery.Item.Deliveries,
+	}
+	node.startExpiryMonitor(node.activeQueueMonitorCancel, queueDeliveryKey(delivery.Queue, delivery.Item.ID), delivery.InvisibleUntil, func() {
+		node.newLogEntry(redeliver)
+	})
+}
+
+func (node *Node) stopQueueMonitor(name string, itemID uint64) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if cancelMonitor, exists := node.activeQueueMonitorCancel[queueDeliveryKey(name, itemID)]; exists {
+		cancelMonitor()
+		delete(node.activeQueueMonitorCancel, queueDeliveryKey(name, itemID))
+	}
+}
+
+// startQueueMonitors re-arms the visibility timeouts of every delivery when
+// a node becomes leader.
+// expects node.mu to be held
+func (node *Node) startQueueMonitors() {
+	for _, entry := range node.db.Range(QUEUE_DELIVERY_PREFIX, prefixEnd(QUEUE_DELIVERY_PREFIX), 0) {
+		var delivery QueueDelivery
+		if found, _ := node.readFromStorage(entry.Key, &delivery); found {
+			node.startQueueMonitor(delivery)
+		}
+	}
+}
+
+// handleQueueRequest turns a queue message into a log command. Accepted
+// commands are answered by the leader once applied; rejected ones right away.
+func (server *Server) handleQueueRequest(clientID string, sessionID string, env Envelope, req QueueRequest) {
+	requester := CoordinationWaiter{ClientID: clientID, SessionID: sessionID, RequestID: env.RequestID}
+	var cmd interface{}
+	switch req.Op {
+	case QueueEnqueue:
+		cmd = QueueEnqueueCommand{Queue: req.Queue, Payload: req.Payload, Requester: requester}
+	case QueueDequeue:
+		visibilityTimeout := req.VisibilityTimeout
+		if visibilityTimeout <= 0 {
+			visibilityTimeout = DEFAULT_QUEUE_VISIBILITY_TIMEOUT
+		}
+		cmd = QueueDequeueCommand{Queue: req.Queue, VisibilityTimeout: visibilityTimeout, Requester: requester}
+	case QueueAck:
+		cmd = QueueAckCommand{Queue: req.Queue, ItemID: req.ItemID, Requester: requester}
+	case QueueNack:
+		cmd = QueueNackCommand{Queue: req.Queue, ItemID: req.ItemID, Requester: requester}
+	default:
+		server.sendToClient(clientID, env.RequestID, MessageError, ErrorReply{
+			Message: fmt.Sprintf("unknown queue operation %q", req.Op),
+		})
+		return
+	}
+	success, _, err := server.SubmitToServer(cmd)
+	if err == nil && !success {
+		err = errors.New("queue command could not be submitted, try different server(leader)")
+	}
+	if err != nil {
+		server.sendToClient(clientID, env.RequestID, MessageQueue, QueueReply{Queue: req.Queue, Error: err.Error()})
+	}
+}
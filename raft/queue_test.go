@@ -0,0 +1,54 @@
+package raft
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Items are stored one per key; a nacked item goes back in front of the
+// items still waiting, and the queue counters follow every operation.
+func TestQueueKeepsItemsInLine(t *testing.T) {
+	leader := startCluster(t, 3)[0]
+	consumer := CoordinationWaiter{ClientID: "consumer"}
+	submit := func(cmd interface{}) {
+		t.Helper()
+		if success, _, err := leader.SubmitToServer(cmd); err != nil || !success {
+			t.Fatalf("submitting %T: %v", cmd, err)
+		}
+	}
+	queueIs := func(what string, ready int, inFlight int) {
+		t.Helper()
+		waitFor(t, 5*time.Second, what, func() bool {
+			queue := leader.node.getQueue("jobs")
+			return int(queue.Tail-queue.Head) == ready && queue.InFlight == inFlight
+		})
+	}
+	for _, payload := range []string{"a", "b", "c"} {
+		submit(QueueEnqueueCommand{Queue: "jobs", Payload: []byte(payload)})
+	}
+	queueIs("three ready items", 3, 0)
+
+	submit(QueueDequeueCommand{Queue: "jobs", VisibilityTimeout: time.Minute, Requester: consumer})
+	queueIs("the first item to be delivered", 2, 1)
+	submit(QueueNackCommand{Queue: "jobs", ItemID: 1, Requester: consumer})
+	queueIs("the nacked item to be ready again", 3, 0)
+
+	var front []string
+	for _, entry := range leader.node.db.Range(QUEUE_READY_PREFIX+"jobs\x00", prefixEnd(QUEUE_READY_PREFIX+"jobs\x00"), 0) {
+		var item QueueItem
+		leader.node.readFromStorage(entry.Key, &item)
+		front = append(front, string(item.Payload))
+	}
+	if got := strings.Join(front, ""); got != "abc" {
+		t.Errorf("ready items are %q, want the nacked item back in front: %q", got, "abc")
+	}
+
+	if _, _, err := leader.SubmitToServer(QueueAckCommand{Queue: "jobs", ItemID: 1, Requester: consumer}); err == nil {
+		t.Error("acknowledging an item that is not delivered succeeded")
+	}
+	big := QueueEnqueueCommand{Queue: "jobs", Payload: make([]byte, MAX_QUEUE_PAYLOAD_SIZE+1)}
+	if _, _, err := leader.SubmitToServer(big); err == nil {
+		t.Error("enqueuing a payload over the size limit succeeded")
+	}
+}
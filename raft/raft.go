@@ -9,7 +9,11 @@ import (
 	"log"
 	"math/rand"
 	"os"
+	"runtime"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -46,12 +50,20 @@ func CreateNode(
 		lastApplied:                   0,
 		state:                         Follower,
 		electionResetEvent:            time.Now(),
-		nextIndex:                     make(map[uint64]uint64),
-		matchedIndex:                  make(map[uint64]uint64),
+		progress:                      make(map[uint64]*Progress),
+		appendStreams:                 make(map[uint64]*appendStream),
+		replication:                   DefaultReplicationConfig,
 		activeLockExpiryMonitorCancel: make(map[string]context.CancelFunc),
+		activeSessionMonitorCancel:    make(map[string]context.CancelFunc),
+		activeQueueMonitorCancel:      make(map[string]context.CancelFunc),
 		pendingLockQueue:              make(map[string]*[]LockRequest),
 		pullLockRequestChan:           make(map[string]chan struct{}, 1),
+		grantingLocks:                 make(map[string]struct{}),
+		lockGrantCounts:               make(map[string]map[string]int),
+		kvResultWaiters:               make(map[uint64]kvResultWaiter),
+		watchers:                      make(map[string]*watcher),
 	}
+	node.logAppended = sync.NewCond(&node.mu)
 	if node.db.HasData() {
 		// fmt.Printf("db has data Restoring from storage on node: %d\n", node.id)
 		node.restoreFromStorage()
@@ -96,8 +108,7 @@ func (node *Node) addPeer(peerId uint64) {
 	node.mu.Lock()
 	defer node.mu.Unlock()
 	node.peerList.Add(peerId)
-	node.nextIndex[peerId] = uint64(len(node.log)) + 1
-	node.matchedIndex[peerId] = 0
+	node.progress[peerId] = newProgress(uint64(len(node.log)) + 1)
 	fmt.Printf("[%d] Added peer %d to cluster\n", node.id, peerId)
 }
 
@@ -108,13 +119,17 @@ func (node *Node) removePeer(peerId uint64) {
 	if node.peerList.Exists(peerId) {
 		node.peerList.Remove(peerId)
 	}
+	delete(node.progress, peerId)
+	if stream, exists := node.appendStreams[peerId]; exists {
+		stream.close()
+		delete(node.appendStreams, peerId)
+	}
 }
 
 func (node *Node) sendCommit() {
 	for range node.newCommitReady {
 		node.mu.Lock()
 		lastAppliedSaved := node.lastApplied
-		currentTermSaved := node.currentTerm
 		var pendingCommitEntries []LogEntry
 		if node.commitLength > node.lastApplied {
 			pendingCommitEntries = node.log[node.lastApplied:node.commitLength]
@@ -126,7 +141,8 @@ func (node *Node) sendCommit() {
 			node.commitChan <- CommitEntry{
 				Command: entry.Command,
 				Index:   lastAppliedSaved + uint64(i) + 1,
-				Term:    currentTermSaved,
+				Term:    entry.Term,
+				Time:    entry.Time,
 			}
 		}
 	}
@@ -190,12 +206,14 @@ func (node *Node) electionTimeout() time.Duration {
 
 func (node *Node) startElection() {
 	node.state = Candidate
+	node.closeAppendStreams()
 	node.currentTerm += 1
 	// fmt.Printf("Calling startElection() by %d for term %d with peers: %v\n", node.id, node.currentTerm, node.peerList)
 	candidacyTerm := node.currentTerm
 	node.electionResetEvent = time.Now()
 	node.votedFor = int64(node.id)
 	node.potentialLeader = int64(node.id)
+	node.persistTermAndVote()
 	votesReceived := 1
 	go func() {
 		node.mu.Lock()
@@ -248,158 +266,98 @@ func (node *Node) becomeLeader() {
 	node.state = Leader
 	node.potentialLeader = int64(node.id)
 	for peer := range node.peerList.peerSet {
-		node.nextIndex[peer] = uint64(len(node.log)) + 1
-		node.matchedIndex[peer] = 0
+		node.progress[peer] = newProgress(uint64(len(node.log)) + 1)
 	}
 	lockKeyValues := node.getAllLockKeyValues()
 	for key, lockInfo := range lockKeyValues {
 		// fmt.Printf("key: %s, value %v\n", key, lockInfo)
-		ctx, cancel := context.WithCancel(context.Background())
-		node.activeLockExpiryMonitorCancel[key] = cancel
-		go node.monitorLockExpiry(ctx, key, lockInfo.ExpiryTime)
+		node.startLockMonitor(key, lockInfo.ExpiryTime)
 		// fmt.Printf("added stuff for key %s\n", key)
 	}
+	node.startQueueMonitors()
+	node.startKVExpiry()
+	for sessionID, session := range node.getAllSessions() {
+		// clients need a full TTL to find the new leader and resume
+		expiryTime := time.Now().Add(session.TTL)
+		if session.ExpiryTime.After(expiryTime) {
+			expiryTime = session.ExpiryTime
+		}
+		node.startSessionMonitor(sessionID, expiryTime)
+	}
 	go func(heartbeatTimeout time.Duration) {
-		node.sendEntriesToFollowers()
-		timer := time.NewTimer(heartbeatTimeout)
-		defer timer.Stop()
+		node.sendEntriesToFollowers(true)
+		// heartbeats keep their pace however often rounds are triggered, so
+		// paused followers still hear from the leader
+		ticker := time.NewTicker(heartbeatTimeout)
+		defer ticker.Stop()
 		for {
-			doSend := false
+			heartbeat := false
 			select {
-			case <-timer.C:
-				doSend = true
-				timer.Stop()
-				timer.Reset(heartbeatTimeout)
+			case <-ticker.C:
+				heartbeat = true
 			case _, ok := <-node.trigger:
 				// fmt.Printf("becomeLeader running on node %d, leader, term = %v, %v\n", node.id, node.state, node.currentTerm)
-				if ok {
-					doSend = true
-				} else {
+				if !ok {
 					return
 				}
-				if !timer.Stop() {
-					<-timer.C
-				}
-				timer.Reset(heartbeatTimeout)
 			}
-			if doSend {
-				if node.state != Leader {
-					return
-				}
-				node.sendEntriesToFollowers()
+			if !node.isLeader() {
+				return
 			}
+			// let proposers that are ready to run append first, so they
+			// share this round's persist and AppendEntries
+			runtime.Gosched()
+			node.sendEntriesToFollowers(heartbeat)
 		}
 	}(50 * time.Millisecond)
 }
 
-func (node *Node) sendEntriesToFollowers() {
+// sendEntriesToFollowers runs one round of replication: it persists what
+// has been proposed since the last round and sends each follower what its
+// progress allows. Heartbeat rounds reach every follower.
+func (node *Node) sendEntriesToFollowers(heartbeat bool) {
+	node.persistAppendedEntries()
 	node.mu.Lock()
-	leadershipTerm := node.currentTerm
-	node.mu.Unlock()
-
-	go func(peer uint64) {
-		if node.peerList.Size() == 0 {
-			if uint64(len(node.log)) > node.commitLength {
-				// fmt.Printf("Before Committing log entries on node %d\n", node.id)
-				commitLengthSaved := node.commitLength
-				for i := node.commitLength + 1; i <= uint64(len(node.log)); i++ {
-					if node.log[i-1].Term == node.currentTerm {
-						node.commitLength = i
-					}
-				}
-				if commitLengthSaved != node.commitLength {
-					// fmt.Printf("Committing log entries on node %d\n", node.id)
-					node.newCommitReady <- struct{}{}
-					node.trigger <- struct{}{}
-				}
-			}
+	defer node.mu.Unlock()
+	if node.state != Leader {
+		return
+	}
+	if node.peerList.Size() == 0 {
+		node.advanceCommit()
+		return
+	}
+	for peer := range node.peerList.peerSet {
+		if requests := node.appendRequests(peer, heartbeat); len(requests) > 0 {
+			node.streamTo(peer).push(requests)
 		}
-	}(node.id)
+	}
+}
 
-	for peer := range node.peerList.peerSet {
-		go func(peer uint64) {
-			node.mu.Lock()
-			nextIndexSaved := node.nextIndex[peer]
-			lastLogIndexSaved := int(nextIndexSaved) - 1
-			lastLogTermSaved := uint64(0)
-			if lastLogIndexSaved > 0 {
-				lastLogTermSaved = node.log[lastLogIndexSaved-1].Term
-			}
-			entries := node.log[nextIndexSaved-1:]
-
-			// fmt.Printf("nextIndexSaved is %d and lastLogIndexSaved is %d for peer %d from node %d on term %d\n", nextIndexSaved, uint64(lastLogIndexSaved), peer, node.id, node.currentTerm)
-			// fmt.Printf("[LeaderSendAppendEntries peer %d] entries size: %d\n", peer, len(entries))
-			args := AppendEntriesArgs{
-				Term:         leadershipTerm,
-				LeaderId:     node.id,
-				LastLogIndex: uint64(lastLogIndexSaved),
-				LastLogTerm:  lastLogTermSaved,
-				Entries:      entries,
-				LeaderCommit: node.commitLength,
-			}
-			node.mu.Unlock()
-			// if len(entries) > 0 {
-			// 	fmt.Printf("Entries Sent on node %d: %v\n", peer, entries)
-			// }
-			var reply AppendEntriesReply
-			if err := node.server.RPC(peer, "RaftNode.AppendEntries", args, &reply); err == nil {
-				node.mu.Lock()
-				defer node.mu.Unlock()
-				if len(entries) > 0 {
-					// fmt.Printf("Entries Sent on node %d: %v\n", peer, entries)
-					// fmt.Printf("Reply from peer %d: success = %v\n", peer, reply.Success)
-				}
-				if reply.Term > leadershipTerm {
-					node.becomeFollower(reply.Term, -1)
-					return
-				}
-				if node.state == Leader && leadershipTerm == reply.Term {
-					if reply.Success {
-						node.nextIndex[peer] = nextIndexSaved + uint64(len(entries))
-						node.matchedIndex[peer] = node.nextIndex[peer] - 1
-						commitLengthSaved := node.commitLength
-						for i := commitLengthSaved + 1; i <= uint64(len(node.log)); i++ {
-							if node.log[i-1].Term == node.currentTerm {
-								matchCount := 1
-								for p := range node.peerList.peerSet {
-									if node.matchedIndex[p] >= i {
-										matchCount++
-									}
-								}
-								if matchCount*2 > node.peerList.Size()+1 {
-									node.commitLength = i
-								}
-							}
-						}
-						if commitLengthSaved != node.commitLength {
-							// fmt.Printf("commit length: %d\n", node.commitLength)
-							// fmt.Printf("[LeaderSendAppendEntries Reply from peer %d] matchIndex[peer], nextIndex[peer], rn.commitIndex = %v, %v, %v\n", peer, node.matchedIndex[peer], node.nextIndex[peer], node.commitLength)
-							node.newCommitReady <- struct{}{}
-							node.trigger <- struct{}{}
-						}
-					} else {
-						if reply.RecoveryTerm == 0 {
-							node.nextIndex[peer] = reply.RecoveryIndex
-						} else {
-							lastLogIndex := uint64(0)
-							for i := uint64(len(node.log)); i > 0; i-- {
-								if node.log[i-1].Term == reply.RecoveryTerm {
-									lastLogIndex = i
-									break
-								}
-							}
-							if lastLogIndex == 0 {
-								node.nextIndex[peer] = reply.RecoveryIndex
-							} else {
-								node.nextIndex[peer] = lastLogIndex + 1
-							}
-						}
-					}
-				}
+// handleAppendResult processes the outcome of an AppendEntries sent to peer
+// on its stream.
+func (node *Node) handleAppendResult(peer uint64, request appendRequest, reply AppendEntriesReply, err error) {
+	leadershipTerm := request.args.Term
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if err == nil && reply.Term > leadershipTerm {
+		node.becomeFollower(reply.Term, -1)
+		return
+	}
+	if node.state != Leader || node.currentTerm != leadershipTerm {
+		return
+	}
+	if err != nil || reply.Term < leadershipTerm {
+		// the follower did not act on the request, so probe again
+		if pr, exists := node.progress[peer]; exists && request.kind != appendHeartbeat && request.generation == pr.generation {
+			if pr.State == ProgressReplicate {
+				pr.becomeProbe(pr.Match + 1)
+			} else {
+				pr.ProbeSent = false
 			}
-		}(peer)
+		}
+		return
 	}
-
+	node.handleAppendEntriesReply(peer, request, reply)
 }
 
 func (node *Node) lastLogIndexAndTerm() (uint64, uint64) {
@@ -430,12 +388,24 @@ func (node *Node) becomeFollower(newTerm uint64, leaderId int64) {
 	node.votedFor = -1
 	node.potentialLeader = leaderId
 	node.electionResetEvent = time.Now()
+	node.persistTermAndVote()
+	node.closeAppendStreams()
 
 	for key, cancelFunc := range node.activeLockExpiryMonitorCancel {
 		cancelFunc()
 		delete(node.activeLockExpiryMonitorCancel, key)
 	}
 
+	for sessionID, cancelFunc := range node.activeSessionMonitorCancel {
+		cancelFunc()
+		delete(node.activeSessionMonitorCancel, sessionID)
+	}
+
+	for delivery, cancelFunc := range node.activeQueueMonitorCancel {
+		cancelFunc()
+		delete(node.activeQueueMonitorCancel, delivery)
+	}
+
 	for key := range node.pendingLockQueue {
 		delete(node.pendingLockQueue, key)
 	}
@@ -445,50 +415,62 @@ func (node *Node) becomeFollower(newTerm uint64, leaderId int64) {
 		delete(node.pullLockRequestChan, key)
 	}
 
+	for key := range node.grantingLocks {
+		delete(node.grantingLocks, key)
+	}
+
+	for key := range node.lockGrantCounts {
+		delete(node.lockGrantCounts, key)
+	}
+
+	node.stopKVExpiry()
+
+	for index, waiter := range node.kvResultWaiters {
+		close(waiter.ch)
+		delete(node.kvResultWaiters, index)
+	}
+
+	node.server.wsMu.Lock()
 	for clientID, wsConn := range node.server.wsClients {
 		wsConn.Close()
 		delete(node.server.wsClients, clientID)
 	}
+	node.server.wsMu.Unlock()
 
 	go node.runElectionTimer()
 }
 
-func (node *Node) persistToStorage() {
-	for _, data := range []struct {
-		name  string
-		value interface{}
-	}{
-		{"currentTerm", node.currentTerm},
-		{"votedFor", node.votedFor},
-		{"log", node.log},
-	} {
-		var buf bytes.Buffer
-		enc := gob.NewEncoder(&buf)
-		if err := enc.Encode(data.value); err != nil {
-			log.Fatal("encode error: ", err)
-		}
-		node.db.Set(data.name, buf.Bytes())
-	}
-}
-
-func (node *Node) restoreFromStorage() {
-	fmt.Printf("Restoring from storage on node: %d\n", node.id)
-	for _, data := range []struct {
-		name  string
-		value interface{}
-	}{
-		{"currentTerm", &node.currentTerm},
-		{"votedFor", &node.votedFor},
-		{"log", &node.log},
-	} {
-		if value, found := node.db.Get(data.name); found {
-			dec := gob.NewDecoder(bytes.NewBuffer(value))
-			if err := dec.Decode(data.value); err != nil {
-				log.Fatal("decode error: ", err)
-			}
-		} else {
-			log.Fatal("No data found for", data.name)
-		}
+// appendEntry appends command to the leader's log and returns its index.
+// node.mu must be held. The entry is persisted and replicated by the next
+// round of sendEntriesToFollowers, together with every other entry proposed
+// in the meantime.
+func (node *Node) appendEntry(command interface{}) uint64 {
+	node.log = append(node.log, LogEntry{
+		Command: command,
+		Term:    node.currentTerm,
+		Time:    time.Now(),
+	})
+	node.triggerRound()
+	return uint64(len(node.log))
+}
+
+// triggerRound wakes the leader loop for another round of
+// sendEntriesToFollowers. It never blocks: a wake-up already pending covers
+// this one, and callers may hold node.mu, which the round needs.
+func (node *Node) triggerRound() {
+	select {
+	case node.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// signalCommit tells sendCommit that commitLength has advanced. Like
+// triggerRound it never blocks, since sendCommit reads commitLength afresh
+// for every signal it takes.
+func (node *Node) signalCommit() {
+	select {
+	case node.newCommitReady <- struct{}{}:
+	default:
 	}
 }
 
@@ -546,7 +528,10 @@ func (node *Node) forwardToLeader(command interface{}) (bool, interface{}, error
 			return false, nil, err
 		}
 		if reply.Success {
-			return reply.Result.Success, reply.Result.Value, reply.Result.Error
+			if reply.Result.Error != "" {
+				return reply.Result.Success, reply.Result.Value, errors.New(reply.Result.Error)
+			}
+			return reply.Result.Success, reply.Result.Value, nil
 		}
 		node.mu.Lock()
 		if reply.Term > node.currentTerm {
@@ -571,43 +556,104 @@ func (node *Node) newLogEntry(command interface{}) (bool, interface{}, error) {
 		switch cmd := command.(type) {
 		case Read:
 			// fmt.Printf("READ v: %v", v)
-			key := cmd.Key
-			var value uint64
-			found, readErr := node.readFromStorage(key, &value)
+			reply, readErr := node.readKVReply(cmd)
+			node.mu.Unlock()
 			if readErr != nil {
-				node.mu.Unlock()
 				return false, nil, readErr
 			}
-			if !found {
+			// fmt.Printf("key, value = %v, %v\n", key, value)
+			return true, reply, nil
+		case Write:
+			if err := validateWrite(cmd); err != nil {
 				node.mu.Unlock()
-				return false, nil, nil
+				return false, nil, err
 			}
-			// fmt.Printf("key, value = %v, %v\n", key, value)
+			node.appendEntry(cmd)
+			node.mu.Unlock()
+			return true, nil, nil
+		case Delete:
+			if err := validateKV(cmd.Key, nil); err != nil {
+				node.mu.Unlock()
+				return false, nil, err
+			}
+			return node.proposeKVCommand(cmd)
+		case CompareAndSwap:
+			if err := validateKV(cmd.Key, cmd.Value); err != nil {
+				node.mu.Unlock()
+				return false, nil, err
+			}
+			return node.proposeKVCommand(cmd)
+		case PutIfAbsent:
+			if err := validateKV(cmd.Key, cmd.Value); err != nil {
+				node.mu.Unlock()
+				return false, nil, err
+			}
+			return node.proposeKVCommand(cmd)
+		case Txn:
+			if err := validateTxn(cmd); err != nil {
+				node.mu.Unlock()
+				return false, nil, err
+			}
+			return node.proposeKVCommand(cmd)
+		case Increment:
+			if err := validateIncrement(cmd); err != nil {
+				node.mu.Unlock()
+				return false, nil, err
+			}
+			return node.proposeKVCommand(cmd)
+		case BatchWrite:
+			if err := validateBatchWrite(cmd); err != nil {
+				node.mu.Unlock()
+				return false, nil, err
+			}
+			return node.proposeKVCommand(cmd)
+		case ClientCommand:
+			if result, duplicate, err := node.duplicateResult(cmd.ClientID, cmd.Seq); duplicate {
+				node.mu.Unlock()
+				return err == nil, result, err
+			}
+			if err := node.admitClientRequest(cmd.ClientID, cmd.Seq, cmd.AckedSeq); err != nil {
+				node.mu.Unlock()
+				return false, nil, err
+			}
+			if err := validateClientCommand(cmd); err != nil {
+				node.mu.Unlock()
+				return false, nil, err
+			}
+			return node.proposeKVCommand(cmd)
+		case Compact:
+			if err := node.validateCompact(cmd); err != nil {
+				node.mu.Unlock()
+				return false, nil, err
+			}
+			return node.proposeKVCommand(cmd)
+		case RangeQuery:
+			reply, readErr := node.rangeKV(cmd)
 			node.mu.Unlock()
-			return true, value, nil
+			if readErr != nil {
+				return false, nil, readErr
+			}
+			return true, reply, nil
+		case FencingTokenQuery:
+			status, readErr := node.fencingTokenStatus(cmd.Key)
+			node.mu.Unlock()
+			if readErr != nil {
+				return false, nil, readErr
+			}
+			return true, status, nil
 		case AddServer:
-			node.log = append(node.log, LogEntry{
-				Command: command,
-				Term:    node.currentTerm,
-			})
-			node.persistToStorage()
+			node.appendEntry(command)
 			node.mu.Unlock()
-			node.trigger <- struct{}{}
 			return true, nil, nil
 		case RemoveServer:
 			if !node.peerList.Exists(cmd.ServerId) || node.id == cmd.ServerId {
 				node.mu.Unlock()
 				return false, nil, errors.New("server with id " + fmt.Sprint(cmd.ServerId) + " cannot be removed from peer " + fmt.Sprint(node.id))
 			}
-			node.log = append(node.log, LogEntry{
-				Command: command,
-				Term:    node.currentTerm,
-			})
+			node.appendEntry(command)
 			node.peerList.Remove(cmd.ServerId)
 			// fmt.Printf("[%d] Removed peer %d from leader list\n", node.id, v.ServerId)
-			node.persistToStorage()
 			node.mu.Unlock()
-			node.trigger <- struct{}{}
 			return true, nil, nil
 		case LockReleaseCommand:
 			// fmt.Printf("LockReleaseCommand for %v\n", cmd.Key)
@@ -624,36 +670,113 @@ func (node *Node) newLogEntry(command interface{}) (bool, interface{}, error) {
 				return false, nil, fmt.Errorf("cannot release lock %s. It is already released\n", cmd.Key)
 			}
 
-			if lockInfo.Holder != cmd.ClientID {
+			if lockInfo.Holder != cmd.ClientID || (!cmd.Expired && lockInfo.OwnerToken != cmd.OwnerToken) {
 				node.mu.Unlock()
 				return false, nil, fmt.Errorf("lock %s is held by someone else\n", cmd.Key)
 			}
-			// fmt.Printf("Should delete the lock key %s\n", cmd.Key)
-			node.db.Delete(lockKey)
-			if node.activeLockExpiryMonitorCancel[cmd.Key] == nil {
+			node.appendEntry(cmd)
+			node.mu.Unlock()
+			return true, nil, nil
+		case MultiLockReleaseCommand:
+			for _, key := range cmd.Keys {
+				var lockInfo LockInfo
+				lockKey := fmt.Sprintf("%s%s", LOCKING_KEY_PREFIX, key)
+				found, readErr := node.readFromStorage(lockKey, &lockInfo)
+				if readErr != nil {
+					node.mu.Unlock()
+					return false, nil, errors.New("reading the lock info from db went wrong")
+				}
+				if !found || lockInfo.Holder != cmd.ClientID {
+					node.mu.Unlock()
+					return false, nil, fmt.Errorf("lock %s is not held by %s", key, cmd.ClientID)
+				}
+			}
+			node.appendEntry(cmd)
+			node.mu.Unlock()
+			return true, nil, nil
+		case LockForceReleaseCommand:
+			var lockInfo LockInfo
+			lockKey := fmt.Sprintf("%s%s", LOCKING_KEY_PREFIX, cmd.Key)
+			found, readErr := node.readFromStorage(lockKey, &lockInfo)
+			if readErr != nil {
 				node.mu.Unlock()
-				return false, nil, fmt.Errorf("Expiry Monitor for Lock %s could not be cancelled", cmd.Key)
+				return false, nil, errors.New("reading the lock info from db went wrong")
 			}
-			node.activeLockExpiryMonitorCancel[cmd.Key]()
-			delete(node.activeLockExpiryMonitorCancel, cmd.Key)
-			node.log = append(node.log, LogEntry{
-				Command: cmd,
-				Term:    node.currentTerm,
-			})
-			fmt.Printf("Successfully deleted data for the lock %s\n", cmd.Key)
-			node.persistToStorage()
+			if !found {
+				node.mu.Unlock()
+				return false, nil, fmt.Errorf("cannot force release lock %s. It is not held", cmd.Key)
+			}
+			cmd.Holder = lockInfo.Holder
+			node.appendEntry(cmd)
+			node.mu.Unlock()
+			return true, lockInfo.Holder, nil
+		case SessionKeepAliveCommand:
+			if _, found := node.getSession(cmd.SessionID); !found {
+				node.mu.Unlock()
+				return false, nil, fmt.Errorf("session %s has expired", cmd.SessionID)
+			}
+			return node.proposeKVCommand(cmd)
+		case BarrierArriveCommand, LatchCreateCommand, LatchCountDownCommand, LatchWaitCommand:
+			if err := node.validateCoordinationCommand(cmd); err != nil {
+				node.mu.Unlock()
+				return false, nil, err
+			}
+			node.appendEntry(cmd)
+			node.mu.Unlock()
+			return true, nil, nil
+		case QueueEnqueueCommand, QueueDequeueCommand, QueueAckCommand, QueueNackCommand, QueueRedeliverCommand:
+			if err := node.validateQueueCommand(cmd); err != nil {
+				node.mu.Unlock()
+				return false, nil, err
+			}
+			node.appendEntry(cmd)
 			node.mu.Unlock()
-			node.trigger <- struct{}{}
 			return true, nil, nil
+		case AuditQuery:
+			records := node.queryLockAudit(cmd)
+			node.mu.Unlock()
+			return true, records, nil
+		case ListLocks:
+			locks, readErr := node.listLocks()
+			node.mu.Unlock()
+			if readErr != nil {
+				return false, nil, readErr
+			}
+			return true, locks, nil
+		case DescribeLock:
+			lock, readErr := node.describeLock(cmd.Key)
+			node.mu.Unlock()
+			if readErr != nil {
+				return false, nil, readErr
+			}
+			return true, lock, nil
+		case LockRenewCommand:
+			var lockInfo LockInfo
+			lockKey := fmt.Sprintf("%s%s", LOCKING_KEY_PREFIX, cmd.Key)
+			found, readErr := node.readFromStorage(lockKey, &lockInfo)
+			if readErr != nil {
+				node.mu.Unlock()
+				return false, nil, errors.New("reading the lock info from db went wrong")
+			}
+			if !found || lockInfo.Holder != cmd.ClientID {
+				// answered rather than failed, so the client can tell that
+				// it has lost the lock from not having reached the leader
+				node.mu.Unlock()
+				return true, LockRenewReply{
+					Key:    cmd.Key,
+					Reason: LockReasonNotHeld,
+					Error:  fmt.Sprintf("lock %s is not held by %s", cmd.Key, cmd.ClientID),
+				}, nil
+			}
+			if cmd.TTL <= 0 {
+				node.mu.Unlock()
+				return false, nil, fmt.Errorf("invalid TTL %v to renew lock %s", cmd.TTL, cmd.Key)
+			}
+			return node.proposeKVCommand(cmd)
 		default:
 			// fmt.Printf("Data append on leader: %d, command: %v\n", node.id, command)
-			node.log = append(node.log, LogEntry{
-				Command: command,
-				Term:    node.currentTerm,
-			})
-			node.persistToStorage()
+			node.appendEntry(command)
 			node.mu.Unlock()
-			node.trigger <- struct{}{}
 			return true, nil, nil
 		}
 	} else {
@@ -665,6 +788,15 @@ func (node *Node) newLogEntry(command interface{}) (bool, interface{}, error) {
 		case Write:
 			node.mu.Unlock()
 			return node.forwardToLeader(cmd)
+		case Delete, CompareAndSwap, PutIfAbsent, Increment, BatchWrite, Txn, RangeQuery, Compact, ClientCommand:
+			node.mu.Unlock()
+			return node.forwardToLeader(cmd)
+		case FencingTokenQuery:
+			node.mu.Unlock()
+			return node.forwardToLeader(cmd)
+		case ListLocks, DescribeLock, LockForceReleaseCommand, LockPolicyCommand, AuditQuery:
+			node.mu.Unlock()
+			return node.forwardToLeader(cmd)
 		}
 	}
 
@@ -679,9 +811,29 @@ func (node *Node) applyLogEntry() error {
 		// fmt.Printf("Collect Commits from node %d, entry: %+cmd\n", i, commit)
 		// logtest(server.GetServerId(), "collectCommits (%d) got %+cmd", server.GetServerId(), commit)
 		// fmt.Printf("commit: %v\n", commit)
+		node.applying = commit
+		node.auditSeq = 0
 		switch cmd := commit.Command.(type) {
 		case Write:
-			node.setData(cmd.Key, cmd.Val)
+			node.applyWrite(cmd)
+		case ExpireKeys:
+			node.applyExpireKeys(cmd)
+		case Delete:
+			node.deliverKVResult(commit, node.applyDelete(cmd))
+		case CompareAndSwap:
+			node.deliverKVResult(commit, node.applyCompareAndSwap(cmd))
+		case PutIfAbsent:
+			node.deliverKVResult(commit, node.applyPutIfAbsent(cmd))
+		case Txn:
+			node.deliverKVResult(commit, node.applyTxn(cmd))
+		case Increment:
+			node.deliverKVResult(commit, node.applyIncrement(cmd))
+		case BatchWrite:
+			node.deliverKVResult(commit, node.applyBatchWrite(cmd))
+		case ClientCommand:
+			node.deliverKVResult(commit, node.applyClientCommand(cmd))
+		case Compact:
+			node.deliverKVResult(commit, node.applyCompact(cmd))
 		case AddServer:
 			// fmt.Printf("Add server\n")
 			node.server.AddToCluster(cmd.ServerId)
@@ -690,37 +842,120 @@ func (node *Node) applyLogEntry() error {
 				node.server.RemoveFromCluster(cmd.ServerId)
 				// fmt.Printf("[%d] Server %d removed from cluster\n", server.GetServerId(), v.ServerId)
 			}
+		case MultiLockAcquireCommand:
+			node.applyMultiLockAcquire(cmd)
+		case MultiLockReleaseCommand:
+			for _, key := range cmd.Keys {
+				if lockInfo, released := node.releaseLock(key, cmd.ClientID); released {
+					node.recordLockAudit(lockAuditRecord(AuditLockReleased, key, lockInfo))
+				}
+			}
 		case LockAcquireCommand:
 			// fmt.Printf("Lock Acquire Command\n")
-			now := time.Now()
-			if node.db.Exists(cmd.Key) {
-				fmt.Printf("Key %s already exists\n", cmd.Key)
+			node.mu.Lock()
+			delete(node.grantingLocks, cmd.Key)
+			node.mu.Unlock()
+			if node.answerDuplicateAcquire(cmd.ClientID, cmd.RequestID, cmd.Seq, cmd.AckedSeq) {
+				node.mu.Lock()
+				node.pingLockQueue(cmd.Key)
+				node.mu.Unlock()
 				continue
 			}
-			expiryTime := now.Add(cmd.TTL)
+			keyStr := fmt.Sprintf("%s%s", LOCKING_KEY_PREFIX, cmd.Key)
+			var heldLock LockInfo
+			if found, _ := node.readFromStorage(keyStr, &heldLock); found {
+				if cmd.Reentrant && heldLock.Reentrant && heldLock.Holder == cmd.ClientID && heldLock.OwnerToken == cmd.OwnerToken {
+					node.reenterLock(cmd, heldLock)
+				} else {
+					fmt.Printf("Key %s already exists\n", cmd.Key)
+					node.failLockGrant(lockRequestOf(cmd), LockReasonHeld)
+				}
+				continue
+			}
+			if _, found := node.getSession(cmd.SessionID); cmd.SessionID != "" && !found {
+				fmt.Printf("Session %s expired before lock %s was granted\n", cmd.SessionID, cmd.Key)
+				node.failLockGrant(lockRequestOf(cmd), LockReasonSessionExpired)
+				continue
+			}
+			expiryTime := node.entryTime().Add(cmd.TTL)
 			lock := LockInfo{
-				Holder:     cmd.ClientID,
-				ExpiryTime: expiryTime,
+				Holder:       cmd.ClientID,
+				SessionID:    cmd.SessionID,
+				AcquiredAt:   node.entryTime(),
+				ExpiryTime:   expiryTime,
+				FencingToken: cmd.FencingToken,
+				Reentrant:    cmd.Reentrant,
+				OwnerToken:   cmd.OwnerToken,
+				HoldCount:    1,
 			}
-			keyStr := fmt.Sprintf("%s%s", LOCKING_KEY_PREFIX, cmd.Key)
 			node.setData(keyStr, lock)
 			node.setData(cmd.FencingToken.Key, cmd.FencingToken.Value)
+			node.recordLockAudit(lockAuditRecord(AuditLockAcquired, cmd.Key, lock))
+			node.recordClientResult(cmd.ClientID, cmd.Seq, cmd.AckedSeq, LockAcquireResult{Key: cmd.Key, FencingToken: cmd.FencingToken})
 			// fmt.Printf("Added lock key %s, ready to notify the client\n", cmd.Key)
 			if node.state == Leader {
-				ctx, cancel := context.WithCancel(context.Background())
 				node.mu.Lock()
-				node.activeLockExpiryMonitorCancel[cmd.Key] = cancel
+				node.startLockMonitor(cmd.Key, expiryTime)
 				node.mu.Unlock()
-				go node.monitorLockExpiry(ctx, cmd.Key, expiryTime)
-				node.server.NotifyLockAcquire(cmd.ClientID, cmd.FencingToken)
+				node.server.NotifyLockAcquire(cmd.ClientID, cmd.RequestID, cmd.Key, cmd.FencingToken)
 				fmt.Printf("Notified Client about lock acquiring\n")
+				node.failTryAcquireRequests(cmd.Key)
+				node.breakDeadlocks()
 			}
+		case LockRenewCommand:
+			node.deliverKVResult(commit, node.applyLockRenew(cmd))
 		case LockReleaseCommand:
-			if node.state == Leader && node.pullLockRequestChan[cmd.Key] != nil {
-				node.pullLockRequestChan[cmd.Key] <- struct{}{}
+			if cmd.Expired {
+				if lockInfo, released := node.releaseLock(cmd.Key, cmd.ClientID); released {
+					node.recordLockAudit(lockAuditRecord(AuditLockExpired, cmd.Key, lockInfo))
+				}
+				continue
 			}
+			node.releaseLockHold(cmd)
 			// fmt.Printf("default\n")
+		case SessionCreateCommand:
+			node.applySessionCreate(cmd)
+		case SessionKeepAliveCommand:
+			node.deliverKVResult(commit, node.applySessionKeepAlive(cmd))
+		case SessionExpireCommand:
+			node.applySessionExpire(cmd)
+		case LockPolicyCommand:
+			node.applyLockPolicy(cmd)
+		case BarrierArriveCommand:
+			node.applyBarrierArrive(cmd)
+		case LatchCreateCommand:
+			node.applyLatchCreate(cmd)
+		case LatchCountDownCommand:
+			node.applyLatchCountDown(cmd)
+		case LatchWaitCommand:
+			node.applyLatchWait(cmd)
+		case QueueEnqueueCommand:
+			node.applyQueueEnqueue(cmd)
+		case QueueDequeueCommand:
+			node.applyQueueDequeue(cmd)
+		case QueueAckCommand:
+			node.applyQueueSettle(cmd.Queue, cmd.ItemID, cmd.Requester, false)
+		case QueueNackCommand:
+			node.applyQueueSettle(cmd.Queue, cmd.ItemID, cmd.Requester, true)
+		case QueueRedeliverCommand:
+			node.applyQueueRedeliver(cmd)
+		case LockForceReleaseCommand:
+			if lockInfo, released := node.releaseLock(cmd.Key, cmd.Holder); released {
+				record := lockAuditRecord(AuditLockForceReleased, cmd.Key, lockInfo)
+				record.Operator = cmd.Operator
+				record.Reason = cmd.Reason
+				node.recordLockAudit(record)
+				if node.state == Leader {
+					node.server.NotifyLockEvent(cmd.Holder, LockEvent{
+						Event:        LockEventRevoked,
+						Key:          cmd.Key,
+						FencingToken: lockInfo.FencingToken,
+					})
+				}
+			}
 		}
+		node.setData(CLUSTER_REVISION_KEY, commit.Index)
+		node.publishKVEvents()
 	}
 	return nil
 }
@@ -732,6 +967,7 @@ func (node *Node) Stop() {
 	node.state = Dead
 	node.potentialLeader = -1
 	close(node.newCommitReady)
+	node.closeAppendStreams()
 }
 
 func (node *Node) Report() (id int64, term uint64, isLeader bool) {
@@ -757,101 +993,308 @@ func (state NodeState) String() string {
 	}
 }
 
-func (node *Node) monitorLockExpiry(ctx context.Context, key string, expiryTime time.Time) {
-	duration := time.Until(expiryTime)
+// monitorExpiry calls expire once expiryTime has passed, unless ctx is
+// cancelled first.
+func (node *Node) monitorExpiry(ctx context.Context, expiryTime time.Time, expire func()) {
 	select {
 	case <-ctx.Done():
-		fmt.Printf("Lock %q expiry monitoring cancelled\n", key)
 		return
-	case <-time.After(duration):
-		var lockInfo LockInfo
-		lockKey := fmt.Sprintf("%s%s", LOCKING_KEY_PREFIX, key)
-		found, readErr := node.readFromStorage(lockKey, &lockInfo)
-		if readErr != nil {
-			fmt.Printf("Reading the lock info from db went wrong")
-			return
-		}
+	case <-time.After(time.Until(expiryTime)):
+		expire()
+	}
+}
 
-		if found {
-			if time.Now().After(lockInfo.ExpiryTime) {
-				fmt.Printf("Lock %q automatically expired and called release lock\n", key)
-				cmd := LockReleaseCommand{
-					Key:      key,
-					ClientID: lockInfo.Holder,
-				}
-				node.newLogEntry(cmd)
-				return
-			}
+// expects node.mu to be held
+func (node *Node) startExpiryMonitor(monitors map[string]context.CancelFunc, key string, expiryTime time.Time, expire func()) {
+	if cancelMonitor, exists := monitors[key]; exists {
+		cancelMonitor()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	monitors[key] = cancel
+	go node.monitorExpiry(ctx, expiryTime, expire)
+}
+
+// expireLock proposes the release of key once its lease has run out.
+func (node *Node) expireLock(key string) {
+	var lockInfo LockInfo
+	lockKey := fmt.Sprintf("%s%s", LOCKING_KEY_PREFIX, key)
+	found, readErr := node.readFromStorage(lockKey, &lockInfo)
+	if readErr != nil {
+		fmt.Printf("Reading the lock info from db went wrong")
+		return
+	}
+
+	if found && time.Now().After(lockInfo.ExpiryTime) {
+		fmt.Printf("Lock %q automatically expired and called release lock\n", key)
+		cmd := LockReleaseCommand{
+			Key:      key,
+			ClientID: lockInfo.Holder,
+			Expired:  true,
+		}
+		if success, _, _ := node.newLogEntry(cmd); success {
+			node.server.NotifyLockEvent(lockInfo.Holder, LockEvent{
+				Event:        LockEventExpired,
+				Key:          key,
+				FencingToken: lockInfo.FencingToken,
+			})
 		}
 	}
 }
 
 func (node *Node) handleLockAcquireRequest(req LockRequest) {
 	// fmt.Printf("handleLockAcquireRequest %v\n", req)
+	if node.answerDuplicateAcquire(req.ClientID, req.RequestID, req.Seq, req.AckedSeq) {
+		return
+	}
 	node.mu.Lock()
 	// fmt.Printf("handleLockAcquireRequest locked %v\n", req)
-	if queuePtr, exists := node.pendingLockQueue[req.Key]; exists {
-		*queuePtr = append(*queuePtr, req)
-	} else {
-		node.pendingLockQueue[req.Key] = &[]LockRequest{req}
+	if req.Reentrant && len(req.Keys) == 0 {
+		var lockInfo LockInfo
+		lockKey := fmt.Sprintf("%s%s", LOCKING_KEY_PREFIX, req.Key)
+		if found, _ := node.readFromStorage(lockKey, &lockInfo); found && lockInfo.Reentrant &&
+			lockInfo.Holder == req.ClientID && lockInfo.OwnerToken == req.OwnerToken {
+			node.mu.Unlock()
+			node.newLogEntry(LockAcquireCommand{
+				Key:          req.Key,
+				ClientID:     req.ClientID,
+				SessionID:    req.SessionID,
+				TTL:          req.TTL,
+				FencingToken: lockInfo.FencingToken,
+				RequestID:    req.RequestID,
+				Reentrant:    true,
+				OwnerToken:   req.OwnerToken,
+				Seq:          req.Seq,
+				AckedSeq:     req.AckedSeq,
+			})
+			return
+		}
 	}
-	lockRequestPing, exists := node.pullLockRequestChan[req.Key]
-	if !exists {
-		lockRequestPing = make(chan struct{}, 1)
-		node.pullLockRequestChan[req.Key] = lockRequestPing
-		// fmt.Printf("starting register\n")
-		go node.registerLockAcquireRequest(node.pendingLockQueue[req.Key], lockRequestPing)
+	keys := requestedLockKeys(req)
+	if node.replaceQueuedLockRequest(req) {
+		node.mu.Unlock()
+		return
+	}
+	if req.TryAcquire {
+		for _, key := range keys {
+			lockKey := fmt.Sprintf("%s%s", LOCKING_KEY_PREFIX, key)
+			queuePtr, queued := node.pendingLockQueue[key]
+			if node.db.Exists(lockKey) || (queued && len(*queuePtr) > 0) {
+				node.mu.Unlock()
+				node.server.NotifyLockFailure(req, LockReasonHeld)
+				return
+			}
+		}
+	}
+	node.lockArrivals++
+	req.arrival = node.lockArrivals
+	req.queuedAt = time.Now()
+	if req.WaitTimeout > 0 {
+		go node.expireLockRequest(req)
+	}
+	// a multi-key request joins the queue of every key it asks for, all under
+	// the same lock so that every queue orders requests the same way
+	for _, key := range keys {
+		if queuePtr, exists := node.pendingLockQueue[key]; exists {
+			*queuePtr = append(*queuePtr, req)
+		} else {
+			node.pendingLockQueue[key] = &[]LockRequest{req}
+		}
+		if _, exists := node.pullLockRequestChan[key]; !exists {
+			lockRequestPing := make(chan struct{}, 1)
+			node.pullLockRequestChan[key] = lockRequestPing
+			// fmt.Printf("starting register\n")
+			go node.registerLockAcquireRequest(key, lockRequestPing)
+		}
+		node.pingLockQueue(key)
 	}
 	node.mu.Unlock()
-	var value LockInfo
-	lockKey := fmt.Sprintf("%s%s", LOCKING_KEY_PREFIX, req.Key)
-	if found, readErr := node.readFromStorage(lockKey, &value); readErr != nil {
-		fmt.Printf("could not read from db for key %s\n", req.Key)
-		return
-	} else if !found {
-		// fmt.Printf("sent ping\n")
-		lockRequestPing <- struct{}{}
+	node.breakDeadlocks()
+}
+
+// requestedLockKeys returns the set of keys req asks for, sorted and without
+// duplicates for multi-key requests.
+func requestedLockKeys(req LockRequest) []string {
+	if len(req.Keys) == 0 {
+		return []string{req.Key}
 	}
+	return normalizeLockKeys(req.Keys)
 }
 
-func (node *Node) registerLockAcquireRequest(queue *[]LockRequest, pullLockRequestChan chan struct{}) {
+func normalizeLockKeys(keys []string) []string {
+	seen := make(map[string]struct{}, len(keys))
+	normalized := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if _, dup := seen[key]; !dup && key != "" {
+			seen[key] = struct{}{}
+			normalized = append(normalized, key)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+// registerLockAcquireRequest serves the waiters queued on key, one at a time,
+// every time it is pinged and the lock is free.
+func (node *Node) registerLockAcquireRequest(key string, pullLockRequestChan chan struct{}) {
+	lockKey := fmt.Sprintf("%s%s", LOCKING_KEY_PREFIX, key)
 	for range pullLockRequestChan {
 		// fmt.Printf("pullLockedChan\n")
 		node.mu.Lock()
 		// fmt.Printf("pullLockedChan locked\n")
-		if len((*queue)) == 0 {
+		queue, exists := node.pendingLockQueue[key]
+		_, granting := node.grantingLocks[key]
+		if !exists || len((*queue)) == 0 || granting || node.db.Exists(lockKey) {
+			node.mu.Unlock()
+			continue
+		}
+		index := node.selectLockRequest(key)
+		req := (*queue)[index]
+		if len(req.Keys) > 0 {
+			if !node.multiLockReady(req) {
+				node.mu.Unlock()
+				continue
+			}
+			node.removePendingLockRequest(key, func(queued LockRequest) bool {
+				return queued.arrival == req.arrival
+			})
+			for _, k := range req.Keys {
+				node.grantingLocks[k] = struct{}{}
+				node.countLockGrant(k, req.ClientID)
+			}
 			node.mu.Unlock()
+			node.newLogEntry(MultiLockAcquireCommand{
+				Keys:          req.Keys,
+				ClientID:      req.ClientID,
+				SessionID:     req.SessionID,
+				TTL:           req.TTL,
+				FencingTokens: node.nextFencingTokens(req.Keys),
+				RequestID:     req.RequestID,
+				Seq:           req.Seq,
+				AckedSeq:      req.AckedSeq,
+			})
 			continue
 		}
-		req := (*queue)[0]
-		*queue = (*queue)[1:]
+		*queue = append((*queue)[:index], (*queue)[index+1:]...)
+		node.grantingLocks[key] = struct{}{}
+		node.countLockGrant(key, req.ClientID)
 		node.mu.Unlock()
-		fencingTokenKey := fmt.Sprintf("%s%s", FENCING_TOKEN_PREFIX, req.Key)
-		fencingTokenCmd := Read{
-			Key: fencingTokenKey,
+		cmd := LockAcquireCommand{
+			Key:          req.Key,
+			ClientID:     req.ClientID,
+			SessionID:    req.SessionID,
+			TTL:          req.TTL,
+			FencingToken: node.nextFencingToken(req.Key),
+			RequestID:    req.RequestID,
+			Reentrant:    req.Reentrant,
+			OwnerToken:   req.OwnerToken,
+			Seq:          req.Seq,
+			AckedSeq:     req.AckedSeq,
 		}
-		success, value, err := node.newLogEntry(fencingTokenCmd)
-		if err != nil {
-			log.Printf("cannot read value for fencing token for key %s\n", fencingTokenKey)
+		node.newLogEntry(cmd)
+		// fmt.Printf("added lock acquire command to the log\n")
+	}
+}
+
+// expireLockRequest drops req from the pending queue once its WaitTimeout has
+// elapsed and tells the client it gave up waiting.
+func (node *Node) expireLockRequest(req LockRequest) {
+	<-time.After(req.WaitTimeout)
+	node.mu.Lock()
+	var removed []LockRequest
+	for _, key := range requestedLockKeys(req) {
+		removed = append(removed, node.removePendingLockRequest(key, func(queued LockRequest) bool {
+			return queued.arrival == req.arrival
+		})...)
+		// the request may have been holding up the ones queued behind it
+		node.pingLockQueue(key)
+	}
+	node.mu.Unlock()
+	if len(removed) > 0 {
+		fmt.Printf("Lock request for %q from client %s timed out waiting\n", requestedLockKeys(req), req.ClientID)
+		node.server.NotifyLockFailure(req, LockReasonWaitTimeout)
+	}
+}
+
+// failTryAcquireRequests rejects every try-acquire request still waiting on
+// key, as the lock has just been handed to someone else.
+func (node *Node) failTryAcquireRequests(key string) {
+	node.mu.Lock()
+	removed := node.removePendingLockRequest(key, func(queued LockRequest) bool {
+		return queued.TryAcquire
+	})
+	node.mu.Unlock()
+	for _, req := range removed {
+		node.server.NotifyLockFailure(req, LockReasonHeld)
+	}
+}
+
+// replaceQueuedLockRequest lets req take over the place of a request for the
+// same keys its client still has waiting. A client that timed out waiting for
+// a reply retries under a new RequestID, and the retry must neither queue the
+// client twice nor be answered under the request it gave up on.
+// expects node.mu to be held
+func (node *Node) replaceQueuedLockRequest(req LockRequest) bool {
+	keys := requestedLockKeys(req)
+	queuePtr, exists := node.pendingLockQueue[keys[0]]
+	if !exists {
+		return false
+	}
+	for _, queued := range *queuePtr {
+		if queued.ClientID != req.ClientID || !slices.Equal(requestedLockKeys(queued), keys) {
 			continue
 		}
-		var fencingTokenValue uint64
-		if !success {
-			fencingTokenValue = 0
+		// a new seq detaches the wait timeout of the request being replaced
+		node.lockArrivals++
+		req.arrival = node.lockArrivals
+		req.queuedAt = queued.queuedAt
+		for _, key := range keys {
+			if queuePtr, exists := node.pendingLockQueue[key]; exists {
+				for i := range *queuePtr {
+					if (*queuePtr)[i].arrival == queued.arrival {
+						(*queuePtr)[i] = req
+					}
+				}
+			}
+		}
+		if req.WaitTimeout > 0 {
+			go node.expireLockRequest(req)
+		}
+		return true
+	}
+	return false
+}
+
+// removePendingLockRequest removes the requests matching match from key's
+// queue. Multi-key requests are taken out of the queues of their other keys
+// as well.
+// expects node.mu to be held
+func (node *Node) removePendingLockRequest(key string, match func(LockRequest) bool) []LockRequest {
+	queuePtr, exists := node.pendingLockQueue[key]
+	if !exists {
+		return nil
+	}
+	var removed []LockRequest
+	remaining := (*queuePtr)[:0]
+	for _, queued := range *queuePtr {
+		if match(queued) {
+			removed = append(removed, queued)
 		} else {
-			fencingTokenValue = value.(uint64) + 1
+			remaining = append(remaining, queued)
 		}
-		// fmt.Printf("fencing token value: %v\n", fencingTokenValue)
-		cmd := LockAcquireCommand{
-			Key:      req.Key,
-			ClientID: req.ClientID,
-			TTL:      req.TTL,
-			FencingToken: FencingToken{
-				Key:   fencingTokenKey,
-				Value: fencingTokenValue,
-			},
+	}
+	*queuePtr = remaining
+	for _, req := range removed {
+		for _, other := range req.Keys {
+			if otherQueue, exists := node.pendingLockQueue[other]; exists && other != key {
+				filtered := (*otherQueue)[:0]
+				for _, queued := range *otherQueue {
+					if queued.arrival != req.arrival {
+						filtered = append(filtered, queued)
+					}
+				}
+				*otherQueue = filtered
+			}
 		}
-		node.newLogEntry(cmd)
-		// fmt.Printf("added lock acquire command to the log\n")
 	}
+	return removed
 }
@@ -1,7 +1,6 @@
 package raft
 
 import (
-	"errors"
 	"fmt"
 	"math"
 	"time"
@@ -81,7 +80,7 @@ func (node *Node) RequestVote(args RequestVoteArgs, reply *RequestVoteReply) err
 		reply.VoteGranted = false
 	}
 	reply.Term = node.currentTerm
-	node.persistToStorage()
+	node.persistTermAndVote()
 	return nil
 }
 
@@ -101,10 +100,24 @@ func (node *Node) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesRepl
 			node.becomeFollower(args.Term, int64(args.LeaderId))
 		}
 		node.electionResetEvent = time.Now()
+		node.awaitPrecedingAppend(args)
 		if args.LastLogIndex == 0 ||
 			args.LastLogIndex <= uint64(len(node.log)) && args.LastLogTerm == node.log[args.LastLogIndex-1].Term {
 			reply.Success = true
-			node.log = append(node.log[:args.LastLogIndex], args.Entries...)
+			// entries already held are kept, so a stale or repeated request
+			// cannot cut the log short; only a conflicting suffix is dropped
+			for i, entry := range args.Entries {
+				index := args.LastLogIndex + uint64(i) + 1
+				if index <= uint64(len(node.log)) {
+					if node.log[index-1].Term == entry.Term {
+						continue
+					}
+					node.truncateLog(index - 1)
+				}
+				node.log = append(node.log, args.Entries[i:]...)
+				node.logAppended.Broadcast()
+				break
+			}
 			for _, entry := range args.Entries {
 				switch cmd := entry.Command.(type) {
 				case AddServer:
@@ -115,32 +128,13 @@ func (node *Node) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesRepl
 					if node.id != cmd.ServerId && node.peerList.Exists(cmd.ServerId) {
 						node.peerList.Remove(cmd.ServerId)
 					}
-				case LockReleaseCommand:
-					fmt.Printf("Called Lock release on follower %v\n", cmd)
-					var lockInfo LockInfo
-					lockKey := fmt.Sprintf("%s%s", LOCKING_KEY_PREFIX, cmd.Key)
-					found, readErr := node.readFromStorage(lockKey, &lockInfo)
-					if readErr != nil {
-						fmt.Printf("lock %v read fail\n", cmd.Key)
-						reply.Success = false
-						return errors.New("reading the lock info from db went wrong")
-					}
-					if !found {
-						continue
-					}
-					if lockInfo.Holder != cmd.ClientID {
-						fmt.Printf("different lock holder for lock %s\n", cmd.Key)
-						reply.Success = false
-						return fmt.Errorf("lock %s is held by someone else\n", cmd.Key)
-					}
-					node.db.Delete(lockKey)
-					fmt.Printf("Successfully deleted all traces of lock %s\n", cmd.Key)
 				}
 
 			}
-			if args.LeaderCommit > node.commitLength {
-				node.commitLength = uint64(math.Min(float64(args.LeaderCommit), float64((len(node.log)))))
-				node.newCommitReady <- struct{}{}
+			lastNewIndex := args.LastLogIndex + uint64(len(args.Entries))
+			if args.LeaderCommit > node.commitLength && lastNewIndex > node.commitLength {
+				node.commitLength = uint64(math.Min(float64(args.LeaderCommit), float64(lastNewIndex)))
+				node.signalCommit()
 			}
 		} else {
 			if args.LastLogIndex > uint64(len(node.log)) {
@@ -163,6 +157,28 @@ func (node *Node) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesRepl
 	return nil
 }
 
+// awaitPrecedingAppend holds an AppendEntries that starts past the end of
+// the log until the entries before it arrive. net/rpc serves each call on its
+// own goroutine, so a pipelined batch can overtake the previous one; it is
+// only rejected if the gap is still there after APPEND_REORDER_WAIT.
+// node.mu must be held.
+func (node *Node) awaitPrecedingAppend(args AppendEntriesArgs) {
+	if len(args.Entries) == 0 || args.LastLogIndex <= uint64(len(node.log)) {
+		return
+	}
+	deadline := time.Now().Add(APPEND_REORDER_WAIT)
+	timer := time.AfterFunc(APPEND_REORDER_WAIT, func() {
+		node.mu.Lock()
+		node.logAppended.Broadcast()
+		node.mu.Unlock()
+	})
+	defer timer.Stop()
+	for args.LastLogIndex > uint64(len(node.log)) && node.state == Follower &&
+		node.currentTerm == args.Term && time.Now().Before(deadline) {
+		node.logAppended.Wait()
+	}
+}
+
 func (node *Node) AppendData(args AppendDataArgs, reply *AppendDataReply) error {
 	node.mu.Lock()
 	if node.state != Leader || node.currentTerm > args.Term {
@@ -176,7 +192,11 @@ func (node *Node) AppendData(args AppendDataArgs, reply *AppendDataReply) error
 	reply.Term = node.currentTerm
 	reply.LeaderId = int64(node.id)
 	node.mu.Unlock()
-	reply.Result.Success, reply.Result.Value, reply.Result.Error = node.newLogEntry(args.Cmd)
+	var err error
+	reply.Result.Success, reply.Result.Value, err = node.newLogEntry(args.Cmd)
+	if err != nil {
+		reply.Result.Error = err.Error()
+	}
 	return nil
 }
 
@@ -61,7 +61,19 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
 }
 
-func (server *Server) handleClientLockCommands(conn *websocket.Conn) {
+func (server *Server) handleClientLockCommands(conn *websocket.Conn, clientID string, sessionID string) {
+	defer server.node.dropWatchers(conn)
+	// KV writes and transactions wait until they are applied, so like
+	// releases they must not hold up the requests read after them. They run
+	// one at a time on their own goroutine instead, so the client's writes
+	// are proposed in the order it sent them.
+	kvRequests := make(chan func(), MAX_PENDING_KV_REQUESTS)
+	defer close(kvRequests)
+	go func() {
+		for handle := range kvRequests {
+			handle()
+		}
+	}()
 	for {
 		if conn == nil {
 			break
@@ -72,53 +84,230 @@ func (server *Server) handleClientLockCommands(conn *websocket.Conn) {
 			break
 		}
 
+		var env Envelope
+		err = json.Unmarshal(msg, &env)
+		if err != nil {
+			log.Printf("Error decoding Envelope: %v", err)
+			server.sendToClient(clientID, "", MessageError, ErrorReply{Message: "malformed envelope"})
+			continue
+		}
+		if env.Version != LOCK_PROTOCOL_VERSION {
+			server.sendToClient(clientID, env.RequestID, MessageError, ErrorReply{
+				Message: fmt.Sprintf("unsupported protocol version %d, expected %d", env.Version, LOCK_PROTOCOL_VERSION),
+			})
+			continue
+		}
+
+		if env.Type == MessageBarrier || env.Type == MessageLatch {
+			var req CoordinationRequest
+			if err := json.Unmarshal(env.Payload, &req); err != nil {
+				server.sendToClient(clientID, env.RequestID, MessageError, ErrorReply{Message: "malformed coordination request"})
+				continue
+			}
+			server.handleCoordinationRequest(clientID, sessionID, env, req)
+			continue
+		}
+		if env.Type == MessageQueue {
+			var req QueueRequest
+			if err := json.Unmarshal(env.Payload, &req); err != nil {
+				server.sendToClient(clientID, env.RequestID, MessageError, ErrorReply{Message: "malformed queue request"})
+				continue
+			}
+			server.handleQueueRequest(clientID, sessionID, env, req)
+			continue
+		}
+		if env.Type == MessageKV {
+			var req KVRequest
+			if err := json.Unmarshal(env.Payload, &req); err != nil {
+				server.sendToClient(clientID, env.RequestID, MessageError, ErrorReply{Message: "malformed kv request"})
+				continue
+			}
+			kvRequests <- func() { server.handleKVRequest(clientID, env, req) }
+			continue
+		}
+		if env.Type == MessageWatch {
+			var req WatchRequest
+			if err := json.Unmarshal(env.Payload, &req); err != nil {
+				server.sendToClient(clientID, env.RequestID, MessageError, ErrorReply{Message: "malformed watch request"})
+				continue
+			}
+			server.handleWatchRequest(conn, clientID, env, req)
+			continue
+		}
+		if env.Type == MessageTxn {
+			var txn Txn
+			if err := json.Unmarshal(env.Payload, &txn); err != nil {
+				server.sendToClient(clientID, env.RequestID, MessageError, ErrorReply{Message: "malformed txn request"})
+				continue
+			}
+			kvRequests <- func() { server.handleTxnRequest(clientID, env, txn) }
+			continue
+		}
+
 		var req LockRequest
-		err = json.Unmarshal(msg, &req)
+		err = json.Unmarshal(env.Payload, &req)
 		if err != nil {
 			log.Printf("Error decoding LockCommand: %v", err)
+			server.sendToClient(clientID, env.RequestID, MessageError, ErrorReply{Message: "malformed lock request"})
 			continue
 		}
+		req.ClientID = clientID
+		req.SessionID = sessionID
+		req.RequestID = env.RequestID
+		req.Seq = env.Seq
+		req.AckedSeq = env.AckedSeq
+		if len(req.Keys) > 0 {
+			req.Key = ""
+			req.Keys = normalizeLockKeys(req.Keys)
+		}
 
 		// fmt.Printf("req: %v\n", req)
-		if req.CommandType == LockAcquire {
+		switch env.Type {
+		case MessageAcquire:
+			req.CommandType = LockAcquire
 			server.node.handleLockAcquireRequest(req)
-		} else if req.CommandType == LockRelease {
-			cmd := LockReleaseCommand{
-				Key:      req.Key,
-				ClientID: req.ClientID,
-			}
-			success, result, err := server.SubmitToServer(cmd)
-			if err != nil {
-				log.Printf("Error submitting LockCommand: %v", err)
-			} else if success {
-				log.Printf("LockCommand for key %q from client %s applied successfully, result: %v", cmd.Key, cmd.ClientID, result)
-			} else {
-				log.Printf("LockCommand for key %q from client %s was not applied, result: %v", cmd.Key, cmd.ClientID, result)
-			}
+		case MessageRelease:
+			req.CommandType = LockRelease
+			// releases and renewals wait on the log, so they must not hold up
+			// the requests read after them
+			go server.handleLockRelease(clientID, env, req)
+		case MessageRenew:
+			go server.handleLockRenew(clientID, env, req)
+		case MessageSession:
+			go server.handleSessionKeepAlive(clientID, sessionID, env)
+		default:
+			server.sendToClient(clientID, env.RequestID, MessageError, ErrorReply{
+				Message: fmt.Sprintf("unknown message type %q", env.Type),
+			})
 		}
 	}
 }
 
-func (server *Server) NotifyLockAcquire(clientID string, fencingToken FencingToken) {
-	server.wsMu.Lock()
-	conn, ok := server.wsClients[clientID]
-	server.wsMu.Unlock()
-	if ok {
-		lockRes := LockAcquireReply{
-			Success:      true,
-			FencingToken: fencingToken,
+func (server *Server) handleLockRelease(clientID string, env Envelope, req LockRequest) {
+	if len(req.Keys) > 0 {
+		cmd := MultiLockReleaseCommand{
+			Keys:     req.Keys,
+			ClientID: req.ClientID,
 		}
-		data, err := json.Marshal(lockRes)
+		success, _, err := server.SubmitToServer(cmd)
+		reply := LockReleaseReply{Success: success && err == nil, Keys: req.Keys}
 		if err != nil {
-			fmt.Printf("json marshal error: %v\n", err)
-			return
-		}
-		err = conn.WriteMessage(websocket.TextMessage, data)
-		if err != nil {
-			fmt.Printf("Error notifying client %s: %v\n", clientID, err)
+			reply.Error = err.Error()
 		}
+		server.sendToClient(clientID, env.RequestID, MessageRelease, reply)
+		return
+	}
+	cmd := LockReleaseCommand{
+		Key:        req.Key,
+		ClientID:   req.ClientID,
+		OwnerToken: req.OwnerToken,
+	}
+	success, result, err := server.SubmitToServer(cmd)
+	reply := LockReleaseReply{Success: success && err == nil, Key: req.Key}
+	if err != nil {
+		log.Printf("Error submitting LockCommand: %v", err)
+		reply.Error = err.Error()
+	} else if success {
+		log.Printf("LockCommand for key %q from client %s applied successfully, result: %v", cmd.Key, cmd.ClientID, result)
 	} else {
+		log.Printf("LockCommand for key %q from client %s was not applied, result: %v", cmd.Key, cmd.ClientID, result)
+	}
+	server.sendToClient(clientID, env.RequestID, MessageRelease, reply)
+}
+
+// handleLockRenew waits for the renewal to be applied and answers with the
+// expiry time it was given there.
+func (server *Server) handleLockRenew(clientID string, env Envelope, req LockRequest) {
+	cmd := LockRenewCommand{
+		Key:      req.Key,
+		ClientID: req.ClientID,
+		TTL:      req.TTL,
+	}
+	success, result, err := server.SubmitToServer(cmd)
+	reply := LockRenewReply{Key: req.Key}
+	if err != nil {
+		reply.Error = err.Error()
+	} else if applied, ok := result.(LockRenewReply); success && ok {
+		reply = applied
+	} else {
+		reply.Error = "lock renewal could not be submitted, try different server(leader)"
+	}
+	server.sendToClient(clientID, env.RequestID, MessageRenew, reply)
+}
+
+// handleSessionKeepAlive waits for the keepalive to be applied and answers
+// with the expiry time the session was given there.
+func (server *Server) handleSessionKeepAlive(clientID string, sessionID string, env Envelope) {
+	success, result, err := server.SubmitToServer(SessionKeepAliveCommand{SessionID: sessionID})
+	reply := SessionKeepAliveReply{SessionID: sessionID}
+	if err != nil {
+		reply.Error = err.Error()
+	} else if applied, ok := result.(SessionKeepAliveReply); success && ok {
+		reply = applied
+	} else {
+		reply.Error = "session keepalive could not be submitted, try different server(leader)"
+	}
+	server.sendToClient(clientID, env.RequestID, MessageSession, reply)
+}
+
+func (server *Server) NotifyLockAcquire(clientID string, requestID string, key string, fencingToken FencingToken) {
+	server.sendToClient(clientID, requestID, MessageAcquire, LockAcquireReply{
+		Success:      true,
+		Key:          key,
+		FencingToken: fencingToken,
+	})
+}
+
+func (server *Server) NotifyMultiLockAcquire(clientID string, requestID string, keys []string, fencingTokens []FencingToken) {
+	server.sendToClient(clientID, requestID, MessageAcquire, LockAcquireReply{
+		Success:       true,
+		Keys:          keys,
+		FencingTokens: fencingTokens,
+	})
+}
+
+func (server *Server) NotifyLockFailure(req LockRequest, reason string) {
+	server.sendToClient(req.ClientID, req.RequestID, MessageAcquire, LockAcquireReply{
+		Success: false,
+		Key:     req.Key,
+		Keys:    req.Keys,
+		Reason:  reason,
+	})
+}
+
+func (server *Server) NotifyLockEvent(clientID string, event LockEvent) {
+	server.sendToClient(clientID, "", MessageEvent, event)
+}
+
+// sendToClient wraps payload in an Envelope and writes it to the client's
+// websocket. Writes are serialised under wsMu as a connection supports only
+// one concurrent writer.
+func (server *Server) sendToClient(clientID string, requestID string, msgType MessageType, payload interface{}) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		fmt.Printf("json marshal error: %v\n", err)
+		return
+	}
+	data, err = json.Marshal(Envelope{
+		Version:   LOCK_PROTOCOL_VERSION,
+		RequestID: requestID,
+		Type:      msgType,
+		Payload:   data,
+	})
+	if err != nil {
+		fmt.Printf("json marshal error: %v\n", err)
+		return
+	}
+	server.wsMu.Lock()
+	defer server.wsMu.Unlock()
+	conn, ok := server.wsClients[clientID]
+	if !ok {
 		fmt.Printf("No websocket found for client %s\n", clientID)
+		return
+	}
+	err = conn.WriteMessage(websocket.TextMessage, data)
+	if err != nil {
+		fmt.Printf("Error notifying client %s: %v\n", clientID, err)
 	}
 }
 
@@ -145,6 +334,12 @@ func (server *Server) WSHandler(w http.ResponseWriter, r *http.Request) {
 	leader, _, isLeader := server.CheckLeader()
 	var reply ConnectionReply
 	if isLeader {
+		reply.SessionID, reply.SessionTTL, err = server.openSession(req.ClientID, req.SessionID, req.SessionTTL)
+		if err != nil {
+			log.Printf("Error opening session for client %s: %v", req.ClientID, err)
+			conn.Close()
+			return
+		}
 		reply.Success = true
 		reply.Leader = int64(server.id)
 		// fmt.Printf("Found the leader\n")
@@ -155,7 +350,6 @@ func (server *Server) WSHandler(w http.ResponseWriter, r *http.Request) {
 		server.wsClients[req.ClientID] = conn
 		server.wsMu.Unlock()
 		fmt.Printf("WebSocket connection established for client: %s\n", req.ClientID)
-		go server.handleClientLockCommands(conn)
 	} else {
 		// fmt.Printf("Did not find the leader\n")
 		reply.Success = false
@@ -166,11 +360,16 @@ func (server *Server) WSHandler(w http.ResponseWriter, r *http.Request) {
 		fmt.Printf("json marshal error: %v\n", err)
 		return
 	}
+	server.wsMu.Lock()
 	err = conn.WriteMessage(websocket.TextMessage, data)
+	server.wsMu.Unlock()
 	if err != nil {
 		fmt.Printf("Write failed\n")
 		return
 	}
+	if isLeader {
+		go server.handleClientLockCommands(conn, req.ClientID, reply.SessionID)
+	}
 }
 
 // func (server *Server)
@@ -197,8 +396,15 @@ func (server *Server) Serve(port ...string) {
 	go server.ConnectionAccept()
 
 	httpPort := fmt.Sprintf(":%d", 50050+server.id)
-	http.HandleFunc("/ws", server.WSHandler)
-	go http.ListenAndServe(httpPort, nil)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", server.WSHandler)
+	mux.HandleFunc("/fencing", server.FencingHandler)
+	mux.HandleFunc("/fencing/validate", server.FencingValidateHandler)
+	mux.HandleFunc("/admin/locks", requireOperator(server.AdminLocksHandler))
+	mux.HandleFunc("/admin/locks/release", requireOperator(server.AdminForceReleaseHandler))
+	mux.HandleFunc("/admin/locks/policy", requireOperator(server.AdminLockPolicyHandler))
+	mux.HandleFunc("/admin/audit", requireOperator(server.AdminAuditHandler))
+	go http.ListenAndServe(httpPort, mux)
 	log.Printf("[%v] Listening for WebSocket connections at ws://localhost:%s/ws\n", server.id, httpPort)
 }
 
@@ -290,6 +496,27 @@ func (server *Server) RPC(peerId uint64, rpcCall string, args interface{}, reply
 	}
 }
 
+// RPCAsync starts a call to peerId without waiting for the reply, which is
+// signalled on the Done channel of the returned call. Calls started one after
+// another are written to the connection in that order.
+func (server *Server) RPCAsync(peerId uint64, rpcCall string, args interface{}, reply interface{}) *rpc.Call {
+	server.mu.Lock()
+	peer := server.peers[peerId]
+	server.mu.Unlock()
+	if peer == nil {
+		call := &rpc.Call{
+			ServiceMethod: rpcCall,
+			Args:          args,
+			Reply:         reply,
+			Error:         fmt.Errorf("[%d] RPC Call to peer %d after it has been closed", server.id, peerId),
+			Done:          make(chan *rpc.Call, 1),
+		}
+		call.Done <- call
+		return call
+	}
+	return peer.Go(rpcCall, args, reply, make(chan *rpc.Call, 1))
+}
+
 func (server *Server) GetServerId() uint64 {
 	return server.id
 }
@@ -0,0 +1,169 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+func sessionKey(sessionID string) string {
+	return fmt.Sprintf("%s%s", SESSION_KEY_PREFIX, sessionID)
+}
+
+func (node *Node) getSession(sessionID string) (Session, bool) {
+	var session Session
+	found, readErr := node.readFromStorage(sessionKey(sessionID), &session)
+	if readErr != nil {
+		return session, false
+	}
+	return session, found
+}
+
+func (node *Node) getAllSessions() map[string]Session {
+	sessions := make(map[string]Session)
+	for _, key := range node.db.Keys() {
+		if strings.HasPrefix(key, SESSION_KEY_PREFIX) {
+			var session Session
+			if found, _ := node.readFromStorage(key, &session); found {
+				sessions[session.ID] = session
+			}
+		}
+	}
+	return sessions
+}
+
+// openSession resumes the client's previous session if it is still alive,
+// otherwise it opens a new one. Called on the leader when a client connects.
+func (server *Server) openSession(clientID string, sessionID string, ttl time.Duration) (string, time.Duration, error) {
+	if sessionID != "" {
+		if session, found := server.node.getSession(sessionID); found && session.ClientID == clientID {
+			_, result, err := server.SubmitToServer(SessionKeepAliveCommand{SessionID: sessionID})
+			if applied, ok := result.(SessionKeepAliveReply); err == nil && ok && applied.Success {
+				fmt.Printf("Resumed session %s for client %s\n", sessionID, clientID)
+				return sessionID, session.TTL, nil
+			}
+		}
+		fmt.Printf("Session %s of client %s has expired, opening a new one\n", sessionID, clientID)
+	}
+	if ttl <= 0 {
+		ttl = DEFAULT_SESSION_TTL
+	}
+	cmd := SessionCreateCommand{
+		SessionID: fmt.Sprintf("%s-%d", clientID, time.Now().UnixNano()),
+		ClientID:  clientID,
+		TTL:       ttl,
+	}
+	success, _, err := server.SubmitToServer(cmd)
+	if err != nil {
+		return "", 0, err
+	}
+	if !success {
+		return "", 0, errors.New("session could not be opened, try different server(leader)")
+	}
+	return cmd.SessionID, ttl, nil
+}
+
+func (node *Node) applySessionCreate(cmd SessionCreateCommand) {
+	session := Session{
+		ID:         cmd.SessionID,
+		ClientID:   cmd.ClientID,
+		TTL:        cmd.TTL,
+		ExpiryTime: node.entryTime().Add(cmd.TTL),
+	}
+	node.setData(sessionKey(session.ID), session)
+	node.mu.Lock()
+	node.startSessionMonitor(session.ID, session.ExpiryTime)
+	node.mu.Unlock()
+}
+
+// applySessionKeepAlive extends the session by its TTL from the entry time.
+// The reply carries the expiry time the replicas applied.
+func (node *Node) applySessionKeepAlive(cmd SessionKeepAliveCommand) SessionKeepAliveReply {
+	reply := SessionKeepAliveReply{SessionID: cmd.SessionID}
+	session, found := node.getSession(cmd.SessionID)
+	if !found {
+		reply.Error = fmt.Sprintf("session %s has expired", cmd.SessionID)
+		return reply
+	}
+	session.ExpiryTime = node.entryTime().Add(session.TTL)
+	node.setData(sessionKey(session.ID), session)
+	node.mu.Lock()
+	node.startSessionMonitor(session.ID, session.ExpiryTime)
+	node.mu.Unlock()
+	reply.Success = true
+	reply.ExpiryTime = session.ExpiryTime
+	return reply
+}
+
+// applySessionExpire ends the session and releases every lock it owns as
+// part of the same log entry, so all replicas drop them together. Locks are
+// the only resource a session owns; there are no semaphores yet.
+func (node *Node) applySessionExpire(cmd SessionExpireCommand) {
+	session, found := node.getSession(cmd.SessionID)
+	if !found {
+		return
+	}
+	node.db.Delete(sessionKey(session.ID))
+	node.dropClientRequests(session.ClientID)
+	node.dropCoordinationWaiters(session.ID)
+	// audit records are numbered in the order they are made, so the locks
+	// are visited in key order for every replica to number them alike
+	lockKeyValues := node.getAllLockKeyValues()
+	keys := make([]string, 0, len(lockKeyValues))
+	for key := range lockKeyValues {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if lockInfo := lockKeyValues[key]; lockInfo.SessionID == session.ID {
+			node.releaseLock(key, lockInfo.Holder)
+			record := lockAuditRecord(AuditLockExpired, key, lockInfo)
+			record.Reason = "session expired"
+			node.recordLockAudit(record)
+			fmt.Printf("Released lock %s held by expired session %s\n", key, session.ID)
+		}
+	}
+
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if cancelMonitor, exists := node.activeSessionMonitorCancel[session.ID]; exists {
+		cancelMonitor()
+		delete(node.activeSessionMonitorCancel, session.ID)
+	}
+	if node.state == Leader {
+		for key := range node.pendingLockQueue {
+			node.removePendingLockRequest(key, func(queued LockRequest) bool {
+				return queued.SessionID == session.ID
+			})
+		}
+	}
+	fmt.Printf("Session %s of client %s expired\n", session.ID, session.ClientID)
+}
+
+// expects node.mu to be held
+func (node *Node) startSessionMonitor(sessionID string, expiryTime time.Time) {
+	if node.state != Leader {
+		return
+	}
+	if cancelMonitor, exists := node.activeSessionMonitorCancel[sessionID]; exists {
+		cancelMonitor()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	node.activeSessionMonitorCancel[sessionID] = cancel
+	go node.monitorSessionExpiry(ctx, sessionID, expiryTime)
+}
+
+func (node *Node) monitorSessionExpiry(ctx context.Context, sessionID string, expiryTime time.Time) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(time.Until(expiryTime)):
+		if _, found := node.getSession(sessionID); found {
+			fmt.Printf("Session %s missed its heartbeats, expiring it\n", sessionID)
+			node.newLogEntry(SessionExpireCommand{SessionID: sessionID})
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package raft
+
+import "math/rand"
+
+// A skiplist keeps the keys of a Database in order, so a write costs
+// O(log n) however many keys the store holds: the log entries, the KV
+// history, the audit trail and the locks all share one keyspace. Each link
+// also records how many keys it skips, after Redis's sorted sets, which
+// gives the number of keys below any key in O(log n) too.
+
+const skiplistMaxLevel = 32
+
+type skiplistNode struct {
+	key  string
+	next []*skiplistNode
+	span []int // keys passed by following next at each level
+}
+
+type skiplist struct {
+	head   *skiplistNode
+	level  int
+	length int
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		head: &skiplistNode{
+			next: make([]*skiplistNode, skiplistMaxLevel),
+			span: make([]int, skiplistMaxLevel),
+		},
+		level: 1,
+	}
+}
+
+func randomSkiplistLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && rand.Intn(4) == 0 {
+		level++
+	}
+	return level
+}
+
+// insert adds key, which must not be in the list yet.
+func (list *skiplist) insert(key string) {
+	var update [skiplistMaxLevel]*skiplistNode
+	var rank [skiplistMaxLevel]int
+	x := list.head
+	for i := list.level - 1; i >= 0; i-- {
+		if i < list.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.next[i] != nil && x.next[i].key < key {
+			rank[i] += x.span[i]
+			x = x.next[i]
+		}
+		update[i] = x
+	}
+	level := randomSkiplistLevel()
+	for i := list.level; i < level; i++ {
+		update[i] = list.head
+		update[i].span[i] = list.length
+	}
+	if level > list.level {
+		list.level = level
+	}
+	node := &skiplistNode{key: key, next: make([]*skiplistNode, level), span: make([]int, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+		node.span[i] = update[i].span[i] - (rank[0] - rank[i])
+		update[i].span[i] = rank[0] - rank[i] + 1
+	}
+	for i := level; i < list.level; i++ {
+		update[i].span[i]++
+	}
+	list.length++
+}
+
+// remove drops key if it is in the list.
+func (list *skiplist) remove(key string) {
+	var update [skiplistMaxLevel]*skiplistNode
+	x := list.head
+	for i := list.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		update[i] = x
+	}
+	x = x.next[0]
+	if x == nil || x.key != key {
+		return
+	}
+	for i := 0; i < list.level; i++ {
+		if update[i].next[i] == x {
+			update[i].span[i] += x.span[i] - 1
+			update[i].next[i] = x.next[i]
+		} else {
+			update[i].span[i]--
+		}
+	}
+	for list.level > 1 && list.head.next[list.level-1] == nil {
+		list.level--
+	}
+	list.length--
+}
+
+// seek returns the node of the first key >= key, or nil if there is none.
+func (list *skiplist) seek(key string) *skiplistNode {
+	x := list.head
+	for i := list.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+	}
+	return x.next[0]
+}
+
+// before returns the node of the last key < key, or of the last key of all
+// if key is empty, and nil if there is none.
+func (list *skiplist) before(key string) *skiplistNode {
+	x := list.head
+	for i := list.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && (key == "" || x.next[i].key < key) {
+			x = x.next[i]
+		}
+	}
+	if x == list.head {
+		return nil
+	}
+	return x
+}
+
+// rank returns how many keys are < key.
+func (list *skiplist) rank(key string) int {
+	rank := 0
+	x := list.head
+	for i := list.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			rank += x.span[i]
+			x = x.next[i]
+		}
+	}
+	return rank
+}
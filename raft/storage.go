@@ -1,8 +1,6 @@
 package raft
 
-import (
-	"sync"
-)
+import "sync"
 
 type Storage interface {
 	HasData() bool
@@ -10,14 +8,21 @@ type Storage interface {
 	Get(key string) ([]byte, bool)
 }
 
+type KeyValue struct {
+	Key   string
+	Value []byte
+}
+
 type Database struct {
-	mu sync.Mutex
-	kv map[string][]byte
+	mu   sync.Mutex
+	kv   map[string][]byte
+	keys *skiplist // every key in kv, in order for range scans
 }
 
 func NewDatabase() *Database {
 	return &Database{
-		kv: make(map[string][]byte),
+		kv:   make(map[string][]byte),
+		keys: newSkiplist(),
 	}
 }
 
@@ -31,6 +36,9 @@ func (db *Database) Get(key string) ([]byte, bool) {
 func (db *Database) Set(key string, value []byte) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	if _, exists := db.kv[key]; !exists {
+		db.keys.insert(key)
+	}
 	db.kv[key] = value
 }
 
@@ -43,9 +51,29 @@ func (db *Database) HasData() bool {
 func (db *Database) Delete(key string) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	if _, exists := db.kv[key]; !exists {
+		return
+	}
+	db.keys.remove(key)
 	delete(db.kv, key)
 }
 
+// DeleteRange deletes the keys with start <= key < end and returns how many
+// there were. An empty end means there is no upper bound.
+func (db *Database) DeleteRange(start string, end string) int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var deleted []string
+	for node := db.keys.seek(start); node != nil && (end == "" || node.key < end); node = node.next[0] {
+		deleted = append(deleted, node.key)
+	}
+	for _, key := range deleted {
+		db.keys.remove(key)
+		delete(db.kv, key)
+	}
+	return len(deleted)
+}
+
 func (db *Database) Exists(key string) bool {
 	db.mu.Lock()
 	defer db.mu.Unlock()
@@ -53,13 +81,72 @@ func (db *Database) Exists(key string) bool {
 	return ok
 }
 
+// Keys returns every key in sorted order.
 func (db *Database) Keys() []string {
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	keys := make([]string, 0, len(db.kv))
-	for k := range db.kv {
-		keys = append(keys, k)
+	keys := make([]string, 0, db.keys.length)
+	for node := db.keys.head.next[0]; node != nil; node = node.next[0] {
+		keys = append(keys, node.key)
 	}
 	// fmt.Printf("KEYS: %v\n", keys)
 	return keys
 }
+
+// Range returns the entries with start <= key < end in key order. An empty
+// end means there is no upper bound, and a limit of 0 means no limit.
+func (db *Database) Range(start string, end string, limit int) []KeyValue {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var entries []KeyValue
+	for node := db.keys.seek(start); node != nil; node = node.next[0] {
+		if end != "" && node.key >= end {
+			break
+		}
+		if limit > 0 && len(entries) == limit {
+			break
+		}
+		entries = append(entries, KeyValue{Key: node.key, Value: db.kv[node.key]})
+	}
+	return entries
+}
+
+// CountRange returns how many keys there are with start <= key < end. An
+// empty end means there is no upper bound.
+func (db *Database) CountRange(start string, end string) int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	to := db.keys.length
+	if end != "" {
+		to = db.keys.rank(end)
+	}
+	if from := db.keys.rank(start); to > from {
+		return to - from
+	}
+	return 0
+}
+
+// Last returns the greatest entry with start <= key < end. An empty end
+// means there is no upper bound.
+func (db *Database) Last(start string, end string) (KeyValue, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	node := db.keys.before(end)
+	if node == nil || node.key < start {
+		return KeyValue{}, false
+	}
+	return KeyValue{Key: node.key, Value: db.kv[node.key]}, true
+}
+
+// prefixEnd returns the smallest key greater than every key starting with
+// prefix, or "" if there is none.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
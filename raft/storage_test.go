@@ -0,0 +1,75 @@
+package raft
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// The ordered index must agree with a sorted copy of the keys through any
+// mix of writes and deletes.
+func TestDatabaseScansMatchSortedKeys(t *testing.T) {
+	db := NewDatabase()
+	present := make(map[string]bool)
+	key := func() string { return fmt.Sprintf("k%03d", rand.Intn(300)) }
+	for i := 0; i < 5000; i++ {
+		switch rand.Intn(10) {
+		case 0:
+			start, end := key(), key()
+			if end < start {
+				start, end = end, start
+			}
+			deleted := 0
+			for k := range present {
+				if k >= start && k < end {
+					delete(present, k)
+					deleted++
+				}
+			}
+			if got := db.DeleteRange(start, end); got != deleted {
+				t.Fatalf("DeleteRange(%s, %s) deleted %d keys, want %d", start, end, got, deleted)
+			}
+		case 1, 2, 3:
+			k := key()
+			db.Delete(k)
+			delete(present, k)
+		default:
+			k := key()
+			db.Set(k, []byte(k))
+			present[k] = true
+		}
+	}
+
+	var sorted []string
+	for k := range present {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	if keys := db.Keys(); fmt.Sprint(keys) != fmt.Sprint(sorted) {
+		t.Fatalf("Keys() = %v, want %v", keys, sorted)
+	}
+	for _, bounds := range [][2]string{{"", ""}, {"k100", "k200"}, {"k150", ""}, {"k200", "k100"}, {"k050", "k051"}} {
+		start, end := bounds[0], bounds[1]
+		var want []string
+		for _, k := range sorted {
+			if k >= start && (end == "" || k < end) {
+				want = append(want, k)
+			}
+		}
+		var got []string
+		for _, entry := range db.Range(start, end, 0) {
+			got = append(got, entry.Key)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("Range(%q, %q) = %v, want %v", start, end, got, want)
+		}
+		if count := db.CountRange(start, end); count != len(want) {
+			t.Errorf("CountRange(%q, %q) = %d, want %d", start, end, count, len(want))
+		}
+		last, found := db.Last(start, end)
+		if found != (len(want) > 0) || found && last.Key != want[len(want)-1] {
+			t.Errorf("Last(%q, %q) = %q, %v; want the last of %v", start, end, last.Key, found, want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package raft
+
+import (
+	"net/rpc"
+	"sync"
+)
+
+// An appendStream carries the AppendEntries the leader sends one follower.
+// Calls made on net/rpc from separate goroutines reach the follower in any
+// order, and a pipelined batch that overtakes the one before it is rejected
+// for leaving a gap in the log. The stream writes requests to the connection
+// in the order they were built and handles the replies in that same order.
+type appendStream struct {
+	peer   uint64
+	mu     sync.Mutex
+	queued []appendRequest
+	wake   chan struct{}
+	sent   chan appendCall // calls awaiting a reply, oldest first
+	stop   chan struct{}
+}
+
+type appendCall struct {
+	request appendRequest
+	reply   *AppendEntriesReply
+	call    *rpc.Call
+}
+
+// streamTo returns the stream to peer, starting it if there is none.
+// node.mu must be held.
+func (node *Node) streamTo(peer uint64) *appendStream {
+	stream, exists := node.appendStreams[peer]
+	if !exists {
+		stream = &appendStream{
+			peer: peer,
+			wake: make(chan struct{}, 1),
+			sent: make(chan appendCall, MAX_STREAM_APPENDS),
+			stop: make(chan struct{}),
+		}
+		node.appendStreams[peer] = stream
+		go node.writeAppends(stream)
+		go node.readAppendReplies(stream)
+	}
+	return stream
+}
+
+// push queues requests behind those already on the stream. Replicating and
+// probing are flow controlled by the progress, but heartbeats are not, so a
+// heartbeat replaces any still queued: a follower that stopped answering is
+// sent one with the latest commit index rather than one per round. It never
+// blocks, so it may be called with node.mu held.
+func (stream *appendStream) push(requests []appendRequest) {
+	stream.mu.Lock()
+	for _, request := range requests {
+		if request.kind == appendHeartbeat {
+			queued := stream.queued[:0]
+			for _, waiting := range stream.queued {
+				if waiting.kind != appendHeartbeat {
+					queued = append(queued, waiting)
+				}
+			}
+			stream.queued = queued
+		}
+		stream.queued = append(stream.queued, request)
+	}
+	stream.mu.Unlock()
+	select {
+	case stream.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (stream *appendStream) close() {
+	close(stream.stop)
+}
+
+// closeAppendStreams stops the streams of a leader that is stepping down, so
+// nothing more is written to its followers. node.mu must be held.
+func (node *Node) closeAppendStreams() {
+	for peer, stream := range node.appendStreams {
+		stream.close()
+		delete(node.appendStreams, peer)
+	}
+}
+
+// writeAppends starts the queued calls one after another; each is on the
+// connection before the next is started.
+func (node *Node) writeAppends(stream *appendStream) {
+	defer close(stream.sent)
+	for {
+		select {
+		case <-stream.stop:
+			return
+		case <-stream.wake:
+		}
+		stream.mu.Lock()
+		queued := stream.queued
+		stream.queued = nil
+		stream.mu.Unlock()
+		for _, request := range queued {
+			reply := new(AppendEntriesReply)
+			call := node.server.RPCAsync(stream.peer, "RaftNode.AppendEntries", request.args, reply)
+			select {
+			case stream.sent <- appendCall{request: request, reply: reply, call: call}:
+			case <-stream.stop:
+				return
+			}
+		}
+	}
+}
+
+func (node *Node) readAppendReplies(stream *appendStream) {
+	for sent := range stream.sent {
+		<-sent.call.Done
+		node.handleAppendResult(stream.peer, sent.request, *sent.reply, sent.call.Error)
+	}
+}
@@ -0,0 +1,138 @@
+package raft
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// validateTxn is run before a transaction is appended to the log.
+func validateTxn(txn Txn) error {
+	if len(txn.Compare)+len(txn.Success)+len(txn.Failure) > MAX_TXN_OPS {
+		return fmt.Errorf("transaction has more than %d comparisons and operations", MAX_TXN_OPS)
+	}
+	for _, cmp := range txn.Compare {
+		if err := validateKV(cmp.Key, cmp.Value); err != nil {
+			return err
+		}
+		if cmp.Target != TxnTargetValue && cmp.Target != TxnTargetVersion {
+			return fmt.Errorf("unknown comparison target %q for key %s", cmp.Target, cmp.Key)
+		}
+		switch cmp.Result {
+		case TxnEqual, TxnNotEqual, TxnLess, TxnGreater:
+		default:
+			return fmt.Errorf("unknown comparison %q for key %s", cmp.Result, cmp.Key)
+		}
+	}
+	for _, ops := range [][]TxnOp{txn.Success, txn.Failure} {
+		for _, op := range ops {
+			if err := validateKV(op.Key, op.Value); err != nil {
+				return err
+			}
+			switch op.Op {
+			case KVPut, KVGet, KVDelete:
+			default:
+				return fmt.Errorf("unknown transaction operation %q", op.Op)
+			}
+		}
+	}
+	if len(txn.Success) == 0 && len(txn.Failure) == 0 {
+		return errors.New("transaction has no operations")
+	}
+	return nil
+}
+
+func (node *Node) txnCompareHolds(cmp TxnCompare) bool {
+	entry, _ := node.readKV(cmp.Key)
+	var order int
+	if cmp.Target == TxnTargetVersion {
+		switch {
+		case entry.Version < cmp.Version:
+			order = -1
+		case entry.Version > cmp.Version:
+			order = 1
+		}
+	} else {
+		order = bytes.Compare(entry.Value, cmp.Value)
+	}
+	switch cmp.Result {
+	case TxnEqual:
+		return order == 0
+	case TxnNotEqual:
+		return order != 0
+	case TxnLess:
+		return order < 0
+	case TxnGreater:
+		return order > 0
+	}
+	return false
+}
+
+func (node *Node) applyTxnOp(op TxnOp) TxnOpResult {
+	result := TxnOpResult{Op: op.Op, Key: op.Key}
+	switch op.Op {
+	case KVPut:
+		previous, _ := node.readKV(op.Key)
+		result.Version = node.putKV(op.Key, op.Value, 0, previous)
+		result.Found = true
+	case KVGet:
+		entry, found := node.readKV(op.Key)
+		result.Value, result.Version, result.Found = entry.Value, entry.Version, found
+	case KVDelete:
+		deleted := node.applyDelete(Delete{Key: op.Key})
+		result.Found = deleted.Success
+	}
+	return result
+}
+
+// applyTxn evaluates every comparison against the state the entry is applied
+// to and runs one branch in order, so a get sees the puts before it.
+func (node *Node) applyTxn(txn Txn) TxnResult {
+	result := TxnResult{Succeeded: true}
+	for _, cmp := range txn.Compare {
+		if !node.txnCompareHolds(cmp) {
+			result.Succeeded = false
+			break
+		}
+	}
+	ops := txn.Success
+	if !result.Succeeded {
+		ops = txn.Failure
+	}
+	for _, op := range ops {
+		result.Results = append(result.Results, node.applyTxnOp(op))
+	}
+	return result
+}
+
+// CommitTxn submits a transaction and waits for its outcome.
+func CommitTxn(server Submitter, txn Txn) (TxnResult, error) {
+	if err := validateTxn(txn); err != nil {
+		return TxnResult{}, err
+	}
+	success, reply, err := server.SubmitToServer(txn)
+	if err != nil {
+		return TxnResult{}, err
+	}
+	if !success {
+		return TxnResult{}, errors.New("command could not be submitted, try different server")
+	}
+	result, ok := reply.(TxnResult)
+	if !ok {
+		return TxnResult{}, fmt.Errorf("unexpected reply for transaction: %T", reply)
+	}
+	return result, nil
+}
+
+// handleTxnRequest serves transactions sent over the /ws connection.
+func (server *Server) handleTxnRequest(clientID string, env Envelope, txn Txn) {
+	var reply TxnReply
+	if result, err := CommitTxn(server.clientSubmitter(clientID, env), txn); err != nil {
+		reply.Error = err.Error()
+	} else {
+		reply.Success = true
+		reply.Succeeded = result.Succeeded
+		reply.Results = result.Results
+	}
+	server.sendToClient(clientID, env.RequestID, MessageTxn, reply)
+}
@@ -0,0 +1,75 @@
+package raft
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// describeTxnResults renders the operations of a branch as "op key=value@version",
+// with "-" for a key that was not found.
+func describeTxnResults(results []TxnOpResult) string {
+	described := make([]string, 0, len(results))
+	for _, result := range results {
+		if !result.Found {
+			described = append(described, fmt.Sprintf("%s %s -", result.Op, result.Key))
+			continue
+		}
+		described = append(described, fmt.Sprintf("%s %s=%s@%d", result.Op, result.Key, result.Value, result.Version))
+	}
+	return strings.Join(described, ", ")
+}
+
+// Each transaction runs against the keys as the ones before it left them.
+func TestTxnBranches(t *testing.T) {
+	leader := startCluster(t, 3)[0]
+	put := func(key string, value string) TxnOp { return TxnOp{Op: KVPut, Key: key, Value: []byte(value)} }
+	get := func(key string) TxnOp { return TxnOp{Op: KVGet, Key: key} }
+	del := func(key string) TxnOp { return TxnOp{Op: KVDelete, Key: key} }
+	value := func(key string, result string, value string) TxnCompare {
+		return TxnCompare{Key: key, Target: TxnTargetValue, Result: result, Value: []byte(value)}
+	}
+	version := func(key string, result string, version uint64) TxnCompare {
+		return TxnCompare{Key: key, Target: TxnTargetVersion, Result: result, Version: version}
+	}
+	steps := []struct {
+		name      string
+		txn       Txn
+		succeeded bool
+		results   string
+	}{
+		{"no comparisons", Txn{Success: []TxnOp{put("a", "1"), put("b", "2")}},
+			true, "put a=@1, put b=@1"},
+		{"every comparison holds", Txn{
+			Compare: []TxnCompare{value("a", TxnEqual, "1"), version("b", TxnEqual, 1)},
+			Success: []TxnOp{put("a", "3"), get("a")},
+			Failure: []TxnOp{del("b")},
+		}, true, "put a=@2, get a=3@2"},
+		{"one comparison fails", Txn{
+			Compare: []TxnCompare{version("b", TxnEqual, 1), value("a", TxnEqual, "1")},
+			Success: []TxnOp{put("a", "4")},
+			Failure: []TxnOp{del("b"), get("b"), get("a")},
+		}, false, "delete b=@0, get b -, get a=3@2"},
+		{"an absent key is empty at version 0", Txn{
+			Compare: []TxnCompare{version("c", TxnEqual, 0), value("c", TxnLess, "x"), value("c", TxnNotEqual, "x")},
+			Success: []TxnOp{put("c", "5")},
+		}, true, "put c=@1"},
+		{"orderings", Txn{
+			Compare: []TxnCompare{value("a", TxnGreater, "2"), version("a", TxnLess, 2)},
+			Success: []TxnOp{get("a")},
+			Failure: []TxnOp{get("c")},
+		}, false, "get c=5@1"},
+	}
+	for _, step := range steps {
+		result, err := CommitTxn(leader, step.txn)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if got := describeTxnResults(result.Results); result.Succeeded != step.succeeded || got != step.results {
+			t.Errorf("%s: got succeeded %v with %q, want %v with %q", step.name, result.Succeeded, got, step.succeeded, step.results)
+		}
+	}
+	if _, err := CommitTxn(leader, Txn{Compare: []TxnCompare{value("a", TxnEqual, "1")}}); err == nil {
+		t.Error("a transaction without operations was committed")
+	}
+}
@@ -0,0 +1,301 @@
+package raft
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// A watcher is a watch opened by a client connected to this node. Watchers
+// only receive events while the node is leader; clients open them again on
+// the new leader after reconnecting.
+//
+// Messages for the client are queued on the watcher and written by its own
+// goroutine, so a slow connection never holds up the apply loop.
+type watcher struct {
+	id            string
+	clientID      string
+	conn          *websocket.Conn
+	key           string
+	prefix        bool
+	startRevision uint64
+
+	outMu  sync.Mutex
+	outbox []watchMessage
+	closed bool
+	wake   chan struct{}
+}
+
+type watchMessage struct {
+	requestID string
+	payload   interface{}
+}
+
+func newWatcher(id string, clientID string, conn *websocket.Conn, req WatchRequest) *watcher {
+	return &watcher{
+		id:            id,
+		clientID:      clientID,
+		conn:          conn,
+		key:           req.Key,
+		prefix:        req.Prefix,
+		startRevision: req.StartRevision,
+		wake:          make(chan struct{}, 1),
+	}
+}
+
+// queue adds a message for the client and reports whether the watch is still
+// open. A watcher MAX_WATCH_BACKLOG messages behind is cancelled: what it
+// still had queued is replaced by a notice, and the client opens the watch
+// again from the last revision it received.
+func (w *watcher) queue(requestID string, payload interface{}) bool {
+	w.outMu.Lock()
+	defer w.outMu.Unlock()
+	if w.closed {
+		return false
+	}
+	if len(w.outbox) >= MAX_WATCH_BACKLOG {
+		w.outbox = []watchMessage{{payload: WatchResponse{
+			WatchID:  w.id,
+			Canceled: true,
+			Error:    "watch fell too far behind",
+		}}}
+		w.closed = true
+	} else {
+		w.outbox = append(w.outbox, watchMessage{requestID: requestID, payload: payload})
+	}
+	w.signal()
+	return !w.closed
+}
+
+// close stops the watcher once what is already queued has been written.
+func (w *watcher) close() {
+	w.outMu.Lock()
+	w.closed = true
+	w.outMu.Unlock()
+	w.signal()
+}
+
+func (w *watcher) signal() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliverWatch writes the messages queued on w in order until w is closed.
+func (server *Server) deliverWatch(w *watcher) {
+	for range w.wake {
+		w.outMu.Lock()
+		outbox, closed := w.outbox, w.closed
+		w.outbox = nil
+		w.outMu.Unlock()
+		for _, msg := range outbox {
+			server.sendToClient(w.clientID, msg.requestID, MessageWatch, msg.payload)
+		}
+		if closed {
+			return
+		}
+	}
+}
+
+func (w *watcher) matches(key string) bool {
+	if w.prefix {
+		return strings.HasPrefix(key, w.key)
+	}
+	return key == w.key
+}
+
+func watcherKey(clientID string, watchID string) string {
+	return fmt.Sprintf("%s/%s", clientID, watchID)
+}
+
+func watchEventKey(revision uint64) string {
+	return fmt.Sprintf("%s%020d", WATCH_EVENT_PREFIX, revision)
+}
+
+// recordKVEvent notes a change made by the entry being applied; the events
+// are published together once the whole entry has been applied.
+func (node *Node) recordKVEvent(event WatchEvent) {
+	event.Revision = node.applying.Index
+	node.kvEvents = append(node.kvEvents, event)
+}
+
+// publishKVEvents stores the events of the entry just applied in the watch
+// history and, on the leader, queues them for the matching watchers. Both
+// happen under watchMu so a watch being opened either replays the revision
+// or receives it, never both.
+func (node *Node) publishKVEvents() {
+	if len(node.kvEvents) == 0 {
+		return
+	}
+	events := node.kvEvents
+	node.kvEvents = nil
+	revision := events[0].Revision
+	isLeader := node.isLeader()
+
+	node.watchMu.Lock()
+	defer node.watchMu.Unlock()
+	if revision <= node.watchRevision {
+		// the log is applied again after a restart; this revision was
+		// stored, and possibly compacted away, before
+		return
+	}
+	node.setData(watchEventKey(revision), events)
+	node.watchRevision = revision
+	if revision > WATCH_HISTORY_REVISIONS {
+		node.dropWatchEvents(revision - WATCH_HISTORY_REVISIONS)
+	}
+	if !isLeader {
+		return
+	}
+	for key, w := range node.watchers {
+		if revision < w.startRevision {
+			continue
+		}
+		if matching := w.filter(events); len(matching) > 0 {
+			response := WatchResponse{WatchID: w.id, Revision: revision, Events: matching}
+			if !w.queue("", response) {
+				delete(node.watchers, key)
+			}
+		}
+	}
+}
+
+// compactWatchEvents drops the watch events up to revision along with the
+// compacted KV history.
+func (node *Node) compactWatchEvents(revision uint64) {
+	node.watchMu.Lock()
+	defer node.watchMu.Unlock()
+	node.dropWatchEvents(revision)
+}
+
+// dropWatchEvents deletes the events up to revision, so watches can only
+// start after it. watchMu must be held.
+func (node *Node) dropWatchEvents(revision uint64) {
+	if revision <= node.watchCompactRevision {
+		return
+	}
+	node.db.DeleteRange(WATCH_EVENT_PREFIX, watchEventKey(revision+1))
+	node.watchCompactRevision = revision
+}
+
+// restoreWatchRevisions recovers the revisions of the watch history from the
+// events kept in storage: the newest stored event, and the compaction
+// publishKVEvents or a Compact made last.
+func (node *Node) restoreWatchRevisions() {
+	node.watchCompactRevision = node.compactedRevision()
+	last, found := node.db.Last(WATCH_EVENT_PREFIX, prefixEnd(WATCH_EVENT_PREFIX))
+	if !found {
+		return
+	}
+	revision, err := strconv.ParseUint(strings.TrimPrefix(last.Key, WATCH_EVENT_PREFIX), 10, 64)
+	if err != nil {
+		fmt.Printf("Invalid watch event key %s: %v\n", last.Key, err)
+		return
+	}
+	node.watchRevision = revision
+	if revision > WATCH_HISTORY_REVISIONS && revision-WATCH_HISTORY_REVISIONS > node.watchCompactRevision {
+		node.watchCompactRevision = revision - WATCH_HISTORY_REVISIONS
+	}
+}
+
+func (w *watcher) filter(events []WatchEvent) []WatchEvent {
+	var matching []WatchEvent
+	for _, event := range events {
+		if w.matches(event.Key) {
+			matching = append(matching, event)
+		}
+	}
+	return matching
+}
+
+// openWatch registers w and replays the history from its start revision.
+// expects node.watchMu to be held
+func (node *Node) openWatch(w *watcher, requestID string) error {
+	if w.startRevision > 0 && w.startRevision <= node.watchCompactRevision {
+		return fmt.Errorf("revision %d has been compacted, the oldest available is %d",
+			w.startRevision, node.watchCompactRevision+1)
+	}
+	key := watcherKey(w.clientID, w.id)
+	if previous, exists := node.watchers[key]; exists {
+		previous.close()
+	}
+	node.watchers[key] = w
+	go node.server.deliverWatch(w)
+	w.queue(requestID, WatchReply{
+		Success:         true,
+		WatchID:         w.id,
+		Revision:        node.watchRevision,
+		CompactRevision: node.watchCompactRevision,
+	})
+	if w.startRevision == 0 {
+		return nil
+	}
+	for _, entry := range node.db.Range(watchEventKey(w.startRevision), prefixEnd(WATCH_EVENT_PREFIX), 0) {
+		var events []WatchEvent
+		if found, _ := node.readFromStorage(entry.Key, &events); !found || len(events) == 0 {
+			continue
+		}
+		if matching := w.filter(events); len(matching) > 0 {
+			response := WatchResponse{WatchID: w.id, Revision: events[0].Revision, Events: matching}
+			if !w.queue("", response) {
+				delete(node.watchers, key)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// dropWatchers removes the watches opened over conn once it is closed.
+func (node *Node) dropWatchers(conn *websocket.Conn) {
+	node.watchMu.Lock()
+	defer node.watchMu.Unlock()
+	for key, w := range node.watchers {
+		if w.conn == conn {
+			w.close()
+			delete(node.watchers, key)
+		}
+	}
+}
+
+// handleWatchRequest opens or cancels a watch for a client connected over
+// /ws.
+func (server *Server) handleWatchRequest(conn *websocket.Conn, clientID string, env Envelope, req WatchRequest) {
+	node := server.node
+	reply := WatchReply{WatchID: req.WatchID}
+	switch {
+	case req.WatchID == "":
+		reply.Error = "watch id not passed"
+	case req.Op == WatchCreate:
+		if !node.isLeader() {
+			reply.Error = "not the leader"
+			break
+		}
+		node.watchMu.Lock()
+		err := node.openWatch(newWatcher(req.WatchID, clientID, conn, req), env.RequestID)
+		node.watchMu.Unlock()
+		if err == nil {
+			return
+		}
+		reply.Error = err.Error()
+	case req.Op == WatchCancel:
+		node.watchMu.Lock()
+		if w, exists := node.watchers[watcherKey(clientID, req.WatchID)]; exists {
+			w.close()
+			delete(node.watchers, watcherKey(clientID, req.WatchID))
+		}
+		reply.Revision = node.watchRevision
+		node.watchMu.Unlock()
+		reply.Success = true
+	default:
+		server.sendToClient(clientID, env.RequestID, MessageError, ErrorReply{
+			Message: fmt.Sprintf("unknown watch operation %q", req.Op),
+		})
+		return
+	}
+	server.sendToClient(clientID, env.RequestID, MessageWatch, reply)
+}
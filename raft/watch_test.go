@@ -0,0 +1,120 @@
+package raft
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// watchTestMessage is either a WatchReply or a WatchResponse, told apart by
+// whether it carries events.
+type watchTestMessage struct {
+	Success bool         `json:"success"`
+	WatchID string       `json:"watchId"`
+	Events  []WatchEvent `json:"events"`
+	Error   string       `json:"error"`
+}
+
+func sendWatchRequest(t *testing.T, conn *websocket.Conn, req WatchRequest) {
+	t.Helper()
+	sendEnvelope(t, conn, MessageWatch, req.WatchID, req)
+}
+
+func readWatchMessage(t *testing.T, conn *websocket.Conn) watchTestMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var env Envelope
+	if err := conn.ReadJSON(&env); err != nil {
+		t.Fatalf("reading a watch message: %v", err)
+	}
+	var msg watchTestMessage
+	if env.Type != MessageWatch || json.Unmarshal(env.Payload, &msg) != nil {
+		t.Fatalf("got a %s message %s, want a watch message", env.Type, env.Payload)
+	}
+	return msg
+}
+
+// describeWatchEvents renders events as "TYPE key=value", in order.
+func describeWatchEvents(events []WatchEvent) string {
+	described := make([]string, 0, len(events))
+	for _, event := range events {
+		described = append(described, fmt.Sprintf("%s %s=%s", event.Type, event.Key, event.Value))
+	}
+	return strings.Join(described, ", ")
+}
+
+// A watch opened from a past revision first replays the matching changes
+// made since, then streams new ones; one opened from a compacted revision is
+// refused.
+func TestWatchReplaysFromStartRevision(t *testing.T) {
+	leader := startCluster(t, 3)[0]
+	revisionOf := func(key string) uint64 {
+		t.Helper()
+		reply, err := GetVersionedData(leader, key)
+		if err != nil || !reply.Found {
+			t.Fatalf("reading %s: found %v, %v", key, reply.Found, err)
+		}
+		return reply.ModRevision
+	}
+	for _, write := range [][2]string{{"w/a", "1"}, {"w/b", "2"}, {"x/c", "3"}} {
+		if _, err := PutDataIfAbsent(leader, write[0], []byte(write[1])); err != nil {
+			t.Fatalf("writing %s: %v", write[0], err)
+		}
+	}
+	if _, err := CompareAndSwapData(leader, "w/a", []byte("1"), []byte("4")); err != nil {
+		t.Fatalf("swapping w/a: %v", err)
+	}
+	secondWrite, lastWrite := revisionOf("w/b"), revisionOf("w/a")
+
+	conn, _ := dialClient(t, leader, ConnectionRequest{ClientID: "watcher"})
+	cases := []struct {
+		watchID string
+		req     WatchRequest
+		replay  []string
+	}{
+		{"from-second-write", WatchRequest{Key: "w/", Prefix: true, StartRevision: secondWrite}, []string{"PUT w/b=2", "PUT w/a=4"}},
+		{"from-last-write", WatchRequest{Key: "w/", Prefix: true, StartRevision: lastWrite}, []string{"PUT w/a=4"}},
+		{"one-key", WatchRequest{Key: "w/b", StartRevision: 1}, []string{"PUT w/b=2"}},
+		{"from-now", WatchRequest{Key: "w/", Prefix: true}, nil},
+	}
+	for _, c := range cases {
+		c.req.Op, c.req.WatchID = WatchCreate, c.watchID
+		sendWatchRequest(t, conn, c.req)
+		if reply := readWatchMessage(t, conn); !reply.Success || reply.WatchID != c.watchID {
+			t.Fatalf("%s: watch not opened: %+v", c.watchID, reply)
+		}
+		var replayed []string
+		for range c.replay {
+			replayed = append(replayed, describeWatchEvents(readWatchMessage(t, conn).Events))
+		}
+		if got, want := strings.Join(replayed, "; "), strings.Join(c.replay, "; "); got != want {
+			t.Errorf("%s: replayed %q, want %q", c.watchID, got, want)
+		}
+	}
+
+	if _, err := DeleteData(leader, "w/b"); err != nil {
+		t.Fatalf("deleting w/b: %v", err)
+	}
+	streamed := map[string]string{}
+	for range cases {
+		msg := readWatchMessage(t, conn)
+		streamed[msg.WatchID] = describeWatchEvents(msg.Events)
+	}
+	for _, c := range cases {
+		if got := streamed[c.watchID]; got != "DELETE w/b=" {
+			t.Errorf("%s: streamed %q after the delete, want %q", c.watchID, got, "DELETE w/b=")
+		}
+	}
+
+	if _, err := CompactData(leader, lastWrite); err != nil {
+		t.Fatalf("compacting: %v", err)
+	}
+	sendWatchRequest(t, conn, WatchRequest{Op: WatchCreate, WatchID: "compacted", Key: "w/", Prefix: true, StartRevision: secondWrite})
+	if reply := readWatchMessage(t, conn); reply.Success || reply.Error == "" {
+		t.Errorf("a watch from compacted revision %d was opened: %+v", secondWrite, reply)
+	}
+}